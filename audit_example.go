@@ -0,0 +1,95 @@
+/*
+Audit logging keeps a record of who changed what, for compliance.
+
+Every successful mutation records an AuditEntry. The entries go to their own table (audit_log) that the
+service only ever inserts into. Nothing here updates or deletes an entry.
+
+Whether a failed audit write fails the request is a policy decision, so it's configurable:
+- non-fatal (the default): the change stands and the failure is logged at error level for someone to chase.
+- fatal: the client gets a 500. note the change itself has already been made by then. fatal only means
+  nobody is told the change succeeded without it being audited.
+*/
+package examplePackage
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// audit actions.
+const (
+    auditUserCreate = "user.create"
+    auditUserUpdate = "user.update"
+    auditUserRestore = "user.restore"
+)
+
+// AuditEntry is one audited change. UserID is the caller, Target is what was changed (eg. a user's id).
+type AuditEntry struct {
+    RequestID string
+    UserID string
+    Action string
+    Target string
+    Timestamp time.Time
+}
+
+// AuditStore persists audit entries.
+type AuditStore interface {
+    Record(ctx context.Context, entry AuditEntry) error
+}
+
+type sqlAuditStore struct {
+    db *slowQueryDB
+}
+
+func newSQLAuditStore(db *slowQueryDB) *sqlAuditStore {
+    return &sqlAuditStore{db: db}
+}
+
+func (s *sqlAuditStore) Record(ctx context.Context, entry AuditEntry) error {
+    defer ctxpkg.Timer(ctx, "db")()
+
+    _, err := s.db.ExecContext(ctx,
+        `INSERT INTO audit_log (request_id, user_id, action, target, created_at) VALUES ($1, $2, $3, $4, $5)`,
+        entry.RequestID, entry.UserID, entry.Action, entry.Target, entry.Timestamp,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to insert audit entry. %w", err)
+    }
+
+    return nil
+}
+
+// recordAudit records that the caller did action to target.
+// it only returns an error when auditing is fatal, and that error is wrapped with errInternal.
+func (c *Controller) recordAudit(ctx context.Context, action, target string) error {
+    if c.audit == nil {
+        return nil
+    }
+
+    entry := AuditEntry{
+        RequestID: ctxpkg.GetRequestID(ctx),
+        UserID: ctxpkg.GetUserID(ctx),
+        Action: action,
+        Target: target,
+        Timestamp: time.Now().UTC(),
+    }
+
+    err := c.audit.Record(ctx, entry)
+    if err == nil {
+        return nil
+    }
+
+    lf := ctxpkg.LogFields(ctx)
+    lf["audit_action"] = action
+    lf["audit_target"] = target
+    ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("AUDIT WRITE FAILED. change was made but not audited")
+
+    if c.auditFatal {
+        return fmt.Errorf("failed to record audit entry. %s. %w", err, errInternal)
+    }
+
+    return nil
+}
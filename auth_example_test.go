@@ -0,0 +1,113 @@
+package examplePackage
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+var testSigningKey = []byte("test-signing-key")
+
+// signTestToken makes an HS256 jwt the way the auth service does.
+func signTestToken(key []byte, header, claims string) string {
+    enc := base64.RawURLEncoding
+    unsigned := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(unsigned))
+
+    return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestHS256VerifierVerify(t *testing.T) {
+    now := time.Unix(1700000000, 0)
+    hs256 := `{"alg":"HS256","typ":"JWT"}`
+
+    tests := []struct {
+        name string
+        key []byte
+        token string
+        wantErr bool
+        wantSub string
+        wantScopes int
+    }{
+        {"valid", testSigningKey, signTestToken(testSigningKey, hs256, `{"sub":"u_1","scope":"users:admin users:delete","exp":1700000060}`), false, "u_1", 2},
+        {"no scopes", testSigningKey, signTestToken(testSigningKey, hs256, `{"sub":"u_1","exp":1700000060}`), false, "u_1", 0},
+        {"wrong key", testSigningKey, signTestToken([]byte("other"), hs256, `{"sub":"u_1","exp":1700000060}`), true, "", 0},
+        {"expired", testSigningKey, signTestToken(testSigningKey, hs256, `{"sub":"u_1","exp":1700000000}`), true, "", 0},
+        {"no exp", testSigningKey, signTestToken(testSigningKey, hs256, `{"sub":"u_1"}`), true, "", 0},
+        {"no subject", testSigningKey, signTestToken(testSigningKey, hs256, `{"exp":1700000060}`), true, "", 0},
+        {"alg none", testSigningKey, signTestToken(testSigningKey, `{"alg":"none"}`, `{"sub":"u_1","exp":1700000060}`), true, "", 0},
+        {"not a jwt", testSigningKey, "abc", true, "", 0},
+        {"no key", nil, signTestToken(nil, hs256, `{"sub":"u_1","exp":1700000060}`), true, "", 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            v := newHS256Verifier(tt.key)
+            v.now = func() time.Time { return now }
+
+            claims, err := v.Verify(tt.token)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if claims.Subject != tt.wantSub {
+                t.Errorf("Subject = %q, want %q", claims.Subject, tt.wantSub)
+            }
+            if len(claims.Scopes) != tt.wantScopes {
+                t.Errorf("Scopes = %v, want %d of them", claims.Scopes, tt.wantScopes)
+            }
+        })
+    }
+}
+
+// a scope gated route has to be reachable with a valid token. without AuthMiddleware it never is.
+func TestAuthMiddlewareWithRequireScope(t *testing.T) {
+    exp := time.Now().Add(time.Hour).Unix()
+    hs256 := `{"alg":"HS256"}`
+    admin := signTestToken(testSigningKey, hs256, `{"sub":"u_1","scope":"users:admin","exp":`+strconv.FormatInt(exp, 10)+`}`)
+    reader := signTestToken(testSigningKey, hs256, `{"sub":"u_2","scope":"users:read","exp":`+strconv.FormatInt(exp, 10)+`}`)
+
+    tests := []struct {
+        name string
+        authorization string
+        want int
+    }{
+        {"no token", "", http.StatusUnauthorized},
+        {"invalid token", "Bearer nope", http.StatusUnauthorized},
+        {"not bearer", "Basic dTpw", http.StatusUnauthorized},
+        {"missing scope", "Bearer " + reader, http.StatusForbidden},
+        {"has scope", "Bearer " + admin, http.StatusOK},
+        {"lower case scheme", "bearer " + admin, http.StatusOK},
+    }
+
+    ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        if ctxpkg.GetUserID(req.Context()) == "" {
+            t.Error("user id not set from the token's subject")
+        }
+        rw.WriteHeader(http.StatusOK)
+    })
+    h := AuthMiddleware(newHS256Verifier(testSigningKey))(RequireScope(adminScope)(ok))
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodPost, "/v1/user/u_9/restore", nil)
+            if tt.authorization != "" {
+                req.Header.Set("Authorization", tt.authorization)
+            }
+            rw := httptest.NewRecorder()
+
+            h.ServeHTTP(rw, req)
+
+            if rw.Code != tt.want {
+                t.Errorf("status = %d, want %d", rw.Code, tt.want)
+            }
+        })
+    }
+}
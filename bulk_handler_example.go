@@ -0,0 +1,435 @@
+/*
+Bulk endpoints take an array of items and report a result PER ITEM with 207 Multi-Status.
+
+207 means "look at the body". One item failing doesn't fail the request, so the client has to check
+each result's status. The alternative, all-or-nothing, forces a client to retry 99 good items
+because of 1 bad one.
+
+Bulk create is the exception. Its users are inserted in one transaction and it's all or nothing, so a
+client that retries the whole batch never creates the same user twice.
+*/
+package examplePackage
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// the most items a single bulk request may contain. it bounds the transaction size and the request's runtime.
+const maxBulkItems = 100
+
+// patchableColumns is the whitelist of fields a patch may change.
+// the key is the json name the client uses and the value is the sql column.
+var patchableColumns = map[string]string{
+    "full_name": "full_name",
+    "address": "address",
+    "city": "city",
+    "state": "state",
+    "zip_code": "zip_code",
+    "phone": "phone",
+}
+
+// bulkResult is the outcome of one item. Index is the item's position in the request.
+type bulkResult struct {
+    Index int `json:"index"`
+    ID string `json:"id,omitempty"`
+    Status int `json:"status"`
+    Error string `json:"error,omitempty"`
+    // Errors are the field errors of a 422, the same ones a single PATCH gets as problem+json.
+    //   the pointers are into the item, eg. "/fields/zip_code".
+    Errors []problemFieldError `json:"errors,omitempty"`
+}
+
+// PATCH /v1/users/bulk?fail_fast=true
+// by default an invalid patch gets a 400 or 422 in its result and the valid ones are still applied.
+//   with fail_fast the first invalid patch fails the whole request with that status.
+// a 422 has the field errors, the same as a single PATCH.
+func (c *Controller) BulkUpdateUsersHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "BulkUpdateUsers"
+    n := c.negotiator(req)
+
+    results, err := c.handleBulkUpdateUsers(ctx, req)
+    // the client disconnected, so the transaction was rolled back and nobody is left to respond to.
+    if err != nil && errs.Is(ctx.Err(), context.Canceled) {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Warn("client went away. bulk update rolled back")
+        return
+    }
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to bulk update users")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        var ve validationErrors
+        if errs.As(err, &ve) {
+            writeProblem(rw, validationProblem(req, ve))
+        } else if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    n.Respond(rw, http.StatusMultiStatus, response.Success(results))
+}
+
+func (c *Controller) handleBulkUpdateUsers(ctx context.Context, req *http.Request) ([]bulkResult, error) {
+    failFast, err := queryParams(req).Bool("fail_fast", false)
+    if err != nil {
+        return nil, err
+    }
+
+    // each patch's fields are a map, which only json can fill.
+    if err := requireJSONBody(req); err != nil {
+        return nil, err
+    }
+    patches := []userPatch{}
+    if err := decodeRequestBody(req, &patches); err != nil {
+        return nil, err
+    }
+
+    // these are errors with the request as a whole, not any one item.
+    if len(patches) == 0 {
+        return nil, fmt.Errorf("at least one patch is required. %w", errBadRequest)
+    }
+    if len(patches) > maxBulkItems {
+        return nil, fmt.Errorf("at most %d patches are allowed. %w", maxBulkItems, errBadRequest)
+    }
+
+    checked := make([]userPatch, len(patches))
+    batchErrs := validateBatch(len(patches), failFast, func(i int) error {
+        cp, err := validatePatch(ctx, patches[i])
+        checked[i] = cp
+        return err
+    })
+
+    // with fail_fast one invalid patch rejects the whole request, before anything is written.
+    if failFast && len(batchErrs) > 0 {
+        be := batchErrs[0]
+        // the body is the whole array here, so the pointers have to say which item, eg. "/3/fields/zip_code".
+        var ve validationErrors
+        if errs.As(be.Err, &ve) {
+            return nil, fmt.Errorf("item %d. %w. %w", be.Index, ve.under(fmt.Sprintf("%d/fields/", be.Index)), errUnprocessable)
+        }
+        return nil, be
+    }
+
+    invalid := make(map[int]error, len(batchErrs))
+    for _, be := range batchErrs {
+        invalid[be.Index] = be.Err
+    }
+
+    results := make([]bulkResult, len(patches))
+    // valid holds the patches that pass validation and validIdx remembers where each came from,
+    //   so store results can be put back at the right index.
+    valid := make([]userPatch, 0, len(patches))
+    validIdx := make([]int, 0, len(patches))
+    for i, p := range patches {
+        results[i] = bulkResult{Index: i, ID: p.ID}
+
+        if err, ok := invalid[i]; ok {
+            var ve validationErrors
+            if errs.As(err, &ve) {
+                results[i].Status = http.StatusUnprocessableEntity
+                results[i].Error = ve.Error()
+                results[i].Errors = problemFieldErrors(ve.under("fields/"))
+            } else {
+                results[i].Status = http.StatusBadRequest
+                results[i].Error = err.Error()
+            }
+            continue
+        }
+
+        valid = append(valid, checked[i])
+        validIdx = append(validIdx, i)
+    }
+
+    if len(valid) == 0 {
+        return results, nil
+    }
+
+    // no point starting a transaction for a client that's already gone.
+    if err := ctx.Err(); err != nil {
+        return nil, fmt.Errorf("bulk update not started. %s. %w", err, errInternal)
+    }
+
+    storeErrs, err := c.DB.BulkUpdateUsers(ctx, valid)
+    if err != nil {
+        return nil, fmt.Errorf("failed to bulk update users. %s. %w", err, errInternal)
+    }
+
+    for j, err := range storeErrs {
+        r := &results[validIdx[j]]
+        switch {
+        case err == nil:
+            r.Status = http.StatusOK
+            // the cached copy is stale now.
+            c.userCache.Delete(r.ID)
+            // the update is committed either way. with fatal auditing the item just isn't reported as a success.
+            if err := c.recordAudit(ctx, auditUserUpdate, r.ID); err != nil {
+                r.Status = http.StatusInternalServerError
+                r.Error = "failed to record audit entry"
+            }
+        case errs.Is(err, errNotFound):
+            r.Status = http.StatusNotFound
+            r.Error = "user not found"
+        case errs.Is(err, errConflict):
+            // the client's version is stale. same meaning as a failed If-Match on a single update.
+            r.Status = http.StatusPreconditionFailed
+            r.Error = "version conflict"
+        }
+    }
+
+    return results, nil
+}
+
+// POST /v1/users/bulk?fail_fast=true
+// unlike the PATCH every user is created or none is. one invalid request is a 422 for the whole batch
+//   with the field errors of every invalid request, or of only the first with fail_fast.
+// the response is the created users in the request's order.
+func (c *Controller) BulkCreateUsersHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "BulkCreateUsers"
+    n := c.negotiator(req)
+
+    if !c.currentSettings().Enabled {
+        err := &HTTPError{
+            Status: http.StatusServiceUnavailable,
+            Code: codeServiceDisabled,
+            Msg: "user creation is currently disabled",
+            Err: errServiceDisabled,
+        }
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Warn("failed to bulk create users")
+        c.respondHTTPError(rw, req, err)
+        return
+    }
+
+    users, err := c.handleBulkCreateUsers(ctx, req)
+    // the client disconnected, so the transaction was rolled back and nobody is left to respond to.
+    if err != nil && errs.Is(ctx.Err(), context.Canceled) {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Warn("client went away. bulk create rolled back")
+        return
+    }
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to bulk create users")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        var ve validationErrors
+        if errs.As(err, &ve) {
+            writeProblem(rw, validationProblem(req, ve))
+        } else if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errConflict) {
+            n.Respond(rw, http.StatusConflict, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    n.Respond(rw, http.StatusCreated, response.Success(users))
+}
+
+func (c *Controller) handleBulkCreateUsers(ctx context.Context, req *http.Request) ([]createUserResponse, error) {
+    failFast, err := queryParams(req).Bool("fail_fast", false)
+    if err != nil {
+        return nil, err
+    }
+
+    curs := []createUserRequest{}
+    if err := decodeRequestBody(req, &curs); err != nil {
+        return nil, err
+    }
+    if len(curs) == 0 {
+        return nil, fmt.Errorf("at least one user is required. %w", errBadRequest)
+    }
+    if len(curs) > maxBulkItems {
+        return nil, fmt.Errorf("at most %d users are allowed. %w", maxBulkItems, errBadRequest)
+    }
+
+    for i := range curs {
+        curs[i].Normalize()
+    }
+
+    // the body is the whole array, so the pointers have to say which item, eg. "/3/zip_code".
+    if batchErrs := ValidateBatch(curs, failFast); len(batchErrs) > 0 {
+        ve := validationErrors{}
+        for _, be := range batchErrs {
+            var itemErrs validationErrors
+            if errs.As(be.Err, &itemErrs) {
+                ve = append(ve, itemErrs.localize(ctxpkg.GetLocale(ctx)).under(fmt.Sprintf("%d/", be.Index))...)
+            }
+        }
+        return nil, fmt.Errorf("%d of %d users are invalid. %w. %w", len(batchErrs), len(curs), ve, errUnprocessable)
+    }
+
+    // the same as a single create. the plaintext never gets near the store.
+    for i := range curs {
+        if curs[i].Password == "" {
+            continue
+        }
+        hash, err := c.passwordHasher.Hash(curs[i].Password)
+        if err != nil {
+            return nil, fmt.Errorf("failed to hash password. %s. %w", err, errInternal)
+        }
+        curs[i].PasswordHash = hash
+        curs[i].Password = ""
+    }
+
+    // the store checks ctx between inserts and rolls everything back if it's done, so a client that
+    //   goes away part way through leaves no users behind.
+    users, events, err := c.DB.BulkInsertUsers(ctx, curs, userCreatedEvent)
+    if errs.Is(err, errConflict) {
+        return nil, fmt.Errorf("no users were created. %s. %w", err, errConflict)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to bulk insert users. %s. %w", err, errInternal)
+    }
+
+    resps := make([]createUserResponse, len(users))
+    for i, u := range users {
+        resps[i] = createUserResponse{
+            ID: u.ID,
+            CreatedAt: u.CreatedAt.Format(time.RFC3339),
+            UpdatedAt: u.UpdatedAt.Format(time.RFC3339),
+        }
+        if err := c.recordAudit(ctx, auditUserCreate, u.ID); err != nil {
+            return nil, err
+        }
+        c.events.Enqueue(ctx, events[i])
+        c.webhooks.Notify(ctx, resps[i])
+    }
+
+    return resps, nil
+}
+
+// BatchError is one invalid item in a batch. Index is the item's position in the batch.
+type BatchError struct {
+    Index int
+    Err error
+}
+
+func (be BatchError) Error() string {
+    return fmt.Sprintf("item %d: %s", be.Index, be.Err)
+}
+
+// Unwrap lets errors.Is see the item's error, so a BatchError is still eg. errBadRequest.
+func (be BatchError) Unwrap() error {
+    return be.Err
+}
+
+// ValidateBatch validates each request the same way as a single create. the requests must already be
+//   normalized.
+// with failFast it stops at the first invalid request, so there's at most one BatchError. otherwise
+//   every request is validated and there's a BatchError for each invalid one.
+func ValidateBatch(reqs []createUserRequest, failFast bool) []BatchError {
+    return validateBatch(len(reqs), failFast, func(i int) error {
+        return validateCreateUserRequest(reqs[i])
+    })
+}
+
+// validateBatch is the fail fast or collect policy on its own, so it's the same for any kind of item.
+// validate checks the item at index i. with failFast it stops at the first invalid item, so there's at
+//   most one BatchError. otherwise every item is checked and there's a BatchError for each invalid one.
+func validateBatch(n int, failFast bool, validate func(i int) error) []BatchError {
+    batchErrs := []BatchError{}
+    for i := 0; i < n; i++ {
+        err := validate(i)
+        if err == nil {
+            continue
+        }
+
+        batchErrs = append(batchErrs, BatchError{Index: i, Err: err})
+        if failFast {
+            break
+        }
+    }
+
+    return batchErrs
+}
+
+// validatePatch checks a patch and returns a copy with its fields keyed by sql column.
+// it's the same check a single user update runs, which is why it takes and returns one patch.
+// a body that's the wrong shape is errBadRequest. values that break the create rules are
+//   validationErrors, localized for ctx's locale, wrapped with errUnprocessable like a create's.
+func validatePatch(ctx context.Context, p userPatch) (userPatch, error) {
+    if p.ID == "" {
+        return p, fmt.Errorf("id is required. %w", errBadRequest)
+    }
+
+    if len(p.Fields) == 0 {
+        return p, fmt.Errorf("at least one field is required. %w", errBadRequest)
+    }
+
+    // the values are also copied into a createUserRequest so ValidatePartial can check them with the
+    //   same rules as a create. only the fields in the patch are checked.
+    cur := createUserRequest{}
+    present := make(map[string]bool, len(p.Fields))
+    cols := make(map[string]interface{}, len(p.Fields))
+    for k, v := range p.Fields {
+        col, ok := patchableColumns[k]
+        if !ok {
+            return p, fmt.Errorf("%q cannot be updated. %w", k, errBadRequest)
+        }
+
+        // decodeJSON leaves numbers in interface{} as json.Number. the stores get an int.
+        if k == "zip_code" {
+            num, ok := v.(json.Number)
+            if !ok {
+                return p, fmt.Errorf("zip_code must be a number. %w", errBadRequest)
+            }
+            zip, err := num.Int64()
+            if err != nil {
+                return p, fmt.Errorf("zip_code must be a whole number. %w", errBadRequest)
+            }
+            cur.ZipCode = int(zip)
+            v = cur.ZipCode
+        } else {
+            s, ok := v.(string)
+            if !ok {
+                return p, fmt.Errorf("%s must be a string. %w", k, errBadRequest)
+            }
+
+            // strings are normalized the same way as when the user was created.
+            s = normalizeField(k, s)
+            switch k {
+            case "full_name":
+                cur.FullName = s
+            case "address":
+                cur.Address = s
+            case "city":
+                cur.City = s
+            case "state":
+                cur.State = s
+            case "phone":
+                cur.Phone = s
+            }
+            v = s
+        }
+
+        present[k] = true
+        cols[col] = v
+    }
+
+    // same rules as creating a user, so eg. an empty full_name is an error but an empty phone removes it.
+    if ve := cur.ValidatePartial(present); len(ve) > 0 {
+        return p, fmt.Errorf("failed to validate patch. %w. %w", ve.localize(ctxpkg.GetLocale(ctx)), errUnprocessable)
+    }
+
+    p.Fields = cols
+    return p, nil
+}
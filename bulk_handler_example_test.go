@@ -0,0 +1,267 @@
+package examplePackage
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    errs "errors"
+)
+
+func TestValidatePatch(t *testing.T) {
+    tests := []struct {
+        name string
+        fields map[string]interface{}
+        wantStatus int
+        wantField string
+    }{
+        {"valid", map[string]interface{}{"city": "Oakland", "zip_code": json.Number("94607")}, 0, ""},
+        {"empty full_name breaks the create rules", map[string]interface{}{"full_name": ""}, http.StatusUnprocessableEntity, "full_name"},
+        {"not patchable", map[string]interface{}{"email": "a@example.com"}, http.StatusBadRequest, ""},
+        {"wrong type", map[string]interface{}{"zip_code": "94607"}, http.StatusBadRequest, ""},
+        {"no fields", map[string]interface{}{}, http.StatusBadRequest, ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := validatePatch(context.Background(), userPatch{ID: "1", Fields: tt.fields})
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Fatalf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+
+            var ve validationErrors
+            if errs.As(err, &ve) != (tt.wantField != "") {
+                t.Fatalf("validationErrors in err = %v, want them only for a 422", err)
+            }
+            if tt.wantField != "" && ve[0].Field != tt.wantField {
+                t.Errorf("Field = %q, want %q", ve[0].Field, tt.wantField)
+            }
+        })
+    }
+}
+
+func TestBulkUpdateInvalidItems(t *testing.T) {
+    body := `[{"id": "1", "fields": {"full_name": ""}}, {"id": "2", "fields": {"email": "x@example.com"}}]`
+
+    t.Run("per item", func(t *testing.T) {
+        c := &Controller{DB: newMemUserStore()}
+        req := httptest.NewRequest(http.MethodPatch, "/v1/users/bulk", strings.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+
+        results, err := c.handleBulkUpdateUsers(req.Context(), req)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if results[0].Status != http.StatusUnprocessableEntity || len(results[0].Errors) != 1 || results[0].Errors[0].Pointer != "/fields/full_name" {
+            t.Errorf("results[0] = %+v, want a 422 pointing at /fields/full_name", results[0])
+        }
+        if results[1].Status != http.StatusBadRequest || len(results[1].Errors) != 0 {
+            t.Errorf("results[1] = %+v, want a 400 with no field errors", results[1])
+        }
+    })
+
+    t.Run("fail fast", func(t *testing.T) {
+        c := &Controller{DB: newMemUserStore()}
+        req := httptest.NewRequest(http.MethodPatch, "/v1/users/bulk?fail_fast=true", strings.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+
+        _, err := c.handleBulkUpdateUsers(req.Context(), req)
+        var ve validationErrors
+        if !errs.As(err, &ve) || !errs.Is(err, errUnprocessable) {
+            t.Fatalf("err = %v, want validationErrors and errUnprocessable", err)
+        }
+        if ve[0].Field != "0/fields/full_name" {
+            t.Errorf("Field = %q, want it to point into item 0", ve[0].Field)
+        }
+    })
+}
+
+// a stale version fails its own item with a 412 and the rest are still applied.
+func TestBulkUpdateVersionConflict(t *testing.T) {
+    store := newMemUserStore()
+    for _, name := range []string{"Ada", "Bob"} {
+        if _, err := store.InsertUser(context.Background(), createUserRequest{FullName: name}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // user 1 moves on to version 2, so a patch still at version 1 is stale.
+    if err := store.UpdateUser(context.Background(), userPatch{ID: "1", Version: 1, Fields: map[string]interface{}{"city": "Austin"}}); err != nil {
+        t.Fatal(err)
+    }
+
+    c := &Controller{DB: store, userCache: newTTLCache(time.Minute)}
+    body := `[{"id": "1", "version": 1, "fields": {"city": "Oakland"}}, {"id": "2", "version": 1, "fields": {"city": "Oakland"}}]`
+    req := httptest.NewRequest(http.MethodPatch, "/v1/users/bulk", strings.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+
+    results, err := c.handleBulkUpdateUsers(req.Context(), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if results[0].Status != http.StatusPreconditionFailed {
+        t.Errorf("results[0] = %+v, want a 412", results[0])
+    }
+    if results[1].Status != http.StatusOK {
+        t.Errorf("results[1] = %+v, want a 200", results[1])
+    }
+
+    stale, _ := store.GetUser(context.Background(), "1")
+    applied, _ := store.GetUser(context.Background(), "2")
+    if stale.City != "Austin" || applied.City != "Oakland" {
+        t.Errorf("cities = %q and %q, want the stale patch skipped and the other applied", stale.City, applied.City)
+    }
+}
+
+func TestValidateBatch(t *testing.T) {
+    // items 1 and 3 are invalid.
+    validate := func(i int) error {
+        if i%2 == 1 {
+            return errBadRequest
+        }
+        return nil
+    }
+
+    tests := []struct {
+        name string
+        failFast bool
+        want []int
+    }{
+        {"collect", false, []int{1, 3}},
+        {"fail fast", true, []int{1}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := validateBatch(5, tt.failFast, validate)
+            if len(got) != len(tt.want) {
+                t.Fatalf("validateBatch() = %v, want items %v", got, tt.want)
+            }
+            for i, be := range got {
+                if be.Index != tt.want[i] || !errs.Is(be, errBadRequest) {
+                    t.Errorf("batch error %d = %v, want item %d wrapping errBadRequest", i, be, tt.want[i])
+                }
+            }
+        })
+    }
+}
+
+func TestValidateBatchCreateRequests(t *testing.T) {
+    valid := createUserRequest{FullName: "Ada", Address: "1 Main St", City: "Austin", State: "TX", ZipCode: 78701}
+    noName := valid
+    noName.FullName = ""
+    noZip := valid
+    noZip.ZipCode = 0
+    reqs := []createUserRequest{valid, noName, valid, noZip}
+
+    tests := []struct {
+        name string
+        failFast bool
+        want []int
+    }{
+        {"collect", false, []int{1, 3}},
+        {"fail fast", true, []int{1}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := ValidateBatch(reqs, tt.failFast)
+            if len(got) != len(tt.want) {
+                t.Fatalf("ValidateBatch() = %v, want items %v", got, tt.want)
+            }
+            for i, be := range got {
+                var ve validationErrors
+                if be.Index != tt.want[i] || !errs.As(be, &ve) {
+                    t.Errorf("batch error %d = %v, want item %d with validation errors", i, be, tt.want[i])
+                }
+            }
+        })
+    }
+
+    if got := ValidateBatch([]createUserRequest{valid, valid}, false); len(got) != 0 {
+        t.Errorf("ValidateBatch() of valid requests = %v, want none", got)
+    }
+}
+
+// cancelling part way through stops the insert loop, and what was already inserted is rolled back.
+func TestBulkInsertUsersCanceled(t *testing.T) {
+    store := newMemUserStore()
+    curs := make([]createUserRequest, 5)
+    for i := range curs {
+        curs[i] = createUserRequest{FullName: "Ada", Address: "1 Main St", City: "Austin", State: "TX", ZipCode: 78701}
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    built := 0
+    // the client goes away right after the second user is inserted.
+    newEvent := func(u userRecord) (event, error) {
+        built++
+        if built == 2 {
+            cancel()
+        }
+        return userCreatedEvent(u)
+    }
+
+    users, _, err := store.BulkInsertUsers(ctx, curs, newEvent)
+    if !errs.Is(err, context.Canceled) {
+        t.Fatalf("BulkInsertUsers() = %v, %v, want %v", users, err, context.Canceled)
+    }
+    if built != 2 {
+        t.Errorf("%d users inserted before stopping, want 2", built)
+    }
+
+    n, _ := store.CountUsers(context.Background(), userFilter{IncludeDeleted: true})
+    pending, _ := store.PendingEvents(context.Background(), 10)
+    if n != 0 || len(pending) != 0 {
+        t.Errorf("%d users and %d events left after the rollback, want none", n, len(pending))
+    }
+}
+
+// one invalid user fails the whole batch, and nothing is created.
+func TestBulkCreateUsers(t *testing.T) {
+    valid := `{"full_name":"Ada","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701}`
+    invalid := `{"full_name":"","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701}`
+
+    tests := []struct {
+        name string
+        body string
+        wantStatus int
+        wantUsers int
+    }{
+        {"all valid", "[" + valid + "," + valid + "]", 0, 2},
+        {"one invalid", "[" + valid + "," + invalid + "]", http.StatusUnprocessableEntity, 0},
+        {"empty", "[]", http.StatusBadRequest, 0},
+        {"taken email", `[{"full_name":"Ada","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701,"email":"a@example.com"},` +
+            `{"full_name":"Bob","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701,"email":"A@example.com"}]`, http.StatusConflict, 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := newMemUserStore()
+            c := &Controller{DB: store}
+            req := httptest.NewRequest(http.MethodPost, "/v1/users/bulk", strings.NewReader(tt.body))
+            req.Header.Set("Content-Type", "application/json")
+
+            resps, err := c.handleBulkCreateUsers(req.Context(), req)
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Fatalf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+
+            var ve validationErrors
+            if tt.wantStatus == http.StatusUnprocessableEntity && (!errs.As(err, &ve) || ve[0].Field != "1/full_name") {
+                t.Errorf("err = %v, want a field error pointing at 1/full_name", err)
+            }
+            if err == nil && len(resps) != tt.wantUsers {
+                t.Errorf("%d users in the response, want %d", len(resps), tt.wantUsers)
+            }
+            if n, _ := store.CountUsers(req.Context(), userFilter{}); n != tt.wantUsers {
+                t.Errorf("%d users stored, want %d", n, tt.wantUsers)
+            }
+        })
+    }
+}
@@ -0,0 +1,169 @@
+/*
+A small in-memory cache for reads that are hit far more often than the data changes (eg. GetUser).
+
+The cache is behind an interface so the in-memory version can be swapped for redis/memcached when
+there's more than one instance of the service, and so metrics can be added by wrapping it rather
+than editing every implementation.
+*/
+package examplePackage
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache is a key/value cache. Get's bool is false on a miss (including an expired entry).
+// Delete's bool is whether there was a live entry to delete, the same as a redis DEL returning 1.
+type Cache interface {
+    Get(key string) (interface{}, bool)
+    Set(key string, val interface{})
+    Delete(key string) bool
+}
+
+type ttlEntry struct {
+    val interface{}
+    expires time.Time
+}
+
+// ttlCache expires entries ttl after they're set.
+// an expired entry is removed when it's read, or by sweep. a key that's never read again (eg. almost
+//   every idempotency key) is only ever removed by sweep, so a cache with an unbounded key space needs it running.
+type ttlCache struct {
+    mu sync.RWMutex
+    entries map[string]ttlEntry
+    ttl time.Duration
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+    return &ttlCache{
+        entries: make(map[string]ttlEntry),
+        ttl: ttl,
+    }
+}
+
+func (tc *ttlCache) Get(key string) (interface{}, bool) {
+    tc.mu.RLock()
+    e, ok := tc.entries[key]
+    tc.mu.RUnlock()
+
+    if !ok {
+        return nil, false
+    }
+
+    if time.Now().After(e.expires) {
+        tc.Delete(key)
+        return nil, false
+    }
+
+    return e.val, true
+}
+
+func (tc *ttlCache) Set(key string, val interface{}) {
+    tc.mu.Lock()
+    tc.entries[key] = ttlEntry{val: val, expires: time.Now().Add(tc.ttl)}
+    tc.mu.Unlock()
+}
+
+// Delete reports false for an expired entry. it was already gone as far as a Get can tell.
+func (tc *ttlCache) Delete(key string) bool {
+    tc.mu.Lock()
+    defer tc.mu.Unlock()
+
+    e, ok := tc.entries[key]
+    delete(tc.entries, key)
+    return ok && !time.Now().After(e.expires)
+}
+
+// sweep removes the expired entries every interval until ctx is done.
+func (tc *ttlCache) sweep(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            tc.evictExpired(time.Now())
+        }
+    }
+}
+
+// evictExpired removes every entry that expired before now.
+func (tc *ttlCache) evictExpired(now time.Time) {
+    tc.mu.Lock()
+    defer tc.mu.Unlock()
+
+    for key, e := range tc.entries {
+        if now.After(e.expires) {
+            delete(tc.entries, key)
+        }
+    }
+}
+
+// the counters are labeled by cache name so the user and idempotency caches report separately
+//   from one set of metrics. hit ratio = hits / (hits + misses).
+var (
+    cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "cache_hits_total",
+        Help: "Number of cache lookups that found a value.",
+    }, []string{"cache"})
+
+    cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "cache_misses_total",
+        Help: "Number of cache lookups that found nothing.",
+    }, []string{"cache"})
+
+    cacheInvalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "cache_invalidations_total",
+        Help: "Number of cache entries deleted before they expired.",
+    }, []string{"cache"})
+)
+
+func init() {
+    prometheus.MustRegister(cacheHits, cacheMisses, cacheInvalidations)
+}
+
+// instrumentedCache counts hits, misses, and invalidations for the Cache it wraps.
+// because it's a Cache itself, callers can't tell it's there.
+type instrumentedCache struct {
+    Cache
+    hits prometheus.Counter
+    misses prometheus.Counter
+    invalidations prometheus.Counter
+}
+
+// newInstrumentedCache looks up the labeled counters once, instead of on every Get.
+func newInstrumentedCache(name string, c Cache) instrumentedCache {
+    return instrumentedCache{
+        Cache: c,
+        hits: cacheHits.WithLabelValues(name),
+        misses: cacheMisses.WithLabelValues(name),
+        invalidations: cacheInvalidations.WithLabelValues(name),
+    }
+}
+
+func (ic instrumentedCache) Get(key string) (interface{}, bool) {
+    val, ok := ic.Cache.Get(key)
+    if ok {
+        ic.hits.Inc()
+    } else {
+        ic.misses.Inc()
+    }
+
+    return val, ok
+}
+
+// Delete only counts an invalidation when there was something to invalidate. an update to a user
+//   that was never read, or whose entry already expired, deletes nothing.
+func (ic instrumentedCache) Delete(key string) bool {
+    deleted := ic.Cache.Delete(key)
+    if deleted {
+        ic.invalidations.Inc()
+    }
+
+    return deleted
+}
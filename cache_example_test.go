@@ -0,0 +1,48 @@
+package examplePackage
+
+import (
+    "testing"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// counters of their own, not the registered ones, so the counts start at zero.
+func newTestInstrumentedCache(c Cache) instrumentedCache {
+    return instrumentedCache{
+        Cache: c,
+        hits: prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"}),
+        misses: prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"}),
+        invalidations: prometheus.NewCounter(prometheus.CounterOpts{Name: "invalidations"}),
+    }
+}
+
+func TestInstrumentedCacheCounts(t *testing.T) {
+    tc := newTTLCache(time.Minute)
+    ic := newTestInstrumentedCache(tc)
+
+    ic.Get("1")
+    ic.Set("1", "Ada")
+    ic.Get("1")
+    ic.Get("1")
+
+    // only the first of these deletes anything.
+    ic.Delete("1")
+    ic.Delete("1")
+    ic.Delete("never set")
+    tc.entries["expired"] = ttlEntry{val: "Bob", expires: time.Now().Add(-time.Second)}
+    ic.Delete("expired")
+
+    counts := map[string]float64{
+        "hits": testutil.ToFloat64(ic.hits),
+        "misses": testutil.ToFloat64(ic.misses),
+        "invalidations": testutil.ToFloat64(ic.invalidations),
+    }
+    want := map[string]float64{"hits": 2, "misses": 1, "invalidations": 1}
+    for name, n := range want {
+        if counts[name] != n {
+            t.Errorf("%s = %v, want %v", name, counts[name], n)
+        }
+    }
+}
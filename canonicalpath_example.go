@@ -0,0 +1,81 @@
+/*
+Trailing slashes.
+
+vestigo routes /v1/users and /v1/users/ as two different paths, and only the first one exists. clients
+append slashes more often than you'd think (string concatenation, some http libraries), and get a 404
+for a route that's right there.
+
+CanonicalPathMiddleware handles a path that ends in a slash, per the "trailing_slash" setting:
+- "redirect" (the default) sends the client to the path without it. it's 301 for GET and HEAD and 308
+  for everything else, because a 301 lets clients turn a POST into a GET and drop the body.
+- "rewrite" serves the path without it, as if that's what was asked for.
+- "reject" is a 404 whose message says the slash is the problem.
+"/" itself is never changed.
+*/
+package examplePackage
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+const (
+    trailingSlashRedirect = "redirect"
+    trailingSlashRewrite = "rewrite"
+    trailingSlashReject = "reject"
+)
+
+var trailingSlashPolicies = map[string]bool{
+    trailingSlashRedirect: true,
+    trailingSlashRewrite: true,
+    trailingSlashReject: true,
+}
+
+// trailingSlashPolicy reads the policy from the current settings, so a reload changes it.
+func (c *Controller) trailingSlashPolicy() string {
+    return c.currentSettings().TrailingSlash
+}
+
+// CanonicalPathMiddleware reads policy on every request. anything it doesn't recognize is treated as redirect.
+func CanonicalPathMiddleware(policy func() string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            path := req.URL.Path
+            if path == "/" || !strings.HasSuffix(path, "/") {
+                next.ServeHTTP(rw, req)
+                return
+            }
+
+            // all of them, so /v1/users// ends up in the same place as /v1/users/.
+            canonical := strings.TrimRight(path, "/")
+            if canonical == "" {
+                canonical = "/"
+            }
+
+            switch policy() {
+            case trailingSlashRewrite:
+                // a shallow copy of the url is enough since only the path changes.
+                u := *req.URL
+                u.Path = canonical
+                u.RawPath = ""
+                req.URL = &u
+                next.ServeHTTP(rw, req)
+            case trailingSlashReject:
+                err := fmt.Errorf("%s has a trailing slash. use %s. %w", path, canonical, errNotFound)
+                getNegotiator(req).Respond(rw, http.StatusNotFound, response.Error(err))
+            default:
+                u := *req.URL
+                u.Path = canonical
+                u.RawPath = ""
+
+                status := http.StatusPermanentRedirect
+                if req.Method == http.MethodGet || req.Method == http.MethodHead {
+                    status = http.StatusMovedPermanently
+                }
+                // relative, like the pagination links, so it works behind any proxy.
+                http.Redirect(rw, req, u.RequestURI(), status)
+            }
+        })
+    }
+}
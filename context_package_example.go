@@ -28,6 +28,13 @@ package context
 
 import (
     "context"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+
+    "github.com/sirupsen/logrus"
 )
 
 // context.WithValue() needs a key. I define a context key as a struct{} to avoid
@@ -42,6 +49,29 @@ type (
 type mainContext struct {
     RequestID string
     IPAddress string
+    TraceID string
+    // UserID is the authenticated caller, if there is one.
+    UserID string
+    Claims Claims
+    // Locale is the caller's preferred language from Accept-Language, eg. "es". empty means the default.
+    Locale string
+    // Sampled requests log at debug level. see Logger.
+    Sampled bool
+    // FeatureFlags are the flags for this request only. read them with IsEnabled.
+    FeatureFlags map[string]bool
+
+    // Timings is a pointer because mainContext is copied on every Set. every copy must share one
+    //   set of timings, otherwise a phase recorded deep in a handler would be lost.
+    Timings *phaseTimings
+}
+
+// Claims are what the auth middleware learned from the caller's token.
+// they are request-scoped like everything else in mainContext. they only live as long as the request's
+//   context and must never be persisted or cached across requests. a token's scopes can be revoked.
+type Claims struct {
+    Subject string
+    Scopes []string
+    ExpiresAt time.Time
 }
 
 // mainContextKey and mainContext are not exportable because the first letter is not capitalized.
@@ -71,6 +101,35 @@ func GetMainContext(ctx context.Context) mainContext {
     return mainContext{}
 }
 
+// MainContext lets other packages name the type in a WithValues callback:
+//
+// ctx = ctxpkg.WithValues(ctx, func(d *ctxpkg.MainContext) { ... })
+//
+// it's an alias, not a new type, so it IS mainContext. there's still no way to create a context key
+//   or store a value except through the functions in this package.
+type MainContext = mainContext
+
+// Clone returns a copy of the request's mainContext.
+// GetMainContext already returns a copy (it returns a value, not a pointer), so this is the same thing
+//   with a name that says it's safe to modify. changing the copy doesn't change the context.
+// Timings is the exception. it's a pointer, so the copy shares it, which is what every copy should do.
+func Clone(ctx context.Context) mainContext {
+    return GetMainContext(ctx)
+}
+
+// WithValues sets several fields with one lookup and one context.WithValue, instead of one of each per field.
+// fn gets a pointer to a copy of the current data, so it can change as many fields as it wants.
+//
+// ctx = ctxpkg.WithValues(ctx, func(d *ctxpkg.MainContext) {
+//     d.RequestID = requestID
+//     d.IPAddress = ipAddress
+// })
+func WithValues(ctx context.Context, fn func(*mainContext)) context.Context {
+    data := GetMainContext(ctx)
+    fn(&data)
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
 func SetRequestID(ctx context.Context, requestID string) context.Context {
     data := GetMainContext(ctx)
     data.RequestID = requestID
@@ -82,6 +141,258 @@ func GetRequestID(ctx context.Context) string {
     return data.RequestID
 }
 
+func SetIPAddress(ctx context.Context, ipAddress string) context.Context {
+    data := GetMainContext(ctx)
+    data.IPAddress = ipAddress
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+func GetIPAddress(ctx context.Context) string {
+    data := GetMainContext(ctx)
+    return data.IPAddress
+}
+
+func SetUserID(ctx context.Context, userID string) context.Context {
+    data := GetMainContext(ctx)
+    data.UserID = userID
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+func GetUserID(ctx context.Context) string {
+    data := GetMainContext(ctx)
+    return data.UserID
+}
+
+func SetClaims(ctx context.Context, claims Claims) context.Context {
+    data := GetMainContext(ctx)
+    data.Claims = claims
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+// GetClaims returns a zero value Claims when nothing was set, never nil, so callers don't need nil checks.
+// an empty Subject means the request isn't authenticated.
+func GetClaims(ctx context.Context) Claims {
+    data := GetMainContext(ctx)
+    return data.Claims
+}
+
+// HasScope reports whether the caller's claims include scope.
+func HasScope(ctx context.Context, scope string) bool {
+    for _, s := range GetClaims(ctx).Scopes {
+        if s == scope {
+            return true
+        }
+    }
+
+    return false
+}
+
+func SetLocale(ctx context.Context, locale string) context.Context {
+    data := GetMainContext(ctx)
+    data.Locale = locale
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+func GetLocale(ctx context.Context) string {
+    data := GetMainContext(ctx)
+    return data.Locale
+}
+
+// LogFields returns the correlation ids in ctx as logrus fields, so every log line can be tied back
+//   to its request without each handler building the fields itself:
+//
+// logrus.WithFields(ctxpkg.LogFields(ctx)).WithField("handler", "CreateUser")
+//
+// empty values are left out rather than logged as "". a new map is returned every call, so the
+//   caller can add to it.
+// every value can come from the client (eg. X-Request-ID), so they all go through SanitizeLogValue.
+func LogFields(ctx context.Context) logrus.Fields {
+    data := GetMainContext(ctx)
+    lf := make(logrus.Fields, 4)
+
+    if data.RequestID != "" {
+        lf["request_id"] = SanitizeLogValue(data.RequestID)
+    }
+    if data.IPAddress != "" {
+        lf["ip_address"] = SanitizeLogValue(data.IPAddress)
+    }
+    if data.UserID != "" {
+        lf["user_id"] = SanitizeLogValue(data.UserID)
+    }
+    if data.TraceID != "" {
+        lf["trace_id"] = SanitizeLogValue(data.TraceID)
+    }
+    if data.Sampled {
+        lf["sampled"] = true
+    }
+
+    return lf
+}
+
+// SanitizeLogValue escapes control characters in s, so a value the client sent can't start a forged
+//   line or hide part of a real one when it's logged. a newline becomes the two characters \n, and
+//   any other control character becomes \u followed by its code, eg. \u001b.
+// it's only for what's logged. the value that's stored or used is never changed.
+func SanitizeLogValue(s string) string {
+    // most values have nothing to escape, and they're returned without allocating.
+    if strings.IndexFunc(s, needsEscape) == -1 {
+        return s
+    }
+
+    var b strings.Builder
+    b.Grow(len(s) + 8)
+    for _, r := range s {
+        switch {
+        case r == '\n':
+            b.WriteString(`\n`)
+        case r == '\r':
+            b.WriteString(`\r`)
+        case r == '\t':
+            b.WriteString(`\t`)
+        case needsEscape(r):
+            fmt.Fprintf(&b, `\u%04x`, r)
+        default:
+            b.WriteRune(r)
+        }
+    }
+
+    return b.String()
+}
+
+// needsEscape is true for control characters, and for the unicode line and paragraph separators
+//   that some log viewers also break lines on.
+func needsEscape(r rune) bool {
+    return unicode.IsControl(r) || r == '\u2028' || r == '\u2029'
+}
+
+func SetSampled(ctx context.Context, sampled bool) context.Context {
+    data := GetMainContext(ctx)
+    data.Sampled = sampled
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+func IsSampled(ctx context.Context) bool {
+    data := GetMainContext(ctx)
+    return data.Sampled
+}
+
+// SetFeatureFlags replaces the request's flags. flags must not be changed afterwards, every copy of
+//   mainContext shares it.
+func SetFeatureFlags(ctx context.Context, flags map[string]bool) context.Context {
+    data := GetMainContext(ctx)
+    data.FeatureFlags = flags
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+// IsEnabled is false for a flag that isn't set, so a new flag is off until it's turned on.
+func IsEnabled(ctx context.Context, flag string) bool {
+    data := GetMainContext(ctx)
+    return data.FeatureFlags[flag]
+}
+
+// Logger is the logger for the request, with LogFields already on it.
+// a sampled request gets a copy of the standard logger at debug level, so its debug lines are written
+//   whatever the configured level. any other request gets the standard logger as it's configured.
+// use it instead of logrus.WithFields so the sampling decision is respected:
+//
+// ctxpkg.Logger(ctx).WithFields(lf).Debug("...")
+func Logger(ctx context.Context) *logrus.Entry {
+    if !IsSampled(ctx) {
+        return logrus.WithFields(LogFields(ctx))
+    }
+
+    // built per call, which is fine because only sampled requests get here, and it means a change to
+    //   the standard logger's format (eg. ConfigureLogging) is always picked up.
+    std := logrus.StandardLogger()
+    verbose := &logrus.Logger{
+        Out: std.Out,
+        Formatter: std.Formatter,
+        Hooks: std.Hooks,
+        Level: logrus.DebugLevel,
+        ExitFunc: std.ExitFunc,
+        ReportCaller: std.ReportCaller,
+    }
+
+    return verbose.WithFields(LogFields(ctx))
+}
+
+func SetTraceID(ctx context.Context, traceID string) context.Context {
+    data := GetMainContext(ctx)
+    data.TraceID = traceID
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+func GetTraceID(ctx context.Context) string {
+    data := GetMainContext(ctx)
+    return data.TraceID
+}
+
+// phaseTimings adds up how long each phase of a request took (eg. "validation", "db").
+// the mutex is needed because phases can run in parallel goroutines.
+type phaseTimings struct {
+    mu sync.Mutex
+    durations map[string]time.Duration
+}
+
+// StartTimings gives the request somewhere to record phase timings. the request log middleware calls it.
+func StartTimings(ctx context.Context) context.Context {
+    data := GetMainContext(ctx)
+    data.Timings = &phaseTimings{durations: make(map[string]time.Duration)}
+    return context.WithValue(ctx, mainContextKey{}, data)
+}
+
+// Timer starts timing phase and returns the func that stops it. the intended use is
+//
+// defer ctxpkg.Timer(ctx, "db")()
+//
+// a phase timed more than once (eg. two queries) is added up.
+// if StartTimings wasn't called, nothing is recorded. timing must never break a request.
+func Timer(ctx context.Context, phase string) func() {
+    t := GetMainContext(ctx).Timings
+    if t == nil {
+        return func() {}
+    }
+
+    start := time.Now()
+    return func() {
+        d := time.Since(start)
+
+        t.mu.Lock()
+        t.durations[phase] += d
+        t.mu.Unlock()
+    }
+}
+
+// GetTimings returns a copy of the recorded phases. it's a copy so the caller can read it without the lock.
+func GetTimings(ctx context.Context) map[string]time.Duration {
+    t := GetMainContext(ctx).Timings
+    if t == nil {
+        return nil
+    }
+
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    durations := make(map[string]time.Duration, len(t.durations))
+    for phase, d := range t.durations {
+        durations[phase] = d
+    }
+
+    return durations
+}
+
+// RemainingBudget returns how much time is left before ctx's deadline.
+// the bool is false when ctx has no deadline, in which case the duration means nothing.
+// a negative duration means the deadline already passed.
+func RemainingBudget(ctx context.Context) (time.Duration, bool) {
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        return 0, false
+    }
+
+    return time.Until(deadline), true
+}
+
 /*
 The logic used in the Getters and Setters shows how I only deal with one object.
 Since context.WithValue() returns a copy of the context, I want to avoid calling it multiple times.
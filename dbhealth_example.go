@@ -0,0 +1,109 @@
+/*
+Database health for /readyz.
+
+An instance that can't reach the database can't serve anything, so /readyz should fail and the load
+balancer should route around it. But load balancers probe often (every second or more, from several
+of them), and pinging the database on every probe would put load on it that grows with the number
+of probes, not the traffic.
+
+So dbHealth pings in the background once per interval and /readyz only reads the last result. a
+probe costs a lock, no matter how often it comes.
+*/
+package examplePackage
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/sirupsen/logrus"
+)
+
+type dbHealthConfig struct {
+    // Interval is the time between pings, so it's also how stale the status can be.
+    Interval time.Duration
+    // Timeout bounds each ping. a ping that times out counts as unhealthy.
+    Timeout time.Duration
+}
+
+var defaultDBHealthConfig = dbHealthConfig{
+    Interval: 2 * time.Second,
+    Timeout: time.Second,
+}
+
+// dbHealthStatus is the result of the last ping.
+// LastOK is when a ping last succeeded. it's zero if none ever has.
+type dbHealthStatus struct {
+    Healthy bool
+    CheckedAt time.Time
+    LastOK time.Time
+    Err error
+}
+
+type dbHealth struct {
+    cfg dbHealthConfig
+    // ping is db.PingContext in main.
+    ping func(context.Context) error
+
+    mu sync.RWMutex
+    status dbHealthStatus
+}
+
+func newDBHealth(cfg dbHealthConfig, ping func(context.Context) error) *dbHealth {
+    return &dbHealth{cfg: cfg, ping: ping}
+}
+
+// Run pings right away, then once per interval until ctx is done.
+// until the first ping finishes the status is unhealthy, so an instance isn't ready before it has
+//   seen the database.
+func (h *dbHealth) Run(ctx context.Context) {
+    ticker := time.NewTicker(h.cfg.Interval)
+    defer ticker.Stop()
+
+    for {
+        h.check(ctx)
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (h *dbHealth) check(ctx context.Context) {
+    pingCtx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+    err := h.ping(pingCtx)
+    cancel()
+
+    now := time.Now()
+
+    h.mu.Lock()
+    wasHealthy := h.status.Healthy
+    // the first ping is a transition too. there's no previous status, healthy or not.
+    first := h.status.CheckedAt.IsZero()
+    h.status.Healthy = err == nil
+    h.status.CheckedAt = now
+    h.status.Err = err
+    if err == nil {
+        h.status.LastOK = now
+    }
+    lastOK := h.status.LastOK
+    h.mu.Unlock()
+
+    // only transitions are logged. a database that's down for an hour is one line, not 1800.
+    switch {
+    case err != nil && (wasHealthy || first):
+        logrus.WithError(err).WithField("last_ok", lastOK).Error("database became unhealthy")
+    case err == nil && !wasHealthy:
+        logrus.Info("database is healthy")
+    }
+}
+
+// Status is the result of the last ping. it never touches the database.
+func (h *dbHealth) Status() dbHealthStatus {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    return h.status
+}
@@ -0,0 +1,158 @@
+/*
+Connection pool tuning for the *sql.DB.
+
+database/sql's defaults suit a script, not a web service. with no limit on open connections a traffic
+spike opens as many as there are requests, until the database refuses more. and with only 2 idle
+connections kept, every burst after a quiet moment pays to open new ones.
+
+The values come from settings ("db" in userSettingsData). anything left out falls back to defaultDBConfig.
+*/
+package examplePackage
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// DBConfig is applied to the pool with SetMaxOpenConns etc.
+// the json tags are only names, for applyDefaults' log line. encoding goes through dbConfigJSON.
+type DBConfig struct {
+    MaxOpenConns int `json:"max_open_conns"`
+    MaxIdleConns int `json:"max_idle_conns"`
+    ConnMaxLifetime time.Duration `json:"conn_max_lifetime"`
+    ConnMaxIdleTime time.Duration `json:"conn_max_idle_time"`
+    // SlowQueryThreshold isn't a pool setting, but it's about the same database. see slowquery_example.go.
+    SlowQueryThreshold time.Duration `json:"slow_query_threshold"`
+}
+
+// defaultDBConfig suits a typical web service sharing a database with a few other instances.
+// - 25 open connections per instance. multiply by the instance count and keep it under the database's
+//   max_connections, with room left for migrations and humans.
+// - as many idle as open, so a burst reuses connections instead of opening new ones.
+// - connections are recycled every 30 minutes so load spreads again after a database failover or scale up.
+// - a connection idle for 5 minutes is closed, so a quiet instance gives its connections back.
+var defaultDBConfig = DBConfig{
+    MaxOpenConns: 25,
+    MaxIdleConns: 25,
+    ConnMaxLifetime: 30 * time.Minute,
+    ConnMaxIdleTime: 5 * time.Minute,
+    SlowQueryThreshold: defaultSlowQueryThreshold,
+}
+
+// dbConfigJSON is DBConfig as it's written in settings. the durations are strings like "30m", because
+//   a bare time.Duration would have to be written in nanoseconds.
+type dbConfigJSON struct {
+    MaxOpenConns int `json:"max_open_conns"`
+    MaxIdleConns int `json:"max_idle_conns"`
+    ConnMaxLifetime string `json:"conn_max_lifetime,omitempty"`
+    ConnMaxIdleTime string `json:"conn_max_idle_time,omitempty"`
+    SlowQueryThreshold string `json:"slow_query_threshold,omitempty"`
+}
+
+func (dc DBConfig) MarshalJSON() ([]byte, error) {
+    raw := dbConfigJSON{MaxOpenConns: dc.MaxOpenConns, MaxIdleConns: dc.MaxIdleConns}
+    if dc.ConnMaxLifetime != 0 {
+        raw.ConnMaxLifetime = dc.ConnMaxLifetime.String()
+    }
+    if dc.ConnMaxIdleTime != 0 {
+        raw.ConnMaxIdleTime = dc.ConnMaxIdleTime.String()
+    }
+    if dc.SlowQueryThreshold != 0 {
+        raw.SlowQueryThreshold = dc.SlowQueryThreshold.String()
+    }
+
+    return json.Marshal(raw)
+}
+
+func (dc *DBConfig) UnmarshalJSON(b []byte) error {
+    raw := dbConfigJSON{}
+    if err := json.Unmarshal(b, &raw); err != nil {
+        return err
+    }
+
+    dc.MaxOpenConns = raw.MaxOpenConns
+    dc.MaxIdleConns = raw.MaxIdleConns
+
+    var err error
+    if raw.ConnMaxLifetime != "" {
+        if dc.ConnMaxLifetime, err = time.ParseDuration(raw.ConnMaxLifetime); err != nil {
+            return fmt.Errorf("conn_max_lifetime. %w", err)
+        }
+    }
+    if raw.ConnMaxIdleTime != "" {
+        if dc.ConnMaxIdleTime, err = time.ParseDuration(raw.ConnMaxIdleTime); err != nil {
+            return fmt.Errorf("conn_max_idle_time. %w", err)
+        }
+    }
+    if raw.SlowQueryThreshold != "" {
+        if dc.SlowQueryThreshold, err = time.ParseDuration(raw.SlowQueryThreshold); err != nil {
+            return fmt.Errorf("slow_query_threshold. %w", err)
+        }
+    }
+
+    return nil
+}
+
+// withDefaults fills every zero field from defaultDBConfig.
+func (dc DBConfig) withDefaults() DBConfig {
+    if dc.MaxOpenConns == 0 {
+        dc.MaxOpenConns = defaultDBConfig.MaxOpenConns
+    }
+    if dc.MaxIdleConns == 0 {
+        dc.MaxIdleConns = defaultDBConfig.MaxIdleConns
+    }
+    if dc.ConnMaxLifetime == 0 {
+        dc.ConnMaxLifetime = defaultDBConfig.ConnMaxLifetime
+    }
+    if dc.ConnMaxIdleTime == 0 {
+        dc.ConnMaxIdleTime = defaultDBConfig.ConnMaxIdleTime
+    }
+    if dc.SlowQueryThreshold == 0 {
+        dc.SlowQueryThreshold = defaultDBConfig.SlowQueryThreshold
+    }
+
+    return dc
+}
+
+// applyDBConfig tunes db's pool.
+func applyDBConfig(db *sql.DB, dc DBConfig) {
+    dc = dc.withDefaults()
+    db.SetMaxOpenConns(dc.MaxOpenConns)
+    db.SetMaxIdleConns(dc.MaxIdleConns)
+    db.SetConnMaxLifetime(dc.ConnMaxLifetime)
+    db.SetConnMaxIdleTime(dc.ConnMaxIdleTime)
+}
+
+// dbPoolStats is the part of sql.DBStats worth watching.
+// WaitCount climbing means requests are queueing for a connection, ie. MaxOpenConns is too low.
+type dbPoolStats struct {
+    MaxOpenConnections int `json:"max_open_connections"`
+    OpenConnections int `json:"open_connections"`
+    InUse int `json:"in_use"`
+    Idle int `json:"idle"`
+    WaitCount int64 `json:"wait_count"`
+    WaitDurationMS int64 `json:"wait_duration_ms"`
+    MaxIdleClosed int64 `json:"max_idle_closed"`
+    MaxIdleTimeClosed int64 `json:"max_idle_time_closed"`
+    MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
+// GET /debug/db
+func (c *Controller) DBStatsHandler(rw http.ResponseWriter, req *http.Request) {
+    st := c.dbStats()
+
+    c.negotiator(req).Respond(rw, http.StatusOK, response.Success(dbPoolStats{
+        MaxOpenConnections: st.MaxOpenConnections,
+        OpenConnections: st.OpenConnections,
+        InUse: st.InUse,
+        Idle: st.Idle,
+        WaitCount: st.WaitCount,
+        WaitDurationMS: st.WaitDuration.Milliseconds(),
+        MaxIdleClosed: st.MaxIdleClosed,
+        MaxIdleTimeClosed: st.MaxIdleTimeClosed,
+        MaxLifetimeClosed: st.MaxLifetimeClosed,
+    }))
+}
@@ -0,0 +1,109 @@
+/*
+DebugCaptureMiddleware logs raw request and response bodies, for diagnosing what a client actually sent
+and got back.
+
+It's off unless the debug_capture setting is on, and when it's off the request passes straight through
+untouched. When it's on:
+- bodies are captured while they're read and written, never read ahead of the handler, so the handler
+  sees exactly the same request.
+- only the first maxDebugCaptureBytes of each body are kept, so a huge upload can't blow up the logs.
+- values of sensitive json keys (passwords, api keys, tokens) are redacted before anything is logged.
+- a gzipped response is captured as written, ie. compressed. ask without Accept-Encoding to read it.
+*/
+package examplePackage
+
+import (
+    "bytes"
+    "io"
+    "net/http"
+    "regexp"
+
+    ctxpkg "github.com/private-repo/context"
+    "github.com/sirupsen/logrus"
+)
+
+// maxDebugCaptureBytes is how much of each body is logged.
+const maxDebugCaptureBytes = 4096
+
+// redactPattern matches a sensitive json key and its string value, eg. "password": "hunter2".
+// it works on truncated bodies too, which a json parser would reject.
+var redactPattern = regexp.MustCompile(`(?i)("(?:password|password_hash|api_key|token|secret|authorization)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// cappedBuffer keeps the first max bytes written to it and silently drops the rest.
+// it always reports the full length as written, so a TeeReader using it never fails the handler's read.
+type cappedBuffer struct {
+    buf bytes.Buffer
+    max int
+    truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+    room := cb.max - cb.buf.Len()
+    if room <= 0 {
+        cb.truncated = cb.truncated || len(p) > 0
+        return len(p), nil
+    }
+
+    if len(p) > room {
+        cb.buf.Write(p[:room])
+        cb.truncated = true
+        return len(p), nil
+    }
+
+    cb.buf.Write(p)
+    return len(p), nil
+}
+
+// redacted returns what was captured with sensitive values replaced.
+func (cb *cappedBuffer) redacted() string {
+    return redactPattern.ReplaceAllString(cb.buf.String(), `$1"[REDACTED]"`)
+}
+
+// captureWriter copies what the handler writes into a cappedBuffer on its way to the client.
+type captureWriter struct {
+    *statusRecorder
+    body *cappedBuffer
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+    cw.body.Write(p)
+    return cw.statusRecorder.Write(p)
+}
+
+// readCloser puts a TeeReader back together with the original body's Close.
+type readCloser struct {
+    io.Reader
+    io.Closer
+}
+
+// DebugCaptureMiddleware logs the request and response bodies at debug level when debug_capture is on.
+func (c *Controller) DebugCaptureMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        if !c.currentSettings().DebugCapture {
+            next.ServeHTTP(rw, req)
+            return
+        }
+
+        reqBody := &cappedBuffer{max: maxDebugCaptureBytes}
+        if req.Body != nil {
+            req.Body = readCloser{Reader: io.TeeReader(req.Body, reqBody), Closer: req.Body}
+        }
+
+        cw := &captureWriter{
+            statusRecorder: newStatusRecorder(rw),
+            body: &cappedBuffer{max: maxDebugCaptureBytes},
+        }
+        next.ServeHTTP(cw, req)
+
+        lf := ctxpkg.LogFields(req.Context())
+        lf["method"] = ctxpkg.SanitizeLogValue(req.Method)
+        lf["path"] = ctxpkg.SanitizeLogValue(req.URL.Path)
+        lf["status"] = cw.status
+        // a body isn't necessarily json, so it can hold raw newlines. eg. a full_name sent as form data.
+        lf["request_body"] = ctxpkg.SanitizeLogValue(reqBody.redacted())
+        lf["request_truncated"] = reqBody.truncated
+        lf["response_body"] = ctxpkg.SanitizeLogValue(cw.body.redacted())
+        lf["response_truncated"] = cw.body.truncated
+        logrus.WithFields(lf).Debug("debug capture")
+    })
+}
@@ -0,0 +1,60 @@
+/*
+The error envelope is the json shape of every error that isn't field validation (that's problem+json,
+see problem_example.go).
+
+{"error": {"code": "FORBIDDEN", "message": "missing scope users:delete"}}
+
+Code is a stable, machine readable string. Clients branch on it. Message is for humans and can change.
+*/
+package examplePackage
+
+import (
+    "net/http"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// error codes. they're part of the api contract, so never rename one.
+const (
+    codeUnauthorized = "UNAUTHORIZED"
+    codeForbidden = "FORBIDDEN"
+    codeNotImplemented = "NOT_IMPLEMENTED"
+    codeServiceDisabled = "SERVICE_DISABLED"
+    codeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+)
+
+type errorBody struct {
+    Code string `json:"code" xml:"code"`
+    Message string `json:"message,omitempty" xml:"message,omitempty"`
+    RequestID string `json:"request_id,omitempty" xml:"request_id,omitempty"`
+    // Handler names the route, eg. "DELETE /v1/user/:user_id". only notImplementedHandler sets it.
+    Handler string `json:"handler,omitempty" xml:"handler,omitempty"`
+}
+
+type errorEnvelope struct {
+    XMLName struct{} `json:"-" xml:"error_response"`
+    Error errorBody `json:"error" xml:"error"`
+}
+
+// writeErrorEnvelope writes the error envelope in the negotiated format.
+func writeErrorEnvelope(rw http.ResponseWriter, req *http.Request, status int, code, message string) {
+    getNegotiator(req).Respond(rw, status, errorEnvelope{
+        Error: errorBody{Code: code, Message: message},
+    })
+}
+
+// notImplementedHandler answers a route that's declared but not written yet with a 501, instead of a
+//   nil handler panicking. RegisterRoutes uses it for every route without a Handler. name is the route,
+//   so whoever calls it can tell which endpoint is still missing.
+func notImplementedHandler(name string) http.HandlerFunc {
+    return func(rw http.ResponseWriter, req *http.Request) {
+        getNegotiator(req).Respond(rw, http.StatusNotImplemented, errorEnvelope{
+            Error: errorBody{
+                Code: codeNotImplemented,
+                Message: name + " is not implemented yet",
+                RequestID: ctxpkg.GetRequestID(req.Context()),
+                Handler: name,
+            },
+        })
+    }
+}
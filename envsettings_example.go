@@ -0,0 +1,206 @@
+/*
+Settings from environment variables, for running the example without the private settings service.
+
+SETTINGS_SOURCE picks where InitializeUserSettings gets its settings:
+- "service" (the default) is the settings service, and nothing else. prod never reads settings from
+  the environment unless someone asks for it.
+- "env" is the environment only.
+- "fallback" is the settings service, and the environment when the service fails.
+
+Each setting is USER_SETTINGS_ plus its json name in upper case, and a nested one has its parent's
+name in front, eg.
+
+USER_SETTINGS_ENABLED=true
+USER_SETTINGS_API_KEY=dev-key
+USER_SETTINGS_CORS_ALLOWED_ORIGINS=http://localhost:3000,http://localhost:8080
+USER_SETTINGS_FEATURE_FLAGS=new_list=true,email_precheck_v2=false
+USER_SETTINGS_DB_MAX_OPEN_CONNS=5
+USER_SETTINGS_DB_SLOW_QUERY_THRESHOLD=50ms
+
+Settings from the environment go through the same defaults, validateRequired and Validate as the ones
+from the service, so a bad value fails the same way.
+*/
+package examplePackage
+
+import (
+    "fmt"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/private-repo/settings"
+    "github.com/sirupsen/logrus"
+)
+
+const envSettingsPrefix = "USER_SETTINGS_"
+
+const (
+    settingsSourceService = "service"
+    settingsSourceEnv = "env"
+    settingsSourceFallback = "fallback"
+)
+
+// newSettingsClient is the SettingsClient for SETTINGS_SOURCE. anything it doesn't recognize is the
+//   settings service, so a typo can't quietly move prod onto the environment.
+func newSettingsClient(source string) SettingsClient {
+    switch strings.ToLower(strings.TrimSpace(source)) {
+    case "", settingsSourceService:
+        return settings.NewClient()
+    case settingsSourceEnv:
+        return envSettingsClient{lookup: os.LookupEnv}
+    case settingsSourceFallback:
+        return fallbackSettingsClient{primary: settings.NewClient(), fallback: envSettingsClient{lookup: os.LookupEnv}}
+    default:
+        logrus.WithField("source", source).Warn("unknown settings source. using the settings service")
+        return settings.NewClient()
+    }
+}
+
+// envSettingsClient fills userSettingsData from environment variables. a variable that isn't set leaves
+//   its field zero, for applyDefaults to fill in.
+type envSettingsClient struct {
+    // lookup is os.LookupEnv, and only replaced in tests.
+    lookup func(string) (string, bool)
+}
+
+func (e envSettingsClient) Get(v interface{}) error {
+    usd, ok := v.(*userSettingsData)
+    if !ok {
+        return fmt.Errorf("envSettingsClient can only fill *userSettingsData, got %T", v)
+    }
+
+    // filled into a copy, so a bad variable never leaves the caller with half of the settings.
+    out := userSettingsData{}
+    if err := e.fill(reflect.ValueOf(&out).Elem(), envSettingsPrefix); err != nil {
+        return err
+    }
+    *usd = out
+
+    return nil
+}
+
+// fill sets every field of dst that has a variable. it recurses into structs, eg. DB.
+func (e envSettingsClient) fill(dst reflect.Value, prefix string) error {
+    rt := dst.Type()
+    for i := 0; i < rt.NumField(); i++ {
+        f := rt.Field(i)
+        if f.PkgPath != "" {
+            continue
+        }
+
+        name := prefix + strings.ToUpper(fieldName(f))
+        d := dst.Field(i)
+        if d.Kind() == reflect.Struct {
+            if err := e.fill(d, name+"_"); err != nil {
+                return err
+            }
+            continue
+        }
+
+        raw, ok := e.lookup(name)
+        if !ok {
+            continue
+        }
+        // the value isn't in the error. it could be the api key.
+        if err := setFromEnv(d, strings.TrimSpace(raw)); err != nil {
+            return fmt.Errorf("invalid %s. %s", name, err)
+        }
+    }
+
+    return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setFromEnv parses raw into d by d's type. a type it doesn't know is an error, not skipped, so a new
+//   setting can't be silently unsettable from the environment.
+func setFromEnv(d reflect.Value, raw string) error {
+    // before the kinds, since a time.Duration is an int64.
+    if d.Type() == durationType {
+        dur, err := time.ParseDuration(raw)
+        if err != nil {
+            return err
+        }
+        d.SetInt(int64(dur))
+        return nil
+    }
+
+    switch d.Kind() {
+    case reflect.String:
+        d.SetString(raw)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(raw)
+        if err != nil {
+            return err
+        }
+        d.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(raw, 10, 64)
+        if err != nil {
+            return err
+        }
+        d.SetInt(n)
+    case reflect.Float64:
+        fl, err := strconv.ParseFloat(raw, 64)
+        if err != nil {
+            return err
+        }
+        d.SetFloat(fl)
+    case reflect.Ptr:
+        // eg. LogSampleRate, where nil and 0 mean different things. a set variable is never nil.
+        p := reflect.New(d.Type().Elem())
+        if err := setFromEnv(p.Elem(), raw); err != nil {
+            return err
+        }
+        d.Set(p)
+    case reflect.Slice:
+        if d.Type().Elem().Kind() != reflect.String {
+            return fmt.Errorf("%s can't be set from the environment", d.Type())
+        }
+        list := []string{}
+        for _, s := range strings.Split(raw, ",") {
+            if s = strings.TrimSpace(s); s != "" {
+                list = append(list, s)
+            }
+        }
+        d.Set(reflect.ValueOf(list))
+    case reflect.Map:
+        if d.Type() != reflect.TypeOf(map[string]bool{}) {
+            return fmt.Errorf("%s can't be set from the environment", d.Type())
+        }
+        // the same "a=true,b=false" as the X-Feature-Flags header, but a bad entry is an error here.
+        flags, bad := parseFeatureFlags(raw)
+        if len(bad) > 0 {
+            return fmt.Errorf("can't parse %s", strings.Join(bad, ", "))
+        }
+        d.Set(reflect.ValueOf(flags))
+    default:
+        return fmt.Errorf("%s can't be set from the environment", d.Type())
+    }
+
+    return nil
+}
+
+// fallbackSettingsClient is primary, and fallback when primary fails.
+// getSettingsWithRetry retries the pair, so the environment is used as soon as one call to the
+//   service fails. that's fine for local dev, where the service isn't there at all.
+type fallbackSettingsClient struct {
+    primary SettingsClient
+    fallback SettingsClient
+}
+
+func (f fallbackSettingsClient) Get(v interface{}) error {
+    err := f.primary.Get(v)
+    if err == nil {
+        return nil
+    }
+
+    logrus.WithError(err).Warn("failed to get settings from the settings service. using the environment")
+    if ferr := f.fallback.Get(v); ferr != nil {
+        return fmt.Errorf("%s. fallback: %w", err, ferr)
+    }
+
+    return nil
+}
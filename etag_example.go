@@ -0,0 +1,73 @@
+/*
+ETags let a client ask "has this changed since I last saw it?" by sending the ETag back in If-None-Match.
+If nothing changed, we answer 304 Not Modified with no body and the client reuses its copy.
+
+The ETag has to be computed from the DATA, not from the bytes written to the client.
+The same data can be written differently (pretty printed, gzipped, xml), and those must all share one ETag.
+So the hash is over canonical json: json.Marshal of the value. struct fields always marshal in
+declaration order and map keys are sorted, so identical data always produces identical bytes.
+*/
+package examplePackage
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "strings"
+)
+
+// computeETag returns a weak ETag for v.
+// it's weak (W/) because it's about the data being equivalent, not the response bytes being identical.
+// parts are hashed along with v for anything that should change the ETag but isn't in the body.
+func computeETag(v interface{}, parts ...string) (string, error) {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return "", err
+    }
+
+    h := sha256.New()
+    for _, p := range parts {
+        h.Write([]byte(p))
+        // separate the parts so ("ab", "c") and ("a", "bc") don't hash the same.
+        h.Write([]byte{0})
+    }
+    h.Write(b)
+
+    // half the hash is plenty to tell versions apart and keeps the header short.
+    return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+// If-None-Match can be "*" or a comma separated list, and comparison is weak so W/ is ignored.
+func etagMatches(ifNoneMatch, etag string) bool {
+    if ifNoneMatch == "" {
+        return false
+    }
+
+    if strings.TrimSpace(ifNoneMatch) == "*" {
+        return true
+    }
+
+    want := strings.TrimPrefix(etag, "W/")
+    for _, candidate := range strings.Split(ifNoneMatch, ",") {
+        if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == want {
+            return true
+        }
+    }
+
+    return false
+}
+
+// notModified sets the ETag header and, if the request already has this version, writes a 304.
+// it returns true when the 304 was written and the handler should stop.
+func notModified(rw http.ResponseWriter, req *http.Request, etag string) bool {
+    rw.Header().Set("ETag", etag)
+
+    if etagMatches(req.Header.Get("If-None-Match"), etag) {
+        rw.WriteHeader(http.StatusNotModified)
+        return true
+    }
+
+    return false
+}
@@ -0,0 +1,221 @@
+/*
+Events (eg. "user.created") use the outbox pattern.
+
+Every event is written to an outbox table FIRST, in the same transaction as the change it describes
+(eg. UserStore.InsertUserWithEvent). Only once that's committed is it handed to an in-memory queue that
+workers drain and dispatch. A dispatched event is marked as such in the outbox. A crash at any point
+leaves either no change and no event, or both, and the poller sends whatever is still pending.
+
+That ordering is what makes backpressure safe. When the queue is full (the downstream is slow or down),
+a new event doesn't have to be dropped or grow memory without bound. It's already in the outbox, so it
+can simply be left there, and the poller picks it up once the queue has room again.
+*/
+package examplePackage
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/sirupsen/logrus"
+)
+
+// event is one outbox row.
+type event struct {
+    ID string
+    Type string
+    Payload []byte
+}
+
+// OutboxStore persists events until they're dispatched.
+type OutboxStore interface {
+    InsertEvent(ctx context.Context, ev event) (string, error)
+    PendingEvents(ctx context.Context, limit int) ([]event, error)
+    MarkDispatched(ctx context.Context, eventID string) error
+}
+
+// what Publish does when the queue is full.
+// shedDefer leaves the event in the outbox right away. shedBlock waits up to BlockTimeout for room first,
+//   which adds latency to the caller but usually avoids the round trip through the poller.
+// neither one drops the event.
+const (
+    shedDefer = "defer"
+    shedBlock = "block"
+)
+
+type dispatcherConfig struct {
+    QueueSize int
+    Workers int
+    ShedPolicy string
+    BlockTimeout time.Duration
+    PollInterval time.Duration
+}
+
+var defaultDispatcherConfig = dispatcherConfig{
+    QueueSize: 1000,
+    Workers: 4,
+    ShedPolicy: shedDefer,
+    BlockTimeout: 50 * time.Millisecond,
+    PollInterval: 10 * time.Second,
+}
+
+var eventsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "events_deferred_total",
+    Help: "Number of events left in the outbox because the dispatch queue was full.",
+})
+
+func init() {
+    prometheus.MustRegister(eventsDeferred)
+}
+
+// dispatcher moves events from the outbox to send.
+type dispatcher struct {
+    cfg dispatcherConfig
+    store OutboxStore
+    send func(context.Context, event) error
+    queue chan event
+
+    // queued holds the ids currently in the queue or being sent, so the poller doesn't queue them twice.
+    mu sync.Mutex
+    queued map[string]bool
+}
+
+func newDispatcher(cfg dispatcherConfig, store OutboxStore, send func(context.Context, event) error) *dispatcher {
+    return &dispatcher{
+        cfg: cfg,
+        store: store,
+        send: send,
+        // the buffer size IS the cap on memory. it never grows past QueueSize events.
+        queue: make(chan event, cfg.QueueSize),
+        queued: make(map[string]bool),
+    }
+}
+
+// Enqueue queues ev, which is already committed to the outbox, for dispatch.
+// it can't fail. a full queue just leaves the event in the outbox for the poller, and so does a nil
+//   dispatcher (eg. in tests).
+func (d *dispatcher) Enqueue(ctx context.Context, ev event) {
+    if d == nil || d.enqueue(ev, d.cfg.ShedPolicy == shedBlock) {
+        return
+    }
+
+    eventsDeferred.Inc()
+    lf := ctxpkg.LogFields(ctx)
+    lf["event_id"] = ev.ID
+    lf["event_type"] = ev.Type
+    logrus.WithFields(lf).Warn("event queue is full. event left in the outbox for the poller")
+}
+
+// enqueue adds ev to the queue unless it's already there. it returns false when there's no room.
+func (d *dispatcher) enqueue(ev event, wait bool) bool {
+    d.mu.Lock()
+    if d.queued[ev.ID] {
+        d.mu.Unlock()
+        return true
+    }
+    d.queued[ev.ID] = true
+    d.mu.Unlock()
+
+    select {
+    case d.queue <- ev:
+        return true
+    default:
+    }
+
+    if wait {
+        timer := time.NewTimer(d.cfg.BlockTimeout)
+        defer timer.Stop()
+
+        select {
+        case d.queue <- ev:
+            return true
+        case <-timer.C:
+        }
+    }
+
+    d.done(ev.ID)
+    return false
+}
+
+// done forgets an event id so the poller can queue it again if it's still pending.
+func (d *dispatcher) done(eventID string) {
+    d.mu.Lock()
+    delete(d.queued, eventID)
+    d.mu.Unlock()
+}
+
+// Run starts the workers and the poller and blocks until ctx is done.
+func (d *dispatcher) Run(ctx context.Context) {
+    wg := sync.WaitGroup{}
+    for i := 0; i < d.cfg.Workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            d.work(ctx)
+        }()
+    }
+
+    d.poll(ctx)
+    wg.Wait()
+}
+
+func (d *dispatcher) work(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case ev := <-d.queue:
+            d.dispatch(ctx, ev)
+        }
+    }
+}
+
+// dispatch sends one event. a failed send stays pending in the outbox and is retried by the poller.
+func (d *dispatcher) dispatch(ctx context.Context, ev event) {
+    defer d.done(ev.ID)
+    lf := logrus.Fields{"event_id": ev.ID, "event_type": ev.Type}
+
+    if err := d.send(ctx, ev); err != nil {
+        logrus.WithFields(lf).WithError(err).Warn("failed to dispatch event. it will be retried")
+        return
+    }
+
+    if err := d.store.MarkDispatched(ctx, ev.ID); err != nil {
+        // the event was sent but will be sent again. receivers must handle duplicates either way.
+        logrus.WithFields(lf).WithError(err).Error("failed to mark event dispatched")
+    }
+}
+
+// poll queues pending outbox events every PollInterval, but only as many as there's room for.
+// it never blocks on the queue, so a stalled consumer can't make the poller pile up events in memory.
+func (d *dispatcher) poll(ctx context.Context) {
+    ticker := time.NewTicker(d.cfg.PollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        room := cap(d.queue) - len(d.queue)
+        if room == 0 {
+            continue
+        }
+
+        pending, err := d.store.PendingEvents(ctx, room)
+        if err != nil {
+            logrus.WithError(err).Error("failed to read pending events")
+            continue
+        }
+
+        for _, ev := range pending {
+            if !d.enqueue(ev, false) {
+                break
+            }
+        }
+    }
+}
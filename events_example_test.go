@@ -0,0 +1,96 @@
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    errs "errors"
+)
+
+// with nothing consuming the queue, it never holds more than QueueSize events and every event is
+//   still pending in the outbox.
+func TestDispatcherStalledConsumer(t *testing.T) {
+    store := newMemUserStore()
+    stalled := make(chan struct{})
+    defer close(stalled)
+
+    cfg := dispatcherConfig{QueueSize: 2, Workers: 1, ShedPolicy: shedDefer, PollInterval: time.Hour}
+    d := newDispatcher(cfg, store, func(ctx context.Context, ev event) error {
+        <-stalled
+        return nil
+    })
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go d.Run(ctx)
+
+    for i := 0; i < 10; i++ {
+        ev := event{Type: "user.created"}
+        id, err := store.InsertEvent(ctx, ev)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ev.ID = id
+        d.Enqueue(ctx, ev)
+
+        if n := len(d.queue); n > cfg.QueueSize {
+            t.Fatalf("queue holds %d events, more than its size %d", n, cfg.QueueSize)
+        }
+    }
+
+    pending, err := store.PendingEvents(ctx, 100)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(pending) != 10 {
+        t.Errorf("%d events pending in the outbox, want all 10", len(pending))
+    }
+}
+
+func TestCreateUserWritesOutbox(t *testing.T) {
+    body := `{"full_name":"Ada","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701}`
+
+    tests := []struct {
+        name string
+        eventErr error
+        wantErr bool
+    }{
+        {"committed with its event", nil, false},
+        {"outbox write fails", errs.New("outbox unavailable"), true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := newMemUserStore()
+            store.FailNextEvent(tt.eventErr)
+            c := &Controller{DB: store}
+
+            req := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(body))
+            resp, err := c.handleCreateUser(req.Context(), req)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("handleCreateUser() error = %v, wantErr %v", err, tt.wantErr)
+            }
+
+            users, _ := store.CountUsers(req.Context(), userFilter{IncludeDeleted: true})
+            pending, _ := store.PendingEvents(req.Context(), 10)
+            if tt.wantErr {
+                if !errs.Is(err, errInternal) {
+                    t.Errorf("error %v isn't an errInternal", err)
+                }
+                if users != 0 || len(pending) != 0 {
+                    t.Errorf("%d users and %d events stored, want neither", users, len(pending))
+                }
+                return
+            }
+
+            if users != 1 || len(pending) != 1 {
+                t.Fatalf("%d users and %d events stored, want one of each", users, len(pending))
+            }
+            if pending[0].Type != "user.created" || !strings.Contains(string(pending[0].Payload), `"id":"`+resp.ID+`"`) {
+                t.Errorf("event = %s %s, want user.created for %s", pending[0].Type, pending[0].Payload, resp.ID)
+            }
+        })
+    }
+}
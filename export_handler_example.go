@@ -0,0 +1,100 @@
+/*
+GET /v1/users/export streams every user as csv.
+
+The difference from the list endpoint is that the response is never fully in memory.
+Each row goes from the database cursor straight to the client. That means once the first row is
+written the status is already 200, so an error part way through can only be logged, not returned.
+*/
+package examplePackage
+
+import (
+    "encoding/csv"
+    "net/http"
+    "strconv"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// flush to the client every this many rows so it sees progress and our buffers stay small.
+const csvFlushEvery = 500
+
+var csvHeader = []string{"id", "full_name", "address", "city", "state", "zip_code", "phone"}
+
+// GET /v1/users/export?state=CA&city=Oakland
+func (c *Controller) ExportUsersHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "ExportUsers"
+    n := c.negotiator(req)
+
+    // validate everything BEFORE writing anything. after the first write we can't change the status.
+    filter, err := parseUserFilter(ctx, queryParams(req))
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("invalid export filter")
+        if !c.respondHTTPError(rw, req, err) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        }
+        return
+    }
+
+    // an admin exporting deleted users needs to tell them apart, so they get a deleted_at column.
+    header := csvHeader
+    if filter.IncludeDeleted {
+        header = append(append([]string{}, csvHeader...), "deleted_at")
+    }
+
+    rw.Header().Set("Content-Type", "text/csv")
+    rw.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+    rw.WriteHeader(http.StatusOK)
+
+    w := csv.NewWriter(rw)
+    // not every ResponseWriter can flush (eg. some test recorders), so this is checked, not assumed.
+    flusher, _ := rw.(http.Flusher)
+    flush := func() {
+        w.Flush()
+        if flusher != nil {
+            flusher.Flush()
+        }
+    }
+
+    if err := w.Write(header); err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to write csv header")
+        return
+    }
+
+    // the record slice is reused for every row to avoid an allocation per user.
+    record := make([]string, len(header))
+    count := 0
+    err = c.DB.StreamUsers(ctx, filter, func(u userRecord) error {
+        record[0] = u.ID
+        record[1] = u.FullName
+        record[2] = u.Address
+        record[3] = u.City
+        record[4] = u.State
+        record[5] = strconv.Itoa(u.ZipCode)
+        record[6] = u.Phone
+        if filter.IncludeDeleted {
+            record[7] = ""
+            if u.DeletedAt != nil {
+                record[7] = u.DeletedAt.Format(time.RFC3339)
+            }
+        }
+        if err := w.Write(record); err != nil {
+            return err
+        }
+
+        count++
+        if count%csvFlushEvery == 0 {
+            flush()
+            // a write error (eg. the client went away) shows up here.
+            return w.Error()
+        }
+        return nil
+    })
+    flush()
+
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).WithField("rows", count).Error("csv export stopped early")
+    }
+}
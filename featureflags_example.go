@@ -0,0 +1,90 @@
+/*
+Request-scoped feature flags.
+
+Flags come from settings ("feature_flags"), so a behavior can be turned on or off without a deploy.
+FeatureFlagsMiddleware copies them into each request's context once, and handlers ask
+ctxpkg.IsEnabled(ctx, flag). a handler never reads the settings for a flag itself, so a settings reload
+part way through a request can't change its flags half way.
+
+In non-prod, where "feature_flag_overrides" is on, a request can also change its own flags with a header,
+eg. for trying both sides of an A/B test:
+
+X-Feature-Flags: new_list=true,email_precheck_v2=false
+*/
+package examplePackage
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+const featureFlagsHeader = "X-Feature-Flags"
+
+// FeatureFlagsMiddleware runs after MainContextMiddleware so its log line has the request id.
+func (c *Controller) FeatureFlagsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        usd := c.currentSettings()
+        // a copy, so overriding a flag for one request never changes the settings every request shares.
+        flags := make(map[string]bool, len(usd.FeatureFlags))
+        for k, v := range usd.FeatureFlags {
+            flags[k] = v
+        }
+
+        // the header is ignored, not rejected, when overrides are off. a client sending it to prod
+        //   gets prod's flags like everyone else.
+        if raw := req.Header.Get(featureFlagsHeader); raw != "" && usd.FeatureFlagOverrides {
+            overrides, bad := parseFeatureFlags(raw)
+            for k, v := range overrides {
+                flags[k] = v
+            }
+
+            ctx := req.Context()
+            lf := ctxpkg.LogFields(ctx)
+            // the flag names are the client's, so it's the sanitized header that's logged, not the map.
+            lf["overrides"] = ctxpkg.SanitizeLogValue(raw)
+            if len(bad) > 0 {
+                lf["ignored"] = len(bad)
+            }
+            ctxpkg.Logger(ctx).WithFields(lf).Debug("feature flags overridden by header")
+        }
+
+        req = req.WithContext(ctxpkg.SetFeatureFlags(req.Context(), flags))
+        next.ServeHTTP(rw, req)
+    })
+}
+
+// parseFeatureFlags parses "a=true,b=false". a flag with no value (eg. "a") is turned on.
+// entries that can't be parsed are returned in bad and otherwise ignored.
+func parseFeatureFlags(raw string) (map[string]bool, []string) {
+    flags := map[string]bool{}
+    bad := []string{}
+    for _, part := range strings.Split(raw, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+
+        kv := strings.SplitN(part, "=", 2)
+        name := strings.TrimSpace(kv[0])
+        if name == "" {
+            bad = append(bad, part)
+            continue
+        }
+        if len(kv) == 1 {
+            flags[name] = true
+            continue
+        }
+
+        on, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+        if err != nil {
+            bad = append(bad, part)
+            continue
+        }
+        flags[name] = on
+    }
+
+    return flags, bad
+}
@@ -7,15 +7,28 @@ package examplePackage
 
 import (
     "context"
+    "crypto/tls"
+    "encoding/json"
+    "encoding/xml"
     "fmt"
     "net/http"
+    "net/mail"
     "database/sql"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+    "unicode/utf8"
     errs "errors"
 
-    "github.com/private-repo/negotiate"
-    "github.com/private-repo/settings"
+    ctxpkg "github.com/private-repo/context"
     "github.com/sirupsen/logrus"
     "gihub.com/husobee/vestigo"
+    "go.opentelemetry.io/otel"
+    "golang.org/x/sync/singleflight"
     "github.com/pkg/errors"
 )
 
@@ -26,57 +39,286 @@ import (
 var (
     errBadRequest = errors.New("input error")
     errInternal = errors.New("internal error")
+    errNotFound = errors.New("not found")
+    errConflict = errors.New("conflict")
+    // errUnprocessable means the body decoded fine but broke a rule, eg. an unknown state. a body that
+    //   can't be decoded at all is errBadRequest. clients show field errors for one and not the other.
+    errUnprocessable = errors.New("unprocessable")
+    // errPreconditionRequired means a write was sent without the If-Match it needs.
+    errPreconditionRequired = errors.New("precondition required")
+    // errServiceDisabled means settings have turned the endpoint off. it's temporary, unlike a 501.
+    errServiceDisabled = errors.New("service disabled")
 )
 
 type Controller struct {
-    settingsClient settings.Client
+    // an interface (settings_example.go) so tests can swap in fakeSettingsClient.
+    settingsClient SettingsClient
+    passwordHasher PasswordHasher
+    userCache Cache
+    // idempotencyCache holds finished creates by Idempotency-Key and createFlights the in-flight ones.
+    // see idempotency_example.go.
+    idempotencyCache Cache
+    createFlights singleflight.Group
+    events *dispatcher
+    webhooks *webhookNotifier
+    audit AuditStore
+    // auditFatal makes a failed audit write fail the request. see audit_example.go.
+    auditFatal bool
+    createLimiter *ipRateLimiter
+    inFlight *inFlightTracker
+    // dbStats reports on the connection pool for /debug/db. it's db.Stats in main.
+    dbStats func() sql.DBStats
+    // createUserSchema is built once in main. see schema_example.go.
+    createUserSchema cachedSchema
+    // openAPIDoc is built once in main from Routes. see openapi_example.go.
+    openAPIDoc cachedSchema
+    settingsRetry retryConfig
+    // settingsMu guards settingsData and lastRefreshed. they're replaced by reloads, which can run on
+    //   the file watcher's or the startup retry's goroutine while handlers are reading them. read them
+    //   with currentSettings and replace them with setSettings, never directly.
+    settingsMu sync.RWMutex
     settingsData userSettingsData
-    DB *sql.DB
+    // when settingsData was last loaded.
+    lastRefreshed time.Time
+    DB UserStore
+    // newNegotiator is how handlers get their Negotiator. nil means getNegotiator. tests set it to
+    //   capture what a handler responds with. see negotiate_example.go.
+    newNegotiator func(*http.Request) Negotiator
 }
 
 // these struct parameters have to be capitalized because we need to decode json.
+// fields tagged `required:"true"` are checked by validateRequired (settings_example.go).
+// APIKey is a secret. it's masked whenever the settings are serialized or logged, and code that
+//   genuinely needs the real key must use apiKey().
 type userSettingsData struct {
     Enabled bool `json:"enabled"`
-    APIKey string `json:"api_key"`
+    APIKey string `json:"api_key" required:"true"`
+    CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+    // WebhookURL is notified of every new user. empty turns webhooks off. see webhook_example.go.
+    WebhookURL string `json:"webhook_url"`
+    // DebugCapture logs request and response bodies. it's for diagnosing a client and is off by default.
+    DebugCapture bool `json:"debug_capture"`
+    // EmailPrecheck looks for an existing user with the same email before inserting. see handleCreateUser.
+    EmailPrecheck bool `json:"email_precheck"`
+    // DB tunes the connection pool. see dbpool_example.go.
+    DB DBConfig `json:"db"`
+    // LogSampleRate is the fraction of requests that log at debug level, eg. 0.01. left out means
+    //   defaultLogSampleRate and 0 turns sampling off. see logging_example.go.
+    LogSampleRate *float64 `json:"log_sample_rate,omitempty"`
+    // FeatureFlags turns flags on or off for every request. see featureflags_example.go.
+    FeatureFlags map[string]bool `json:"feature_flags"`
+    // FeatureFlagOverrides lets a request change its own flags with the X-Feature-Flags header. it's for
+    //   testing in non-prod and must stay off in prod, or any client could change how prod behaves.
+    FeatureFlagOverrides bool `json:"feature_flag_overrides"`
+    // TrailingSlash is "redirect", "rewrite" or "reject". see canonicalpath_example.go.
+    TrailingSlash string `json:"trailing_slash"`
 }
 
 func main() {
+    // first, so every line main logs is in the right format. see logging_example.go.
+    ConfigureLogging(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+
+    // ctx is cancelled on SIGINT/SIGTERM. everything long running that main starts stops when it's done.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    db, err := sql.Open("postgres", "postgres://localhost/users")
+    if err != nil {
+        panic(err)
+    }
+
+    // every query the stores run goes through sdb so the slow ones are logged.
+    sdb := newSlowQueryDB(db)
+
+    // the same store is both the UserStore and the events' OutboxStore.
+    // new users get random UUIDs. newULIDGenerator() would make ids that sort by creation time instead.
+    store := newSQLUserStore(sdb, uuidGenerator{})
+
+    // idempotency keys are hardly ever read twice, so without the sweep they'd pile up for their whole 24h.
+    idempotencyCache := newTTLCache(24 * time.Hour)
+    go idempotencyCache.sweep(ctx, time.Minute)
+
     // i instantiate a pointer when I create the variable here because there will be no 
     //   ambiguity in the usage of the variable "c" for the rest of this function
     c := &Controller{
-        settingsClient: settings.NewClient(),
+        // the settings service unless SETTINGS_SOURCE says otherwise. see envsettings_example.go.
+        settingsClient: newSettingsClient(os.Getenv("SETTINGS_SOURCE")),
+        passwordHasher: newBcryptHasher(12),
+        userCache: newInstrumentedCache("user", newTTLCache(30*time.Second)),
+        idempotencyCache: newInstrumentedCache("idempotency", idempotencyCache),
+        // reads are retried on deadlocks and dropped connections. see retry_store_example.go.
+        DB: newRetryableDB(store, defaultDBRetry),
+        // audit entries go to their own table. a failed write is logged but doesn't fail the request.
+        audit: newSQLAuditStore(sdb),
+        dbStats: db.Stats,
     }
+    // the threshold is in settings, which hang off c, so it can only be hooked up now.
+    sdb.threshold = c.slowQueryThreshold
 
-    if err := c.InitializeUserSettings(); err != nil {
+    // by default, failing to load settings fails startup. SETTINGS_STARTUP_POLICY=lenient starts disabled
+    //   instead, so a settings outage doesn't block a deploy. see settings_example.go.
+    if err := c.LoadSettingsAtStartup(ctx, parseStartupPolicy(os.Getenv("SETTINGS_STARTUP_POLICY"))); err != nil {
         panic(err)
     }
 
+    // the pool is tuned from settings, so this has to wait until they're loaded. sql.Open doesn't connect,
+    //   so no connection has been made with the defaults yet.
+    applyDBConfig(db, c.currentSettings().DB)
+
+    // the schema is derived from createUserRequest, which can't change while we're running, so it's built once.
+    c.createUserSchema, err = newCreateUserSchema()
+    if err != nil {
+        panic(err)
+    }
+
+    // events are written to the outbox and dispatched in the background. see events_example.go.
+    // until there's a real consumer, dispatching an event just logs it.
+    c.events = newDispatcher(defaultDispatcherConfig, store, func(ctx context.Context, ev event) error {
+        logrus.WithFields(logrus.Fields{"event_id": ev.ID, "event_type": ev.Type}).Info("event dispatched")
+        return nil
+    })
+    go c.events.Run(ctx)
+
+    // side effects of a request (eg. webhooks) run on the job queue after the response. see jobqueue_example.go.
+    // it's drained during shutdown, after the server has stopped taking requests.
+    jobs := newJobQueue(defaultJobQueueConfig)
+
+    // the url is read from settings on every delivery, so webhooks can be turned on without a restart.
+    c.webhooks = newWebhookNotifier(defaultWebhookConfig, jobs, c.webhookURL)
+
+    // besides /v1/settings/reload, settings reload on their own when the mounted config file changes.
+    go func() {
+        if err := c.WatchSettingsFile(ctx, "/etc/user-settings/settings.json"); err != nil {
+            logrus.WithError(err).Error("settings file watcher stopped")
+        }
+    }()
+
+    // the limiter lives on the controller so /v1/ratelimit can report on it.
+    c.createLimiter = newIPRateLimiter(5, 10)
+    go c.createLimiter.sweep(ctx)
+    // counts requests so shutdown can wait for them, and answers /readyz. see readiness_example.go.
+    c.inFlight = newInFlightTracker()
+    c.inFlight.readinessGrace = parseReadinessGrace(os.Getenv("READINESS_GRACE"))
+    // /readyz reads the database's health from the last background ping instead of pinging per probe.
+    //   see dbhealth_example.go.
+    c.inFlight.dbHealth = newDBHealth(defaultDBHealthConfig, db.PingContext)
+    go c.inFlight.dbHealth.Run(ctx)
+
+    // the global provider is configured by whatever exporter the deployment uses.
+    // it's only read here, so tests can register c.Routes() with their own provider, or without tracing.
+    tp := otel.GetTracerProvider()
     router := vestigo.NewRouter()
-    // i include versions in the routes from the start so versioning is easier to manage moving forward.
-    router.Post("/v1/user", c.CreateUserHandler)
-    router.Post("/v1/update-settings", c.UpdateUserSettingsHandler)
+    // every route and its middleware is declared in Routes (routes_example.go).
+    routes := c.Routes()
+    // tracing is outermost so a span covers the whole request, including one that times out.
+    // routes with a MaxConcurrent get their limit innermost, right around the handler.
+    // write routes can be drained ahead of shutdown. see readiness_example.go.
+    RegisterRoutes(router, withTracing(tp, withRequestTimeout(defaultRequestTimeout, withWriteDrain(c.inFlight, withConcurrencyLimits(routes)))))
+    go c.inFlight.drainWritesOnSIGUSR1()
+
+    // the OpenAPI document is generated from the same routes. see openapi_example.go.
+    c.openAPIDoc, err = newOpenAPIDoc(routes)
+    if err != nil {
+        panic(err)
+    }
 
-    // to demonstrate RESTful API design, i include these routes but the logic isn't provided here.
-    router.Get("/v1/user/:user_id", c.GetUserHandler)
-    router.Delete("/v1/user/:user_id", c.DeleteUserHandler)
+    // the cert is served through GetCertificate so renewals are picked up on SIGHUP without a restart.
+    cr, err := newCertReloader("/etc/tls/server.crt", "/etc/tls/server.key")
+    if err != nil {
+        panic(err)
+    }
+    go cr.reloadOnSIGHUP()
+
+    // CORS wraps the whole router (not each route) so preflight OPTIONS requests are answered
+    //   before vestigo tries to route them.
+    // the origins are read from settings on every request, so they can change without a redeploy.
+    // tokens are verified with the auth service's signing key. without one every token is rejected, so
+    //   only the routes that don't need a scope work. see auth_example.go.
+    authKey := os.Getenv("AUTH_SIGNING_KEY")
+    if authKey == "" {
+        logrus.Warn("AUTH_SIGNING_KEY is not set. every bearer token will be rejected")
+    }
+    verifier := newHS256Verifier([]byte(authKey))
+
+    cors := newCORSMiddleware(c.corsAllowedOrigins, []string{http.MethodGet, http.MethodPost, http.MethodDelete})
+
+    server := &http.Server{
+        Addr: ":8443",
+        // MainContextMiddleware is outermost so everything after it, including CORS, has a request id.
+        // SamplingMiddleware decides whether the request logs at debug level (logging_example.go).
+        // FeatureFlagsMiddleware puts the request's flags in its context (featureflags_example.go).
+        // RequestLogMiddleware is next so its log line has the request id and covers everything else.
+        // DebugCaptureMiddleware does nothing unless the debug_capture setting is on.
+        // NegotiationMiddleware rejects conflicting format requests before any handler runs.
+        // AuthMiddleware puts the caller's claims in the context for RequireScope and friends.
+        // CanonicalPathMiddleware deals with trailing slashes, which vestigo would otherwise 404.
+        // MethodNotAllowedMiddleware answers a known path with the wrong method (methodnotallowed_example.go).
+        // the in-flight count wraps everything, so a request counts from the moment it arrives.
+        Handler: c.inFlight.Middleware(MainContextMiddleware(c.SamplingMiddleware(c.FeatureFlagsMiddleware(RequestLogMiddleware(c.DebugCaptureMiddleware(cors(NegotiationMiddleware(AuthMiddleware(verifier)(CanonicalPathMiddleware(c.trailingSlashPolicy)(MethodNotAllowedMiddleware(routes)(router))))))))))),
+        TLSConfig: &tls.Config{
+            GetCertificate: cr.GetCertificate,
+        },
+    }
 
-    // for this route i would include query params in the logic to deal with pagination.
-    // eg. /v1/users?limit=10&offset=5
-    router.Get("/v1/users", c.GetAllUsersHandler)
+    // the cert and key file arguments are empty because TLSConfig.GetCertificate provides them.
+    go func() {
+        if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+            panic(err)
+        }
+    }()
+
+    <-ctx.Done()
+
+    // give in-flight requests a chance to finish instead of cutting them off. the readiness grace comes
+    //   out of the same deadline, so it's added on top.
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), c.inFlight.readinessGrace+15*time.Second)
+    defer cancel()
+    // fail /readyz first and give the load balancer time to notice, then wait for what's in flight.
+    //   only after that does the server stop accepting connections.
+    if err := c.inFlight.BeginShutdown(shutdownCtx); err != nil {
+        logrus.WithError(err).WithField("in_flight", c.inFlight.InFlight()).Warn("requests still in flight at the shutdown deadline")
+    }
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        logrus.WithError(err).Error("failed to shut down cleanly")
+    }
+    // no request can queue a job now, so whatever is queued is all that's left. it shares the deadline.
+    if err := jobs.Shutdown(shutdownCtx); err != nil {
+        logrus.WithError(err).Error("failed to drain the job queue")
+    }
 }
 
 // you'll notice that all method receivers are pointers (c *Controller).
 // the convention in Golang is if a function requires a pointer method reciever, all method
 //   receivers should be pointers to avoid confusion.
 // i'll explain why these are pointers shortly
-func (c *Controller) InitializeUserSettings() error {
+func (c *Controller) InitializeUserSettings(ctx context.Context) error {
     // notice here I don't instantiate the variable as a pointer like i did in main().
     usd := userSettingsData{}
 
-    // but here, I explicitly pass a pointer to c.SettingsClient.Get 
-    if err := c.settingsClient.Get(&usd); err != nil {
+    // but here, I explicitly pass a pointer to c.getSettingsWithRetry, which retries
+    //   c.settingsClient.Get with backoff (settings_example.go).
+    if err := c.getSettingsWithRetry(ctx, &usd); err != nil {
         // first example of using sentinel errors in Golang's error wrapping.
-        return fmt.Errorf("failed to get user settings. %s. %w", err, errInternal)
+        // getSettingsWithRetry already wrapped errInternal, so the error is returned as is.
+        return err
+    }
+
+    // explicitly pass a pointer even though validateRequired only reads.
+    // it accepts both, and this avoids copying the struct into the interface{}.
+    if err := validateRequired(&usd); err != nil {
+        return fmt.Errorf("invalid user settings. %s. %w", err, errInternal)
+    }
+
+    // fields the settings service left out get their defaults before validating, so the defaults are
+    //   validated too. see applyDefaults in settings_example.go.
+    if applied := applyDefaults(&usd, DefaultSettings); len(applied) > 0 {
+        logrus.WithField("defaults", applied).Info("settings left out were given their defaults")
+    }
+
+    // a bad config fails loudly here: startup panics and a reload is rejected, leaving the last good
+    //   settings in place because setSettings isn't called until the end of this function.
+    if err := usd.Validate(); err != nil {
+        return fmt.Errorf("invalid user settings. %s. %w", err, errInternal)
     }
 
     // a lot of Golang code instantiates a pointer when the variable is created.
@@ -87,39 +329,132 @@ func (c *Controller) InitializeUserSettings() error {
     // because i modify the Controller struct here, i need the method receiver to be a pointer.
     // if the method receiver was a value, this line of code will only live for the life of this function.
     // i want every function that has the same receiver to have the modified data.
-    c.settingsData = usd
+    c.setSettings(usd)
 
     return nil
 }
 
+// currentSettings is how everything reads the settings. it's a copy, so a reload part way through a
+//   request can't change the values the request already has.
+// the maps and slices in it are shared with the copy every other request has, so they're never modified
+//   in place. a reload replaces the whole struct.
+func (c *Controller) currentSettings() userSettingsData {
+    usd, _ := c.currentSettingsAt()
+    return usd
+}
+
+// currentSettingsAt is currentSettings with the time it was loaded, read together so they always match.
+func (c *Controller) currentSettingsAt() (userSettingsData, time.Time) {
+    c.settingsMu.RLock()
+    defer c.settingsMu.RUnlock()
+
+    return c.settingsData, c.lastRefreshed
+}
+
+// setSettings replaces the settings and records when.
+func (c *Controller) setSettings(usd userSettingsData) {
+    c.settingsMu.Lock()
+    defer c.settingsMu.Unlock()
+
+    c.settingsData = usd
+    c.lastRefreshed = time.Now()
+}
+
+// corsAllowedOrigins reads the origins from the current settings.
+// it's passed to the CORS middleware as a function, not a slice, so a settings update is seen immediately.
+func (c *Controller) corsAllowedOrigins() []string {
+    return c.currentSettings().CORSAllowedOrigins
+}
+
+type reloadSettingsResponse struct {
+    PreviousEnabled bool `json:"previous_enabled"`
+    Enabled bool `json:"enabled"`
+    Settings userSettingsData `json:"settings"`
+}
+
+// POST /v1/settings/reload
+// InitializeUserSettings always goes to the settings service (nothing in between caches it),
+//   so this is a true refresh from the source.
+// the response shows Enabled before and after so an operator can see what the reload changed.
+func (c *Controller) ReloadSettingsHandler(rw http.ResponseWriter, req *http.Request) {
+    n := c.negotiator(req)
+    previous := c.currentSettings().Enabled
+
+    if err := c.InitializeUserSettings(req.Context()); err != nil {
+        logrus.WithError(err).Error("failed to reload user settings")
+        n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        return
+    }
+
+    usd := c.currentSettings()
+    n.Respond(rw, http.StatusOK, response.Success(reloadSettingsResponse{
+        PreviousEnabled: previous,
+        Enabled: usd.Enabled,
+        Settings: usd,
+    }))
+}
+
 // POST /v1/update-settings
+// kept for backward compatibility. new callers should use POST /v1/settings/reload.
 func (c *Controller) UpdateUserSettingsHandler(rw http.ResponseWriter, req *http.Request) {
-    n := negotiate.GetNegotiator(req)
+    n := c.negotiator(req)
 
     // here, you truly see why the method receiver is a pointer.
     // because of this handler, i can update the service's settings whenever i want
     //   by simply curling the endpoint.
     // since the method receiver is a pointer, all functions will get the updated settings.
-    if err := c.InitializeUserSettings(); err != nil {
+    if err := c.InitializeUserSettings(req.Context()); err != nil {
         logrus.WithError(err).Error("failed to update user settings")
         n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
         return
     }
 
-    // return c.SettingsData to see what the updated settings are
-    n.Respond(rw, http.StatusOK, response.Success(c.SettingsData))
+    // return the settings to see what the updated settings are.
+    // the api key is masked when it's serialized (settings_example.go), so it's safe to send.
+    n.Respond(rw, http.StatusOK, response.Success(c.currentSettings()))
+}
+
+// GET /v1/settings
+// clients poll this, so it supports If-None-Match. an unchanged state gets a 304 and no body.
+func (c *Controller) GetSettingsHandler(rw http.ResponseWriter, req *http.Request) {
+    n := c.negotiator(req)
+    usd, lastRefreshed := c.currentSettingsAt()
+
+    // lastRefreshed is part of the ETag so a reload is visible to clients even if the values are the same.
+    // computeETag marshals usd, so the hash is over the masked api key, never the real one.
+    etag, err := computeETag(usd, lastRefreshed.UTC().Format(time.RFC3339Nano))
+    if err != nil {
+        logrus.WithError(err).Error("failed to compute settings etag")
+        n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        return
+    }
+
+    if notModified(rw, req, etag) {
+        return
+    }
+
+    n.Respond(rw, http.StatusOK, response.Success(usd))
 }
 
 // POST /v1/user
 func (c *Controller) CreateUserHandler(rw http.ResponseWriter, req *http.Request) {
     // Golang's use of context is an area of much debate and i discuss it in context_package_example.go.
     ctx := req.Context()
-    lf := logrus.Fields{"handler": "CreateUser"}
-    n := negotiate.GetNegotiator(req)
-
-    if !c.SettingsData.Enabled {
-        // could argue this could return different statuses.
-        n.Respond(rw, http.StatusNotImplemented, response.Error(nil))
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "CreateUser"
+    n := c.negotiator(req)
+
+    if !c.currentSettings().Enabled {
+        // a 503, not a 501. the endpoint exists and comes back when settings turn it on again, and the
+        //   code lets clients tell the two apart.
+        err := &HTTPError{
+            Status: http.StatusServiceUnavailable,
+            Code: codeServiceDisabled,
+            Msg: "user creation is currently disabled",
+            Err: errServiceDisabled,
+        }
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Warn("failed to create user")
+        c.respondHTTPError(rw, req, err)
         return
     }
 
@@ -130,15 +465,41 @@ func (c *Controller) CreateUserHandler(rw http.ResponseWriter, req *http.Request
     // this makes the code easier to maintain because anyone can look at one handler and
     //   instantly understand what to expect.
     // i leverage Golang's error wrapping to communicate to the main handler what the status should be.
-    userResp, err := c.handleCreateUser(ctx, req)
-    lf["user_id"] = user.ID
+    // a dry run stops after validation, so it never touches the db or the idempotency cache.
+    //   it still comes after the Enabled check, since a form that validates should also be creatable.
+    dryRun := isDryRun(req)
+    var userResp createUserResponse
+    var err error
+    if dryRun {
+        lf["dry_run"] = true
+        _, err = decodeCreateUserRequest(ctx, req)
+    } else {
+        // createUserIdempotent calls handleCreateUser, at most once per Idempotency-Key.
+        userResp, err = c.createUserIdempotent(ctx, req)
+        // user_id in lf is the caller (from LogFields), so the new user gets its own key.
+        lf["created_user_id"] = userResp.ID
+    }
     if err != nil {
-        logrus.WithFields(lf).WithError(err).Error("failed to create user")
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to create user")
+
+        // an HTTPError says exactly how to respond (httperror_example.go). anything else goes down
+        //   the sentinel ladder.
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
 
         // Golang's new (go1.13) way of dealing with errors.
-        if errs.Is(err, errBadRequest) {
+        var ve validationErrors
+        if errs.As(err, &ve) {
+            // field level failures are returned as problem+json so clients can map them to form inputs.
+            writeProblem(rw, validationProblem(req, ve))
+        } else if errs.Is(err, errUnprocessable) {
+            n.Respond(rw, http.StatusUnprocessableEntity, response.Error(err))
+        } else if errs.Is(err, errBadRequest) {
             // return the error so the client can fix it.
             n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errConflict) {
+            n.Respond(rw, http.StatusConflict, response.Error(err))
         } else if errs.Is (err, errInternal){
             // don't want the client to know about internal errors.
             n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
@@ -146,19 +507,91 @@ func (c *Controller) CreateUserHandler(rw http.ResponseWriter, req *http.Request
         return
     }
 
+    if dryRun {
+        n.Respond(rw, http.StatusOK, response.Success(dryRunResponse{Valid: true}))
+        return
+    }
+
     n.Respond(rw, http.StatusCreated, response.Success(userResp))
 }
 
+// dryRunResponse is the body of a dry run that passed validation.
+type dryRunResponse struct {
+    XMLName xml.Name `json:"-" xml:"result"`
+    Valid bool `json:"valid" xml:"valid"`
+}
+
+// isDryRun reports whether the client asked to validate only, with ?dry_run=true or X-Dry-Run: true.
+func isDryRun(req *http.Request) bool {
+    if v, err := strconv.ParseBool(req.URL.Query().Get("dry_run")); err == nil && v {
+        return true
+    }
+    v, err := strconv.ParseBool(req.Header.Get("X-Dry-Run"))
+    return err == nil && v
+}
+
+// the xml tags let legacy partners send and receive xml. see negotiate_example.go.
 type createUserRequest struct {
-    FullName string `json:"full_name"`
-    Address string `json:"address"`
-    City string `json:"city"`
-    State string `json:"state"`
-    ZipCode int `json:"zip_code"`
+    XMLName xml.Name `json:"-" xml:"user"`
+    FullName string `json:"full_name" xml:"full_name"`
+    Address string `json:"address" xml:"address"`
+    City string `json:"city" xml:"city"`
+    State string `json:"state" xml:"state"`
+    ZipCode int `json:"zip_code" xml:"zip_code"`
+    // Phone is optional. it's normalized to E.164 before validation. see phone_example.go.
+    Phone string `json:"phone,omitempty" xml:"phone,omitempty"`
+    // Email is optional, but no two users can have the same one.
+    Email string `json:"email,omitempty" xml:"email,omitempty"`
+
+    // Password is optional and only ever lives in memory for the life of the request.
+    // PasswordHash is what's stored. the "-" tags mean it can never be decoded from or sent to a client.
+    Password string `json:"password,omitempty" xml:"password,omitempty"`
+    PasswordHash string `json:"-" xml:"-"`
+}
+
+// Normalize cleans up what people type before it's validated and stored, so "  bob  " is saved as
+//   "bob" and "ca" as "CA". see normalizeField for what happens to each field.
+// Password is left exactly as sent. a space in a password is part of the password.
+func (cur *createUserRequest) Normalize() {
+    cur.FullName = normalizeField("full_name", cur.FullName)
+    cur.Address = normalizeField("address", cur.Address)
+    cur.City = normalizeField("city", cur.City)
+    cur.State = normalizeField("state", cur.State)
+    cur.Phone = normalizeField("phone", cur.Phone)
+    cur.Email = normalizeField("email", cur.Email)
+}
+
+// normalizeField normalizes the value of a json field. creates, replaces and patches all use it so
+//   a user ends up the same however it was written.
+// every field is trimmed. on top of that:
+// - full_name and city have runs of whitespace collapsed to one space. "San   Francisco" is a typo.
+// - state is upper case, to match validStates.
+// - phone has its separators stripped (phone_example.go).
+// - email is lower case. the local part is case sensitive on paper but no provider treats it that way,
+//   and lower casing it means the unique check can't be dodged with "Bob@" vs "bob@".
+func normalizeField(field, value string) string {
+    value = strings.TrimSpace(value)
+
+    switch field {
+    case "full_name", "city":
+        return strings.Join(strings.Fields(value), " ")
+    case "state":
+        return strings.ToUpper(value)
+    case "phone":
+        return normalizePhone(value)
+    case "email":
+        return strings.ToLower(value)
+    }
+
+    return value
 }
 
 type createUserResponse struct {
-    ID string `json:"id"`
+    XMLName xml.Name `json:"-" xml:"user"`
+    ID string `json:"id" xml:"id"`
+    // RFC3339 in UTC. they're strings, not time.Time, so the format is the same in json and xml.
+    CreatedAt string `json:"created_at" xml:"created_at"`
+    UpdatedAt string `json:"updated_at" xml:"updated_at"`
 }
 
 // this function has all the logic and communicates to the main handler what it should return to the client.
@@ -171,73 +604,306 @@ func (c *Controller) handleCreateUser(ctx context.Context, req *http.Request) (c
     // returning values keeps the memory on the stack along with the function, which is much more efficient.
     resp := createUserResponse{}
 
+    cur, err := decodeCreateUserRequest(ctx, req)
+    if err != nil {
+        return resp, err
+    }
+
+    // replace the plaintext with its hash BEFORE anything gets near the store.
+    if cur.Password != "" {
+        hash, err := c.passwordHasher.Hash(cur.Password)
+        if err != nil {
+            return resp, fmt.Errorf("failed to hash password. %s. %w", err, errInternal)
+        }
+        cur.PasswordHash = hash
+        cur.Password = ""
+    }
+
+    // the pre-check only exists to give a friendly 409 without tripping the unique constraint.
+    // it's racy: two requests with the same email can both pass it before either inserts. that's why
+    //   the unique constraint on users.email stays the real guard, and InsertUser turns its violation
+    //   into errConflict too. it costs a round trip, so it's a setting.
+    if cur.Email != "" && c.currentSettings().EmailPrecheck {
+        exists, err := c.DB.EmailExists(ctx, cur.Email)
+        if err != nil {
+            return resp, fmt.Errorf("failed to check email. %s. %w", err, errInternal)
+        }
+        if exists {
+            return resp, fmt.Errorf("a user with this email already exists. %w", errConflict)
+        }
+    }
+
+    // the sql lives in store_example.go. the user and its user.created event are written in one
+    //   transaction, so a user can never exist without its event. see events_example.go.
+    user, ev, err := c.DB.InsertUserWithEvent(ctx, cur, userCreatedEvent)
+    if errs.Is(err, errConflict) {
+        return resp, fmt.Errorf("a user with this email already exists. %w", errConflict)
+    }
+    if err != nil {
+        // if something went wrong, it had to have been an internal server error level of error.
+        return resp, fmt.Errorf("failed to insert user. %s. %w", err, errInternal)
+    }
+
+    resp.ID = user.ID
+    resp.CreatedAt = user.CreatedAt.Format(time.RFC3339)
+    resp.UpdatedAt = user.UpdatedAt.Format(time.RFC3339)
+
+    if err := c.recordAudit(ctx, auditUserCreate, user.ID); err != nil {
+        return resp, err
+    }
+
+    // the event is already in the outbox. this only saves it waiting for the poller.
+    c.events.Enqueue(ctx, ev)
+
+    // delivery happens in the background and can't fail the request. see webhook_example.go.
+    c.webhooks.Notify(ctx, resp)
+
+    return resp, nil
+}
+
+// userCreatedEvent is the user.created event for u. its payload is the create's response body.
+func userCreatedEvent(u userRecord) (event, error) {
+    payload, err := json.Marshal(createUserResponse{
+        ID: u.ID,
+        CreatedAt: u.CreatedAt.Format(time.RFC3339),
+        UpdatedAt: u.UpdatedAt.Format(time.RFC3339),
+    })
+    if err != nil {
+        return event{}, err
+    }
+
+    return event{Type: "user.created", Payload: payload}, nil
+}
+
+// decodeCreateUserRequest decodes, normalizes and validates the body. it's everything a create does
+//   before it has side effects, which makes it the whole of a dry run.
+func decodeCreateUserRequest(ctx context.Context, req *http.Request) (createUserRequest, error) {
     cur := createUserRequest{}
     // again, explicitly declare a pointer when necessary (&cur).
-    if err := json.NewDecoder(req.Body).Decode(&cur); err != nil {
-        // use the %w directive and use a sentinel error, which gets interpreted to an http response code at the
-        //   main handler level.
+    // the body may be json or xml depending on Content-Type (see negotiate_example.go).
+    if err := decodeRequestBody(req, &cur); err != nil {
+        // decodeRequestBody wraps with errBadRequest, a sentinel error which gets interpreted to an
+        //   http response code at the main handler level.
         // this function doesn't need to know about http response codes.
-        return resp, fmt.Errorf("failed to decode. %s. %w", err, errBadRequest)
+        return cur, err
     }
 
+    // what's validated is what's stored and returned, so this happens first.
+    // eg. "+1 415 555 0100" is fine to send. it's stored as "+14155550100".
+    cur.Normalize()
+
     // this function doesn't modify "cur" so it doesn't need it to be a pointer.
     // ie. this function won't produce any side effects
-    if err := validateCreateUserRequest(cur); err != nil {
-        return resp, fmt.Errorf("failed to validate create user request. %s. %w", err, errBadRequest)
+    stopValidation := ctxpkg.Timer(ctx, "validation")
+    err := validateCreateUserRequest(cur)
+    stopValidation()
+    var ve validationErrors
+    if errs.As(err, &ve) {
+        err = ve.localize(ctxpkg.GetLocale(ctx))
     }
-
-    // didn't bother writing this function out.
-    userID, err := c.DB.InsertUser(ctx, cur)
     if err != nil {
-        // if something went wrong, it had to have been an internal server error level of error.
-        return resp, fmt.Errorf("failed to insert user. %s. %w", err, errInternal)
+        // go1.20 lets me wrap more than one error. i wrap the validation error itself (instead of %s)
+        //   so the main handler can pull the FieldErrors back out with errors.As.
+        return cur, fmt.Errorf("failed to validate create user request. %w. %w", err, errUnprocessable)
     }
 
-    resp.ID = userID
-    return resp, nil
+    return cur, nil
 }
 
-func validateCreateUserRequest(cur CreateUserRequest) error {
-    // here, i'm saying "errs" is a slice of strings that has a length of 0 but a capacity of 5.
+// the longest full_name, address and city we accept, in characters (not bytes).
+// they're vars so a deployment can change them with SetFieldLimits.
+var (
+    maxFullNameLength = 200
+    maxAddressLength = 500
+    maxCityLength = 100
+)
+
+// FieldLimits is the argument to SetFieldLimits. a zero field leaves that limit as it is.
+type FieldLimits struct {
+    FullName int
+    Address int
+    City int
+}
+
+// SetFieldLimits overrides the max lengths. call it at startup, before serving requests and before
+//   the JSON Schema is built. the limits are read without a lock.
+func SetFieldLimits(l FieldLimits) {
+    if l.FullName > 0 {
+        maxFullNameLength = l.FullName
+    }
+    if l.Address > 0 {
+        maxAddressLength = l.Address
+    }
+    if l.City > 0 {
+        maxCityLength = l.City
+    }
+}
+
+// tooLong counts characters, so "José" is 4 long like the client thinks, not 5 bytes.
+func tooLong(s string, max int) bool {
+    return utf8.RuneCountInString(s) > max
+}
+
+// validStates is the set of two letter state (and DC) codes.
+// it's a map so checking membership is a single lookup instead of a loop.
+var validStates = map[string]bool{
+    "AL": true, "AK": true, "AZ": true, "AR": true, "CA": true, "CO": true, "CT": true, "DE": true,
+    "DC": true, "FL": true, "GA": true, "HI": true, "ID": true, "IL": true, "IN": true, "IA": true,
+    "KS": true, "KY": true, "LA": true, "ME": true, "MD": true, "MA": true, "MI": true, "MN": true,
+    "MS": true, "MO": true, "MT": true, "NE": true, "NV": true, "NH": true, "NJ": true, "NM": true,
+    "NY": true, "NC": true, "ND": true, "OH": true, "OK": true, "OR": true, "PA": true, "RI": true,
+    "SC": true, "SD": true, "TN": true, "TX": true, "UT": true, "VT": true, "VA": true, "WA": true,
+    "WV": true, "WI": true, "WY": true,
+}
+
+// validEmail accepts a bare address like "jo@example.com".
+// ParseAddress alone would also accept a display name ("Jo <jo@example.com>"), which isn't an email
+//   we can store, so the parsed address has to be the whole input.
+func validEmail(email string) bool {
+    addr, err := mail.ParseAddress(email)
+    return err == nil && addr.Address == email
+}
+
+// FieldError describes a single field that failed validation.
+// Field is the json name of the field (not the Go name) because that's what the client sent us.
+// Key identifies the message in the catalog (messages_example.go) and Message is its text in the
+//   caller's locale. Key never changes with the locale, so clients can branch on it.
+type FieldError struct {
+    Field string `json:"field"`
+    Key string `json:"key"`
+    Message string `json:"message"`
+    // Args fill in the message's %d/%s verbs, eg. the limit in "must be at most %d characters".
+    // they're kept so localize can format the translated message with them too.
+    Args []interface{} `json:"-"`
+}
+
+// fieldError builds a FieldError with the default (english) message. handlers translate it with localize.
+func fieldError(field, key string, args ...interface{}) FieldError {
+    return FieldError{Field: field, Key: key, Message: formatMessage(defaultLocale, key, args), Args: args}
+}
+
+// validationErrors is the error returned when one or more fields fail validation.
+// i keep the structured slice instead of flattening it into a string so the main handler
+//   can hand the client something machine readable (see problem_example.go).
+type validationErrors []FieldError
+
+// under is ve with every Field moved under prefix, eg. "fields/" turns "zip_code" into "fields/zip_code",
+//   for a body where the fields aren't at the top level.
+func (ve validationErrors) under(prefix string) validationErrors {
+    out := make(validationErrors, len(ve))
+    for i, fe := range ve {
+        fe.Field = prefix + fe.Field
+        out[i] = fe
+    }
+
+    return out
+}
+
+func (ve validationErrors) Error() string {
+    msgs := make([]string, 0, len(ve))
+    for _, fe := range ve {
+        msgs = append(msgs, fe.Message)
+    }
+
+    return strings.Join(msgs, "; ")
+}
+
+// createUserFields is every field ValidatePartial knows, by json name. a create validates all of them.
+var createUserFields = map[string]bool{
+    "full_name": true,
+    "address": true,
+    "city": true,
+    "state": true,
+    "zip_code": true,
+    "phone": true,
+    "email": true,
+    "password": true,
+}
+
+// the same rules are published to clients as a JSON Schema (createUserSchemaRules in schema_example.go).
+func validateCreateUserRequest(cur createUserRequest) error {
+    // a nil validationErrors in an error interface is NOT a nil error, so the empty case has to be
+    //   checked here instead of returning ValidatePartial's result directly.
+    if errs := cur.ValidatePartial(createUserFields); len(errs) > 0 {
+        return errs
+    }
+
+    return nil
+}
+
+// ValidatePartial runs the create rules, but only for the fields in present (json names).
+// a field that's present gets exactly the create rule, required or not. eg. a PATCH that sends
+//   "full_name": "" is an error because a user can't be without a name, while one that leaves
+//   full_name out isn't checked at all. that's how create and PATCH share one set of rules.
+func (cur createUserRequest) ValidatePartial(present map[string]bool) validationErrors {
+    // here, i'm saying "errs" is a slice of FieldErrors that has a length of 0 but a capacity of 5.
     // that means at this moment, "errs" is an empty slice, as you would expect.
-    // BUT it can accept a maximum of 5 strings before it needs to allocate a new slice with greater capacity.
+    // BUT it can accept a maximum of 5 FieldErrors before it needs to allocate a new slice with greater capacity.
     // this is an optimization technique.
-    errs := make([]string, 0, 5)
+    errs := make(validationErrors, 0, 5)
 
     // i could say the same thing using a literal: 
-    // errs := []string{}
+    // errs := validationErrors{}
 
-    // this creates a slice of strings with 0 length and 0 capacity.
-    // when i want to append something, like i do below, there's no room to add another string
+    // this creates a slice of FieldErrors with 0 length and 0 capacity.
+    // when i want to append something, like i do below, there's no room to add another FieldError
     //   so Golang will create a new slice with double the capacity (in this case, 1) in order to 
     //   fit the new data. if i keep appending, the capacity will double again to 2. if i add another,
     //   there'll be a new slice created with capacity of 4, and so on.
     // since i already know the maximum bound of the slice, i declare it when i make the slice.
     // this avoids extra allocations and improves performance.
 
-    if cur.FullName == "" {
-        errs = append(errs, "full name is required")
+    // too long is rejected, never truncated, so the client finds out its data didn't fit.
+    if present["full_name"] {
+        if cur.FullName == "" {
+            errs = append(errs, fieldError("full_name", msgFullNameRequired))
+        } else if tooLong(cur.FullName, maxFullNameLength) {
+            errs = append(errs, fieldError("full_name", msgFullNameTooLong, maxFullNameLength))
+        }
+    }
+
+    if present["address"] {
+        if cur.Address == "" {
+            errs = append(errs, fieldError("address", msgAddressRequired))
+        } else if tooLong(cur.Address, maxAddressLength) {
+            errs = append(errs, fieldError("address", msgAddressTooLong, maxAddressLength))
+        }
+    }
+
+    if present["city"] {
+        if cur.City == "" {
+            errs = append(errs, fieldError("city", msgCityRequired))
+        } else if tooLong(cur.City, maxCityLength) {
+            errs = append(errs, fieldError("city", msgCityTooLong, maxCityLength))
+        }
     }
 
-    if cur.Address == "" {
-        errs = append(errs, "address is required")
+    // Normalize already upper cased it, so "tx" passes and "ZZ" doesn't.
+    if present["state"] && !validStates[cur.State] {
+        errs = append(errs, fieldError("state", msgStateInvalid))
     }
 
-    if cur.City == "" {
-        errs = append(errs, "city is required")
+    if present["zip_code"] {
+        if cur.ZipCode == 0 {
+            errs = append(errs, fieldError("zip_code", msgZipRequired))
+        } else if cur.ZipCode < 0 || cur.ZipCode > 99999 {
+            errs = append(errs, fieldError("zip_code", msgZipOutOfRange))
+        }
     }
 
-    if cur.State == "" || len(cur.State) != 2 {
-        errs = append(errs, "state is required and must be 2 characters")
+    // phone is optional, but one that's given must be E.164.
+    if present["phone"] && cur.Phone != "" && !validPhone(cur.Phone) {
+        errs = append(errs, fieldError("phone", msgPhoneInvalid))
     }
 
-    if cur.ZipCode == 0 {
-        errs = append(errs, "zip code is required")
+    if present["email"] && cur.Email != "" && !validEmail(cur.Email) {
+        errs = append(errs, fieldError("email", msgEmailInvalid))
     }
 
-    if len(errs) > 0 {
-        return fmt.Errorf("%s", strings.Join(errs, "; "))
+    // len, not tooLong. bcrypt's limit is in bytes, so "é" counts twice.
+    if present["password"] && len(cur.Password) > maxPasswordBytes {
+        errs = append(errs, fieldError("password", msgPasswordTooLong, maxPasswordBytes))
     }
 
-    return nil
+    return errs
 }
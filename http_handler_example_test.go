@@ -0,0 +1,156 @@
+package examplePackage
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// the limits are inclusive: a value exactly the limit long is fine, one character more isn't.
+func TestValidateFieldLengths(t *testing.T) {
+    valid := createUserRequest{FullName: "Ada", Address: "1 Main St", City: "Austin", State: "TX", ZipCode: 78701}
+
+    tests := []struct {
+        name string
+        set func(*createUserRequest)
+        wantField string
+        wantKey string
+    }{
+        {"full_name at the limit", func(c *createUserRequest) { c.FullName = strings.Repeat("a", maxFullNameLength) }, "", ""},
+        {"full_name over the limit", func(c *createUserRequest) { c.FullName = strings.Repeat("a", maxFullNameLength+1) }, "full_name", msgFullNameTooLong},
+        {"address at the limit", func(c *createUserRequest) { c.Address = strings.Repeat("a", maxAddressLength) }, "", ""},
+        {"address over the limit", func(c *createUserRequest) { c.Address = strings.Repeat("a", maxAddressLength+1) }, "address", msgAddressTooLong},
+        {"city at the limit", func(c *createUserRequest) { c.City = strings.Repeat("a", maxCityLength) }, "", ""},
+        {"city over the limit", func(c *createUserRequest) { c.City = strings.Repeat("a", maxCityLength+1) }, "city", msgCityTooLong},
+        // characters, not bytes. "é" is 2 bytes.
+        {"multibyte city at the limit", func(c *createUserRequest) { c.City = strings.Repeat("é", maxCityLength) }, "", ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cur := valid
+            tt.set(&cur)
+
+            ve := cur.ValidatePartial(createUserFields)
+            if tt.wantField == "" {
+                if len(ve) > 0 {
+                    t.Errorf("ValidatePartial() = %v, want no errors", ve)
+                }
+                return
+            }
+            if len(ve) != 1 || ve[0].Field != tt.wantField || ve[0].Key != tt.wantKey {
+                t.Errorf("ValidatePartial() = %v, want one too long error for %s", ve, tt.wantField)
+            }
+        })
+    }
+}
+
+func TestSetFieldLimits(t *testing.T) {
+    defer SetFieldLimits(FieldLimits{FullName: maxFullNameLength, Address: maxAddressLength, City: maxCityLength})
+
+    // a zero leaves the address limit alone.
+    SetFieldLimits(FieldLimits{FullName: 5, City: 3})
+
+    cur := createUserRequest{FullName: "Ada L", Address: strings.Repeat("a", maxAddressLength), City: "Rome"}
+    ve := cur.ValidatePartial(map[string]bool{"full_name": true, "address": true, "city": true})
+    if len(ve) != 1 || ve[0].Field != "city" {
+        t.Errorf("ValidatePartial() = %v, want only city to be too long", ve)
+    }
+}
+
+// a state has to be a real one, not just two letters. create and PATCH share the rule.
+func TestValidateState(t *testing.T) {
+    valid := createUserRequest{FullName: "Ada", Address: "1 Main St", City: "Austin", State: "TX", ZipCode: 78701}
+
+    tests := []struct {
+        state string
+        wantErr bool
+    }{
+        {"TX", false},
+        {"DC", false},
+        {"ZZ", true},
+        {"TEX", true},
+        {"", true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.state, func(t *testing.T) {
+            cur := valid
+            cur.State = tt.state
+            ve := cur.ValidatePartial(createUserFields)
+            if gotErr := len(ve) > 0; gotErr != tt.wantErr {
+                t.Fatalf("ValidatePartial() = %v, wantErr %v", ve, tt.wantErr)
+            }
+            if tt.wantErr && (ve[0].Field != "state" || ve[0].Key != msgStateInvalid) {
+                t.Errorf("ValidatePartial() = %v, want %s on state", ve, msgStateInvalid)
+            }
+
+            _, err := validatePatch(context.Background(), userPatch{ID: "1", Fields: map[string]interface{}{"state": tt.state}})
+            wantStatus := 0
+            if tt.wantErr {
+                wantStatus = http.StatusUnprocessableEntity
+            }
+            if status := errStatus(err); status != wantStatus {
+                t.Errorf("patch status = %d, want %d (err %v)", status, wantStatus, err)
+            }
+        })
+    }
+}
+
+// every invalid field is reported at once, in one problem+json, so a form can mark them all.
+func TestCreateUserReportsEveryFieldError(t *testing.T) {
+    c := &Controller{DB: newMemUserStore()}
+    c.setSettings(userSettingsData{Enabled: true})
+
+    body := `{"full_name":"","address":"","city":"Austin","state":"ZZ","zip_code":123456}`
+    req := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(body))
+    req.Header.Set("Content-Type", mediaTypeJSON)
+    rw := httptest.NewRecorder()
+    c.CreateUserHandler(rw, req)
+
+    if rw.Code != http.StatusUnprocessableEntity || rw.Header().Get("Content-Type") != problemContentType {
+        t.Fatalf("got %d %s, want %d %s", rw.Code, rw.Header().Get("Content-Type"), http.StatusUnprocessableEntity, problemContentType)
+    }
+
+    pd := problemDetails{}
+    if err := json.NewDecoder(rw.Body).Decode(&pd); err != nil {
+        t.Fatal(err)
+    }
+    got := make([]string, 0, len(pd.Errors))
+    for _, fe := range pd.Errors {
+        got = append(got, fe.Pointer)
+    }
+    if want := "/full_name,/address,/state,/zip_code"; strings.Join(got, ",") != want {
+        t.Errorf("pointers = %s, want %s", strings.Join(got, ","), want)
+    }
+}
+
+func TestCreateUserRequestNormalize(t *testing.T) {
+    cur := createUserRequest{
+        FullName: "  bob  ",
+        Address: " 1 Main St ",
+        City: " San   Francisco ",
+        State: "ca",
+        Phone: "+1 (415) 555-0100",
+        Email: " Bob@Example.com ",
+        Password: " secret ",
+    }
+    cur.Normalize()
+
+    want := createUserRequest{
+        FullName: "bob",
+        Address: "1 Main St",
+        City: "San Francisco",
+        State: "CA",
+        Phone: "+14155550100",
+        Email: "bob@example.com",
+        // a space in a password is part of the password.
+        Password: " secret ",
+    }
+    if cur != want {
+        t.Errorf("Normalize() = %+v, want %+v", cur, want)
+    }
+}
@@ -0,0 +1,71 @@
+/*
+HTTPError lets the logic function pick the exact response instead of the main handler.
+
+The sentinel errors (errBadRequest, errNotFound, ...) map to one status each, which is enough most of
+the time. When it isn't, eg. a 422 for a well formed request that can't be processed, the logic
+function returns an *HTTPError and the main handler responds with it as is:
+
+return resp, &HTTPError{Status: http.StatusUnprocessableEntity, Code: "USER_DISABLED", Msg: "user is disabled"}
+
+Main handlers check for an HTTPError first and fall back to their errors.Is ladder, so code that
+returns sentinels keeps working while it's migrated.
+*/
+package examplePackage
+
+import (
+    "net/http"
+    "strings"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// HTTPError is an error that knows its response.
+// Msg is shown to the client. Err is the cause and is only logged, so it's safe to put internal detail in it.
+type HTTPError struct {
+    Status int
+    // Code goes in the error envelope. empty means one derived from Status, eg. "UNPROCESSABLE_ENTITY".
+    Code string
+    Msg string
+    Err error
+}
+
+func (he *HTTPError) Error() string {
+    if he.Err == nil {
+        return he.Msg
+    }
+
+    return he.Msg + ". " + he.Err.Error()
+}
+
+// Unwrap lets errors.Is and errors.As see the cause, so an HTTPError wrapping errNotFound is still errNotFound.
+func (he *HTTPError) Unwrap() error {
+    return he.Err
+}
+
+// code is he.Code, or the status text as a code when it isn't set.
+func (he *HTTPError) code() string {
+    if he.Code != "" {
+        return he.Code
+    }
+
+    return strings.ToUpper(strings.ReplaceAll(http.StatusText(he.Status), " ", "_"))
+}
+
+// respondHTTPError responds with err's HTTPError, if it has one, as the error envelope, and reports whether it did.
+// the request id is included so a client reporting the error can be matched to our logs.
+func (c *Controller) respondHTTPError(rw http.ResponseWriter, req *http.Request, err error) bool {
+    var he *HTTPError
+    if !errs.As(err, &he) {
+        return false
+    }
+
+    c.negotiator(req).Respond(rw, he.Status, errorEnvelope{
+        Error: errorBody{
+            Code: he.code(),
+            Message: he.Msg,
+            RequestID: ctxpkg.GetRequestID(req.Context()),
+        },
+    })
+    return true
+}
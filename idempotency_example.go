@@ -0,0 +1,114 @@
+/*
+Idempotency keys make retrying a create safe.
+
+A client sends an Idempotency-Key header with a create. If the response gets lost (timeout, dropped
+connection) the client retries with the SAME key, and instead of creating a second user we return the
+result of the first one.
+
+A key belongs to whoever sent it: it's scoped to the caller's user id, or their ip when there's no token.
+So two callers who happen to pick the same key never see each other's users. A key also belongs to one
+body. A retry has to send exactly the same body, and a different body with a used key is a 422:
+
+POST /v1/user
+Idempotency-Key: 7c4a8d09
+{"full_name": "Someone Else", ...}
+422 Unprocessable Entity
+
+The tricky case is a retry that arrives while the first request is still running. Both would miss the
+cache and both would insert. singleflight fixes that: the second request waits for the first one's result.
+*/
+package examplePackage
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// idempotentCreate is what's cached for a key: the create's result and a hash of the body that made it.
+type idempotentCreate struct {
+    bodyHash string
+    resp createUserResponse
+}
+
+// idempotencyScope is who a key belongs to. the user id when the request has a token, the ip otherwise.
+func idempotencyScope(ctx context.Context, req *http.Request) string {
+    if userID := ctxpkg.GetUserID(ctx); userID != "" {
+        return "user:" + userID
+    }
+
+    return "ip:" + clientIP(req)
+}
+
+// createUserIdempotent runs handleCreateUser at most once per caller and Idempotency-Key.
+// requests without the header are not deduplicated.
+func (c *Controller) createUserIdempotent(ctx context.Context, req *http.Request) (createUserResponse, error) {
+    header := req.Header.Get("Idempotency-Key")
+    if header == "" {
+        return c.handleCreateUser(ctx, req)
+    }
+    key := idempotencyScope(ctx, req) + ":" + header
+
+    // the body is read here to hash it, then put back for handleCreateUser to decode.
+    body, err := readBody(req.Body)
+    if err != nil {
+        return createUserResponse{}, err
+    }
+    req.Body = io.NopCloser(bytes.NewReader(body))
+    sum := sha256.Sum256(body)
+    bodyHash := hex.EncodeToString(sum[:])
+
+    // a finished create with this key. return its result without touching the database.
+    if v, ok := c.idempotencyCache.Get(key); ok {
+        return checkIdempotentBody(v.(idempotentCreate), bodyHash)
+    }
+
+    // if the request we waited on failed, its error isn't ours. eg. its client disconnected and
+    //   cancelled its context. so a waiter gets one more try, this time running the create itself
+    //   (or waiting on whichever request is running it now).
+    var created idempotentCreate
+    for attempt := 0; attempt < 2; attempt++ {
+        ran := false
+        var v interface{}
+        v, err, _ = c.createFlights.Do(key, func() (interface{}, error) {
+            ran = true
+
+            resp, err := c.handleCreateUser(ctx, req)
+            created := idempotentCreate{bodyHash: bodyHash, resp: resp}
+            if err != nil {
+                return created, err
+            }
+
+            // recorded before the flight ends, so a request arriving after this point hits the cache
+            //   instead of starting a new flight.
+            c.idempotencyCache.Set(key, created)
+            return created, nil
+        })
+        created = v.(idempotentCreate)
+
+        if ran {
+            return created.resp, err
+        }
+        if err == nil {
+            // we waited on someone else's create, which may have had a different body.
+            return checkIdempotentBody(created, bodyHash)
+        }
+    }
+
+    return createUserResponse{}, err
+}
+
+// checkIdempotentBody returns created's response if bodyHash matches the body that created it.
+func checkIdempotentBody(created idempotentCreate, bodyHash string) (createUserResponse, error) {
+    if created.bodyHash != bodyHash {
+        return createUserResponse{}, fmt.Errorf("Idempotency-Key was already used with a different request body. %w", errUnprocessable)
+    }
+
+    return created.resp, nil
+}
@@ -0,0 +1,133 @@
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+const idempotentBody = `{"full_name":"Ada","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701}`
+
+// gatedStore holds every insert until release is closed, so a test can line requests up behind it.
+type gatedStore struct {
+    *memUserStore
+    started chan struct{}
+    release chan struct{}
+    once sync.Once
+}
+
+func (g *gatedStore) InsertUserWithEvent(ctx context.Context, cur createUserRequest, newEvent func(userRecord) (event, error)) (userRecord, event, error) {
+    g.once.Do(func() { close(g.started) })
+    <-g.release
+    return g.memUserStore.InsertUserWithEvent(ctx, cur, newEvent)
+}
+
+func idempotentRequest(userID, key, body string) *http.Request {
+    req := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(body))
+    req.Header.Set("Idempotency-Key", key)
+    if userID != "" {
+        req = req.WithContext(ctxpkg.WithValues(req.Context(), func(d *ctxpkg.MainContext) { d.UserID = userID }))
+    }
+    return req
+}
+
+func TestCreateUserIdempotentConcurrent(t *testing.T) {
+    store := &gatedStore{memUserStore: newMemUserStore(), started: make(chan struct{}), release: make(chan struct{})}
+    c := &Controller{DB: store, idempotencyCache: newTTLCache(time.Hour)}
+
+    ids := make([]string, 2)
+    createErrs := make([]error, 2)
+    var wg sync.WaitGroup
+    create := func(i int) {
+        defer wg.Done()
+        req := idempotentRequest("u_1", "key-1", idempotentBody)
+        resp, err := c.createUserIdempotent(req.Context(), req)
+        ids[i], createErrs[i] = resp.ID, err
+    }
+
+    wg.Add(2)
+    go create(0)
+    // the second request only starts once the first is inside the insert, so it has to find the flight.
+    <-store.started
+    go create(1)
+    time.Sleep(20 * time.Millisecond)
+    close(store.release)
+    wg.Wait()
+
+    for i, err := range createErrs {
+        if err != nil {
+            t.Fatalf("request %d error = %v", i, err)
+        }
+    }
+    if ids[0] == "" || ids[0] != ids[1] {
+        t.Errorf("ids = %q and %q, want the same user", ids[0], ids[1])
+    }
+    if n, _ := store.CountUsers(context.Background(), userFilter{}); n != 1 {
+        t.Errorf("%d users inserted, want 1", n)
+    }
+}
+
+func TestCreateUserIdempotentScopeAndBody(t *testing.T) {
+    other := strings.Replace(idempotentBody, "Ada", "Bob", 1)
+
+    tests := []struct {
+        name string
+        userID string
+        body string
+        wantNew bool
+        wantStatus int
+    }{
+        {"same caller retries", "u_1", idempotentBody, false, 0},
+        {"other caller, same key", "u_2", idempotentBody, true, 0},
+        {"no token, same key", "", idempotentBody, true, 0},
+        {"same caller, different body", "u_1", other, false, http.StatusUnprocessableEntity},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := newMemUserStore()
+            c := &Controller{DB: store, idempotencyCache: newTTLCache(time.Hour)}
+
+            first := idempotentRequest("u_1", "key-1", idempotentBody)
+            want, err := c.createUserIdempotent(first.Context(), first)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            req := idempotentRequest(tt.userID, "key-1", tt.body)
+            got, err := c.createUserIdempotent(req.Context(), req)
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Fatalf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+            if err != nil {
+                return
+            }
+            if isNew := got.ID != want.ID; isNew != tt.wantNew {
+                t.Errorf("got user %s after %s, want a new user: %v", got.ID, want.ID, tt.wantNew)
+            }
+        })
+    }
+}
+
+// keys that are never read again still have to go once they expire.
+func TestTTLCacheEvictExpired(t *testing.T) {
+    tc := newTTLCache(time.Minute)
+    tc.Set("old", 1)
+    tc.Set("new", 2)
+    tc.entries["old"] = ttlEntry{val: 1, expires: time.Now().Add(-time.Second)}
+
+    tc.evictExpired(time.Now())
+
+    if _, ok := tc.entries["old"]; ok {
+        t.Error("expired entry is still there")
+    }
+    if _, ok := tc.entries["new"]; !ok {
+        t.Error("live entry was evicted")
+    }
+}
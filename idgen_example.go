@@ -0,0 +1,115 @@
+/*
+User id generation.
+
+Ids are made by the service, not the database, so the strategy is a choice instead of whatever the
+users table's default happens to be. sqlUserStore is given an IDGenerator in main.
+
+- uuidGenerator (the default) makes random UUIDv4s. they say nothing about when the user was created.
+- ulidGenerator makes ULIDs. they sort by creation time, so ordering by id is ordering by age, which
+  suits cursor paging: a new user always sorts after every cursor already handed out.
+- a nil IDGenerator leaves the id to the database, eg. a sequence.
+*/
+package examplePackage
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "sync"
+    "time"
+)
+
+// IDGenerator makes a new, unique user id.
+type IDGenerator interface {
+    NewID() string
+}
+
+// uuidGenerator makes random (version 4) UUIDs, eg. "0b9e8f52-3c1d-4a7e-9f3e-5d2c8a6b1e40".
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+    b := make([]byte, 16)
+    // crypto/rand only fails when the OS can't provide randomness, and then nothing else will work either.
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+
+    // set the version (4) and the variant (RFC 4122) bits.
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+
+    h := hex.EncodeToString(b)
+    return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// crockfordBase32 is the ULID alphabet. it leaves out I, L, O and U so ids can't be misread.
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator makes ULIDs, eg. "01HF3Z8Q4V7N2KXW6T9RBCMJ5D". the first 10 characters are the
+//   millisecond it was made and the other 16 are random.
+// two ids in the same millisecond would sort randomly, so instead the second one's random part is the
+//   first one's plus one. that keeps the ids from one generator strictly increasing.
+type ulidGenerator struct {
+    mu sync.Mutex
+    lastMS uint64
+    // lastHi and lastLo are the last id's 80 random bits, the high 16 and the low 64.
+    lastHi uint16
+    lastLo uint64
+    // now is time.Now, and only replaced in tests.
+    now func() time.Time
+}
+
+func newULIDGenerator() *ulidGenerator {
+    return &ulidGenerator{now: time.Now}
+}
+
+func (g *ulidGenerator) NewID() string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    ms := uint64(g.now().UnixNano() / int64(time.Millisecond))
+    if ms <= g.lastMS {
+        // the same millisecond, or the clock went backwards. either way the last timestamp is reused
+        //   and the random part incremented, so the id still sorts after the last one.
+        ms = g.lastMS
+        g.lastLo++
+        if g.lastLo == 0 {
+            // 2^80 ids in one millisecond isn't going to happen.
+            g.lastHi++
+        }
+    } else {
+        b := make([]byte, 10)
+        if _, err := rand.Read(b); err != nil {
+            panic(err)
+        }
+        g.lastHi = binary.BigEndian.Uint16(b[:2])
+        g.lastLo = binary.BigEndian.Uint64(b[2:])
+    }
+    g.lastMS = ms
+
+    // 48 bits of time then 80 of randomness, 128 in all, as 26 base32 characters.
+    b := make([]byte, 16)
+    binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+    binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+    binary.BigEndian.PutUint16(b[6:8], g.lastHi)
+    binary.BigEndian.PutUint64(b[8:16], g.lastLo)
+
+    return encodeULID(b)
+}
+
+// encodeULID writes 128 bits as 26 base32 characters. 26*5 is 130, so the first character only
+//   carries 3 bits.
+func encodeULID(b []byte) string {
+    hi := binary.BigEndian.Uint64(b[0:8])
+    lo := binary.BigEndian.Uint64(b[8:16])
+
+    out := make([]byte, 26)
+    for i := 25; i >= 0; i-- {
+        out[i] = crockfordBase32[lo&0x1f]
+        // shift the 128 bits right by 5.
+        lo = lo>>5 | hi<<59
+        hi >>= 5
+    }
+
+    return string(out)
+}
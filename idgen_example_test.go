@@ -0,0 +1,64 @@
+package examplePackage
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// ids from one generator always sort in the order they were made, even when the clock doesn't move
+//   or moves backwards.
+func TestULIDGeneratorOrder(t *testing.T) {
+    t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+    clock := []time.Time{
+        t0,
+        t0, // same millisecond
+        t0.Add(300 * time.Microsecond), // still the same millisecond
+        t0.Add(-5 * time.Millisecond), // the clock went backwards
+        t0.Add(time.Millisecond),
+        t0.Add(time.Millisecond),
+    }
+    tick := 0
+    g := &ulidGenerator{now: func() time.Time {
+        now := clock[tick]
+        tick++
+        return now
+    }}
+
+    ids := make([]string, len(clock))
+    for i := range ids {
+        ids[i] = g.NewID()
+        if len(ids[i]) != 26 || strings.Trim(ids[i], crockfordBase32) != "" {
+            t.Fatalf("id %q isn't 26 base32 characters", ids[i])
+        }
+        if i > 0 && ids[i] <= ids[i-1] {
+            t.Errorf("id %d %s doesn't sort after %s", i, ids[i], ids[i-1])
+        }
+    }
+
+    // the first four share t0's timestamp. the backwards one reuses it instead of going back in time.
+    for _, id := range ids[1:4] {
+        if id[:10] != ids[0][:10] {
+            t.Errorf("timestamp of %s = %s, want %s", id, id[:10], ids[0][:10])
+        }
+    }
+    if ids[4][:10] <= ids[0][:10] {
+        t.Errorf("timestamp of %s didn't move forward from %s", ids[4], ids[0][:10])
+    }
+}
+
+func TestEncodeULID(t *testing.T) {
+    zero := make([]byte, 16)
+    if got := encodeULID(zero); got != strings.Repeat("0", 26) {
+        t.Errorf("encodeULID(zero) = %s", got)
+    }
+
+    ones := make([]byte, 16)
+    for i := range ones {
+        ones[i] = 0xff
+    }
+    // the first character only carries 3 bits, so it tops out at 7.
+    if got, want := encodeULID(ones), "7"+strings.Repeat("Z", 25); got != want {
+        t.Errorf("encodeULID(ones) = %s, want %s", got, want)
+    }
+}
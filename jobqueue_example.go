@@ -0,0 +1,161 @@
+/*
+A jobQueue runs side effects (webhooks, emails, ...) after the response has been sent, so a slow third
+party adds nothing to request latency.
+
+It's a buffered channel drained by a fixed number of workers. The buffer is the backpressure: when it's
+full, Enqueue either waits up to BlockTimeout for room or gives up straight away, depending on config.
+A job that gives up is dropped, so only work that can be lost belongs here. Work that must happen goes
+through the outbox (events_example.go).
+
+On shutdown the queue stops taking jobs and the workers finish what's already queued, until the
+shutdown deadline. Jobs still running at the deadline see their context cancelled.
+*/
+package examplePackage
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/sirupsen/logrus"
+)
+
+// what Enqueue does when the queue is full.
+const (
+    jobsDrop = "drop"
+    jobsBlock = "block"
+)
+
+type jobQueueConfig struct {
+    QueueSize int
+    Workers int
+    FullPolicy string
+    // BlockTimeout is how long Enqueue waits for room under jobsBlock.
+    BlockTimeout time.Duration
+}
+
+var defaultJobQueueConfig = jobQueueConfig{
+    QueueSize: 1000,
+    Workers: 8,
+    FullPolicy: jobsDrop,
+    BlockTimeout: 50 * time.Millisecond,
+}
+
+type jobQueue struct {
+    cfg jobQueueConfig
+    jobs chan func(context.Context)
+
+    // ctx is what jobs run with. it's NOT the request's context (the request is long gone by then) and
+    //   it's not main's context either, because queued jobs should still run while shutting down.
+    //   it's only cancelled when the shutdown deadline passes.
+    ctx context.Context
+    cancel context.CancelFunc
+    wg sync.WaitGroup
+
+    // mu guards closed. Enqueue holds the read lock while sending so Shutdown can't close the channel
+    //   under it.
+    mu sync.RWMutex
+    closed bool
+}
+
+// newJobQueue starts the workers. they run until Shutdown.
+func newJobQueue(cfg jobQueueConfig) *jobQueue {
+    ctx, cancel := context.WithCancel(context.Background())
+    q := &jobQueue{
+        cfg: cfg,
+        jobs: make(chan func(context.Context), cfg.QueueSize),
+        ctx: ctx,
+        cancel: cancel,
+    }
+
+    for i := 0; i < cfg.Workers; i++ {
+        q.wg.Add(1)
+        go q.work()
+    }
+
+    return q
+}
+
+func (q *jobQueue) work() {
+    defer q.wg.Done()
+
+    // range stops once Shutdown closes the channel AND everything in it has been taken.
+    for job := range q.jobs {
+        // past the shutdown deadline. the rest of the queue is skipped, not started with a dead context.
+        if q.ctx.Err() != nil {
+            continue
+        }
+        q.run(job)
+    }
+}
+
+// run calls one job. a panicking job is logged instead of taking the worker (and the process) down.
+func (q *jobQueue) run(job func(context.Context)) {
+    defer func() {
+        if r := recover(); r != nil {
+            logrus.WithField("panic", r).Error("job panicked")
+        }
+    }()
+
+    job(q.ctx)
+}
+
+// Enqueue queues job to run in the background.
+// it returns false when the job was dropped because the queue is full or shutting down. the caller
+//   logs that, since it knows what the job was for.
+func (q *jobQueue) Enqueue(job func(context.Context)) bool {
+    q.mu.RLock()
+    defer q.mu.RUnlock()
+
+    if q.closed {
+        return false
+    }
+
+    select {
+    case q.jobs <- job:
+        return true
+    default:
+    }
+
+    if q.cfg.FullPolicy != jobsBlock {
+        return false
+    }
+
+    timer := time.NewTimer(q.cfg.BlockTimeout)
+    defer timer.Stop()
+
+    select {
+    case q.jobs <- job:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+// Shutdown stops new jobs and waits for the queued ones to finish, or for ctx to be done.
+// when ctx wins, the jobs' context is cancelled and ctx's error is returned. jobs still in the queue
+//   at that point are skipped.
+func (q *jobQueue) Shutdown(ctx context.Context) error {
+    q.mu.Lock()
+    if !q.closed {
+        q.closed = true
+        close(q.jobs)
+    }
+    q.mu.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        q.wg.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        q.cancel()
+        return nil
+    case <-ctx.Done():
+        q.cancel()
+        logrus.WithField("pending_jobs", len(q.jobs)).Warn("job queue did not drain before the deadline")
+        return ctx.Err()
+    }
+}
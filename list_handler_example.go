@@ -0,0 +1,570 @@
+/*
+The list endpoint, GET /v1/users.
+
+It follows the same pattern as CreateUserHandler: the main handler only decides the http status,
+and handleGetAllUsers has the logic and communicates back with sentinel errors.
+*/
+package examplePackage
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+    "github.com/sirupsen/logrus"
+)
+
+const (
+    defaultListLimit = 20
+    maxListLimit = 100
+
+    // how long the list query gets when the client asks for a partial result instead of an error.
+    partialListTimeout = 2 * time.Second
+
+    // maxBatchIDs caps ?ids=. like maxFilterValues, every id is another placeholder in the IN clause.
+    maxBatchIDs = 100
+)
+
+// sortColumns is the whitelist of sort keys clients can use, mapped to their sql column.
+// the client never gets to put its own text into ORDER BY. that's what prevents sql injection.
+var sortColumns = map[string]string{
+    "id": "id",
+    "full_name": "full_name",
+    "city": "city",
+    "state": "state",
+    "zip_code": "zip_code",
+}
+
+type listUsersResponse struct {
+    Users []userRecord `json:"users"`
+
+    // Total is how many users match the filters across every page. the same numbers are sent as
+    //   headers, see setPaginationHeaders.
+    Total int `json:"total"`
+    Limit int `json:"limit"`
+    Offset int `json:"offset"`
+
+    // Partial is true when the deadline cut the query short and Users is incomplete.
+    Partial bool `json:"partial"`
+
+    // NextCursor is the ?cursor= for the page after this one. it's only set when the page is sorted by
+    //   id and there may be more users after it. see encodeCursor.
+    NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// usersByIDsResponse is the body of GET /v1/users?ids=.
+type usersByIDsResponse struct {
+    // Users are in the order their ids were asked for.
+    Users []userRecord `json:"users"`
+    // NotFound is the requested ids that aren't users, including soft deleted ones. it's [] rather
+    //   than null when every id was found.
+    NotFound []string `json:"not_found"`
+}
+
+// GET /v1/users?limit=10&offset=5&sort=state,-zip_code&state=CA,NV&city=Oakland&partial=true
+// GET /v1/users?limit=10&cursor=dV8xMjM pages by id from the last page's next_cursor instead of an offset.
+// GET /v1/users?ids=a,b,c fetches those users instead of a page. see getUsersByIDs.
+func (c *Controller) GetAllUsersHandler(rw http.ResponseWriter, req *http.Request) {
+    lf := ctxpkg.LogFields(req.Context())
+    lf["handler"] = "GetAllUsers"
+
+    // checked for presence, not value, so an empty ?ids= is a 400 and not the first page.
+    _, byIDs := req.URL.Query()["ids"]
+
+    // ndjson clients get every matching user streamed, one per line, instead of a page.
+    if !byIDs && c.negotiator(req).MediaType() == mediaTypeNDJSON {
+        c.streamUsersNDJSON(rw, req, lf)
+        return
+    }
+
+    // the route is Streaming for the ndjson branch above, so withRequestTimeout gave it no deadline.
+    //   a page or a lookup by id is an ordinary request, so it gets the ordinary budget here instead.
+    RequestTimeout(defaultRequestTimeout)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        if byIDs {
+            c.getUsersByIDs(rw, req, lf)
+            return
+        }
+        c.getUsersPage(rw, req, lf)
+    })).ServeHTTP(rw, req)
+}
+
+// getUsersPage answers a plain list request with one page.
+func (c *Controller) getUsersPage(rw http.ResponseWriter, req *http.Request, lf logrus.Fields) {
+    ctx := req.Context()
+    n := c.negotiator(req)
+
+    listResp, err := c.handleGetAllUsers(ctx, req)
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to list users")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    setPaginationHeaders(rw.Header(), req.URL, listResp)
+
+    // a dashboard would rather see some rows than an error. 206 tells the client the body is
+    //   valid but incomplete, and the partial flag says the same thing in the body.
+    if listResp.Partial {
+        ctxpkg.Logger(ctx).WithFields(lf).Warn("returning partial user list")
+        n.Respond(rw, http.StatusPartialContent, response.Success(listResp))
+        return
+    }
+
+    n.Respond(rw, http.StatusOK, response.Success(listResp))
+}
+
+func (c *Controller) handleGetAllUsers(ctx context.Context, req *http.Request) (listUsersResponse, error) {
+    resp := listUsersResponse{}
+    qv := queryParams(req)
+
+    // a page either starts at a cursor or at an offset, never both.
+    if err := mutuallyExclusive(req, "cursor", "offset"); err != nil {
+        return resp, err
+    }
+
+    limit, err := qv.IntBetween("limit", defaultListLimit, 1, maxListLimit)
+    if err != nil {
+        return resp, err
+    }
+
+    offset, err := qv.IntBetween("offset", 0, 0, maxOffset)
+    if err != nil {
+        return resp, err
+    }
+
+    orderBy, err := parseSort(qv.String("sort", ""))
+    if err != nil {
+        return resp, err
+    }
+
+    afterID, err := parseCursor(qv.String("cursor", ""))
+    if err != nil {
+        return resp, err
+    }
+    // the cursor is an id, so it only marks a place in a list sorted by id.
+    if afterID != "" && orderBy != "id ASC" {
+        return resp, fmt.Errorf("cursor can only be used when sorting by id. %w", errBadRequest)
+    }
+
+    filter, err := parseUserFilter(ctx, qv)
+    if err != nil {
+        return resp, err
+    }
+
+    // the count runs before the partial deadline is applied. a page can be cut short, but a wrong total
+    //   would send pagination clients to pages that don't exist.
+    total, err := c.DB.CountUsers(ctx, filter)
+    if err != nil {
+        return resp, fmt.Errorf("failed to count users. %s. %w", err, errInternal)
+    }
+
+    // partial results are opt in. without the flag the query runs under the request's context
+    //   and a timeout is an error like it always was.
+    allowPartial, err := qv.Bool("partial", false)
+    if err != nil {
+        return resp, err
+    }
+    if allowPartial {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, partialListTimeout)
+        // always call cancel, otherwise the timer leaks until it fires.
+        defer cancel()
+    }
+
+    users, partial, err := c.DB.ListUsers(ctx, listUsersQuery{
+        Limit: limit,
+        Offset: offset,
+        OrderBy: orderBy,
+        Filter: filter,
+        AfterID: afterID,
+    })
+    if err != nil {
+        return resp, fmt.Errorf("failed to list users. %s. %w", err, errInternal)
+    }
+
+    if partial && !allowPartial {
+        return resp, fmt.Errorf("user list timed out. %w", errInternal)
+    }
+
+    resp.Users = users
+    resp.Partial = partial
+    resp.Total = total
+    resp.Limit = limit
+    resp.Offset = offset
+    // a short page that wasn't cut off is the last one. a partial page may have more users after it.
+    if orderBy == "id ASC" && len(users) > 0 && (len(users) == limit || partial) {
+        resp.NextCursor = encodeCursor(users[len(users)-1].ID)
+    }
+    return resp, nil
+}
+
+// encodeCursor makes the cursor for the page after the user with id. it's the id in base64 so clients
+//   treat it as opaque and don't build their own.
+func encodeCursor(id string) string {
+    return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// parseCursor is the id in a cursor from encodeCursor. an empty cursor is the first page, "".
+func parseCursor(cursor string) (string, error) {
+    if cursor == "" {
+        return "", nil
+    }
+
+    id, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil || len(id) == 0 {
+        return "", fmt.Errorf("cursor %q is not valid. %w", cursor, errBadRequest)
+    }
+
+    return string(id), nil
+}
+
+// getUsersByIDs answers ?ids= with one query, instead of the client sending a GET per user.
+// an id that isn't found isn't an error. it's in NotFound, so the status is 200 as long as the query worked.
+// the paging, sort and filter params don't apply and are ignored.
+func (c *Controller) getUsersByIDs(rw http.ResponseWriter, req *http.Request, lf logrus.Fields) {
+    ctx := req.Context()
+    n := c.negotiator(req)
+
+    resp, err := c.handleGetUsersByIDs(ctx, queryParams(req))
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to get users by id")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    n.Respond(rw, http.StatusOK, response.Success(resp))
+}
+
+func (c *Controller) handleGetUsersByIDs(ctx context.Context, qv queryValues) (usersByIDsResponse, error) {
+    resp := usersByIDsResponse{}
+
+    ids, err := parseIDs(qv.String("ids", ""))
+    if err != nil {
+        return resp, err
+    }
+
+    users, err := c.DB.GetUsersByIDs(ctx, ids)
+    if err != nil {
+        return resp, fmt.Errorf("failed to get users by id. %s. %w", err, errInternal)
+    }
+
+    // the store's order is whatever the database's is, so the users are put back in the order asked for.
+    byID := make(map[string]userRecord, len(users))
+    for _, u := range users {
+        byID[u.ID] = u
+    }
+
+    resp.Users = make([]userRecord, 0, len(users))
+    resp.NotFound = []string{}
+    for _, id := range ids {
+        if u, ok := byID[id]; ok {
+            resp.Users = append(resp.Users, u)
+        } else {
+            resp.NotFound = append(resp.NotFound, id)
+        }
+    }
+
+    return resp, nil
+}
+
+// parseIDs turns "a,b,c" into the ids, trimmed and without duplicates, in the order given.
+// it's errBadRequest when there are none, or more than maxBatchIDs.
+func parseIDs(raw string) ([]string, error) {
+    parts := strings.Split(raw, ",")
+    ids := make([]string, 0, len(parts))
+    seen := make(map[string]bool, len(parts))
+    for _, id := range parts {
+        id = strings.TrimSpace(id)
+        if id == "" || seen[id] {
+            continue
+        }
+        seen[id] = true
+        ids = append(ids, id)
+    }
+
+    if len(ids) == 0 {
+        return nil, fmt.Errorf("ids needs at least one id. %w", errBadRequest)
+    }
+    // the cap is on distinct ids, so repeating one doesn't count against it.
+    if len(ids) > maxBatchIDs {
+        return nil, fmt.Errorf("ids accepts at most %d ids. %w", maxBatchIDs, errBadRequest)
+    }
+
+    return ids, nil
+}
+
+type countUsersResponse struct {
+    Count int `json:"count" xml:"count"`
+}
+
+// GET /v1/users/count?state=CA,NV&city=Oakland
+// the total for a dashboard, without reading any rows. the filters are the same as the list's.
+func (c *Controller) CountUsersHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "CountUsers"
+    n := c.negotiator(req)
+
+    countResp, err := c.handleCountUsers(ctx, req)
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to count users")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    n.Respond(rw, http.StatusOK, response.Success(countResp))
+}
+
+func (c *Controller) handleCountUsers(ctx context.Context, req *http.Request) (countUsersResponse, error) {
+    resp := countUsersResponse{}
+
+    filter, err := parseUserFilter(ctx, queryParams(req))
+    if err != nil {
+        return resp, err
+    }
+
+    // CountUsers is a SELECT COUNT(*) with the list's WHERE clause. see store_example.go.
+    count, err := c.DB.CountUsers(ctx, filter)
+    if err != nil {
+        return resp, fmt.Errorf("failed to count users. %s. %w", err, errInternal)
+    }
+
+    resp.Count = count
+    return resp, nil
+}
+
+// setPaginationHeaders sets X-Total-Count and an RFC 5988 Link header with the next and prev pages,
+//   for clients that paginate without parsing the body.
+// the links are u with only limit and offset changed, so filters and sort carry over to every page.
+// next is left out on the last page and prev on the first.
+// a request paged by cursor gets its next link by cursor too. it has no prev, since a cursor only
+//   goes forward.
+func setPaginationHeaders(h http.Header, u *url.URL, page listUsersResponse) {
+    h.Set("X-Total-Count", strconv.Itoa(page.Total))
+
+    if _, byCursor := u.Query()["cursor"]; byCursor {
+        if page.NextCursor != "" {
+            h.Set("Link", cursorLink(u, page.Limit, page.NextCursor))
+        }
+        return
+    }
+
+    links := make([]string, 0, 2)
+    if next := page.Offset + page.Limit; next < page.Total {
+        links = append(links, pageLink(u, page.Limit, next, "next"))
+    }
+    if page.Offset > 0 {
+        prev := page.Offset - page.Limit
+        if prev < 0 {
+            prev = 0
+        }
+        links = append(links, pageLink(u, page.Limit, prev, "prev"))
+    }
+
+    if len(links) > 0 {
+        h.Set("Link", strings.Join(links, ", "))
+    }
+}
+
+// pageLink is one Link header entry. eg. </v1/users?limit=10&offset=20&state=CA>; rel="next"
+// the url is relative, which the RFC allows, so it's right behind any proxy or host name.
+func pageLink(u *url.URL, limit, offset int, rel string) string {
+    q := u.Query()
+    q.Set("limit", strconv.Itoa(limit))
+    q.Set("offset", strconv.Itoa(offset))
+    // a cursor and an offset can't be sent together. see mutuallyExclusive.
+    q.Del("cursor")
+
+    return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, q.Encode(), rel)
+}
+
+// cursorLink is the next page's Link header entry when paging by cursor.
+func cursorLink(u *url.URL, limit int, cursor string) string {
+    q := u.Query()
+    q.Set("limit", strconv.Itoa(limit))
+    q.Set("cursor", cursor)
+
+    return fmt.Sprintf(`<%s?%s>; rel="next"`, u.Path, q.Encode())
+}
+
+// parseSort turns "state,-zip_code" into "state ASC, zip_code DESC, id ASC".
+// a leading "-" means descending. keys are applied in the order given.
+// id is always added last (unless the client already sorted by it) so rows with equal sort values
+//   come back in the same order every time. without that, offset pagination can skip or repeat rows.
+func parseSort(raw string) (string, error) {
+    if raw == "" {
+        return "id ASC", nil
+    }
+
+    keys := strings.Split(raw, ",")
+    // +1 for the id tie breaker.
+    clauses := make([]string, 0, len(keys)+1)
+    hasID := false
+    for _, key := range keys {
+        key = strings.TrimSpace(key)
+
+        dir := "ASC"
+        if strings.HasPrefix(key, "-") {
+            dir = "DESC"
+            key = key[1:]
+        }
+
+        col, ok := sortColumns[key]
+        if !ok {
+            return "", fmt.Errorf("cannot sort by %q. %w", key, errBadRequest)
+        }
+
+        if col == "id" {
+            hasID = true
+        }
+        clauses = append(clauses, col+" "+dir)
+    }
+
+    if !hasID {
+        clauses = append(clauses, "id ASC")
+    }
+
+    return strings.Join(clauses, ", "), nil
+}
+
+// maxFilterValues caps how many values a single filter may list, eg. ?state=CA,NY,...
+// every value is another placeholder in an IN clause, so without a cap a client could send thousands.
+// it's a var so a deployment can raise or lower it.
+var maxFilterValues = 20
+
+// adminScope lets a caller see soft deleted users with ?include_deleted=true.
+const adminScope = "users:admin"
+
+// parseUserFilter reads the state, city and include_deleted filters.
+// state may be a comma separated list. each one is checked against validStates so a typo is a 400
+//   instead of a silently empty list.
+func parseUserFilter(ctx context.Context, qv queryValues) (userFilter, error) {
+    f := userFilter{
+        City: qv.String("city", ""),
+    }
+
+    includeDeleted, err := parseIncludeDeleted(ctx, qv)
+    if err != nil {
+        return f, err
+    }
+    f.IncludeDeleted = includeDeleted
+
+    raw := qv.String("state", "")
+    if raw == "" {
+        return f, nil
+    }
+
+    states := strings.Split(raw, ",")
+    if len(states) > maxFilterValues {
+        return f, fmt.Errorf("state accepts at most %d values. %w", maxFilterValues, errBadRequest)
+    }
+
+    f.States = make([]string, 0, len(states))
+    for _, st := range states {
+        st = strings.ToUpper(strings.TrimSpace(st))
+        if !validStates[st] {
+            return f, fmt.Errorf("%q is not a valid state. %w", st, errBadRequest)
+        }
+        f.States = append(f.States, st)
+    }
+
+    return f, nil
+}
+
+// parseIncludeDeleted reads ?include_deleted=. it's a 403 for anyone without adminScope, rather than
+//   being ignored, so a caller never mistakes "no deleted users shown" for "there are none".
+func parseIncludeDeleted(ctx context.Context, qv queryValues) (bool, error) {
+    include, err := qv.Bool("include_deleted", false)
+    if err != nil {
+        return false, err
+    }
+    if include && !ctxpkg.HasScope(ctx, adminScope) {
+        return false, &HTTPError{
+            Status: http.StatusForbidden,
+            Code: codeForbidden,
+            Msg: "include_deleted requires the " + adminScope + " scope",
+        }
+    }
+
+    return include, nil
+}
+
+// streamUsersNDJSON writes one json object per line and flushes each one, so neither side has to hold
+//   the whole list in memory.
+// when the client disconnects, the request's context is cancelled. the callback checks it on every row,
+//   and because the query itself runs with the same context, the database stops too.
+func (c *Controller) streamUsersNDJSON(rw http.ResponseWriter, req *http.Request, lf logrus.Fields) {
+    ctx := req.Context()
+
+    filter, err := parseUserFilter(ctx, queryParams(req))
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("invalid stream filter")
+        if !c.respondHTTPError(rw, req, err) {
+            c.negotiator(req).Respond(rw, http.StatusBadRequest, response.Error(err))
+        }
+        return
+    }
+
+    rw.Header().Set("Content-Type", mediaTypeNDJSON)
+    rw.WriteHeader(http.StatusOK)
+
+    flusher, _ := rw.(http.Flusher)
+    enc := json.NewEncoder(rw)
+    count := 0
+    err = c.DB.StreamUsers(ctx, filter, func(u userRecord) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+
+        // Encode writes the trailing newline, which is the ndjson record separator.
+        if err := enc.Encode(u); err != nil {
+            return err
+        }
+        if flusher != nil {
+            flusher.Flush()
+        }
+
+        count++
+        return nil
+    })
+
+    // the status is already sent, so a failure part way through can only be logged.
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).WithField("rows", count).Warn("ndjson stream stopped early")
+    }
+}
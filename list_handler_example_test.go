@@ -0,0 +1,257 @@
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    errs "errors"
+)
+
+func TestParseIncludeDeleted(t *testing.T) {
+    tests := []struct {
+        name string
+        query string
+        scope string
+        want bool
+        wantStatus int
+    }{
+        {"not asked for", "", "", false, 0},
+        {"admin", "include_deleted=true", adminScope, true, 0},
+        {"admin asking for false", "include_deleted=false", adminScope, false, 0},
+        {"no scope", "include_deleted=true", "users:read", false, http.StatusForbidden},
+        {"not a bool", "include_deleted=maybe", adminScope, false, http.StatusBadRequest},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodGet, "/v1/users?"+tt.query, nil)
+            ctx := ctxWithScope(req.Context(), tt.scope)
+
+            got, err := parseIncludeDeleted(ctx, queryParams(req))
+            if got != tt.want {
+                t.Errorf("parseIncludeDeleted() = %v, want %v", got, tt.want)
+            }
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Errorf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+        })
+    }
+}
+
+// an admin with a real token has to be able to count deleted users. before AuthMiddleware existed
+//   nobody could ever get adminScope.
+func TestCountUsersIncludeDeletedWithAdminToken(t *testing.T) {
+    ctx := context.Background()
+    store := newMemUserStore()
+    kept, err := store.InsertUser(ctx, createUserRequest{FullName: "Ann", Email: "ann@example.com"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    gone, err := store.InsertUser(ctx, createUserRequest{FullName: "Bob", Email: "bob@example.com"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := store.SoftDeleteUser(ctx, gone.ID); err != nil {
+        t.Fatal(err)
+    }
+    c := &Controller{DB: store}
+
+    exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+    token := signTestToken(testSigningKey, `{"alg":"HS256"}`, `{"sub":"admin_1","scope":"`+adminScope+`","exp":`+exp+`}`)
+
+    var got countUsersResponse
+    h := AuthMiddleware(newHS256Verifier(testSigningKey))(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        got, err = c.handleCountUsers(req.Context(), req)
+    }))
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/users/count?include_deleted=true", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    h.ServeHTTP(httptest.NewRecorder(), req)
+
+    if err != nil {
+        t.Fatalf("handleCountUsers() error = %v", err)
+    }
+    if got.Count != 2 {
+        t.Errorf("Count = %d, want 2 (%s and the deleted %s)", got.Count, kept.ID, gone.ID)
+    }
+}
+
+// errStatus is the status a handler would respond with for err, or 0 for nil.
+func errStatus(err error) int {
+    var he *HTTPError
+    switch {
+    case err == nil:
+        return 0
+    case errs.As(err, &he):
+        return he.Status
+    case errs.Is(err, errBadRequest):
+        return http.StatusBadRequest
+    case errs.Is(err, errUnprocessable):
+        return http.StatusUnprocessableEntity
+    case errs.Is(err, errNotFound):
+        return http.StatusNotFound
+    case errs.Is(err, errConflict):
+        return http.StatusConflict
+    default:
+        return http.StatusInternalServerError
+    }
+}
+
+// deadlineStore records whether the list's queries ran with a deadline.
+type deadlineStore struct {
+    *memUserStore
+    hadDeadline bool
+}
+
+func (d *deadlineStore) CountUsers(ctx context.Context, f userFilter) (int, error) {
+    _, d.hadDeadline = ctx.Deadline()
+    return d.memUserStore.CountUsers(ctx, f)
+}
+
+func (d *deadlineStore) GetUsersByIDs(ctx context.Context, ids []string) ([]userRecord, error) {
+    _, d.hadDeadline = ctx.Deadline()
+    return d.memUserStore.GetUsersByIDs(ctx, ids)
+}
+
+// the route is Streaming, so withRequestTimeout skips it. the handler has to add the deadline itself.
+func TestGetAllUsersHasDeadline(t *testing.T) {
+    for _, target := range []string{"/v1/users", "/v1/users?ids=1,2"} {
+        t.Run(target, func(t *testing.T) {
+            store := &deadlineStore{memUserStore: newMemUserStore()}
+            c := &Controller{DB: store}
+
+            c.GetAllUsersHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+
+            if !store.hadDeadline {
+                t.Error("the query ran without a deadline")
+            }
+        })
+    }
+}
+
+// following next_cursor from the first page has to visit every user once, in id order.
+func TestCursorPagination(t *testing.T) {
+    ctx := context.Background()
+    store := newMemUserStore()
+    // past 9, so the ids can't be compared as plain strings.
+    for i := 0; i < 12; i++ {
+        if _, err := store.InsertUser(ctx, createUserRequest{FullName: "User " + strconv.Itoa(i)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    c := &Controller{DB: store}
+
+    got := []string{}
+    target := "/v1/users?limit=2"
+    for pages := 0; target != ""; pages++ {
+        if pages > 6 {
+            t.Fatal("next_cursor never ran out")
+        }
+        req := httptest.NewRequest(http.MethodGet, target, nil)
+        page, err := c.handleGetAllUsers(ctx, req)
+        if err != nil {
+            t.Fatalf("handleGetAllUsers(%s) error = %v", target, err)
+        }
+        for _, u := range page.Users {
+            got = append(got, u.ID)
+        }
+
+        target = ""
+        if page.NextCursor != "" {
+            target = "/v1/users?limit=2&cursor=" + page.NextCursor
+        }
+    }
+
+    if want := "1,2,3,4,5,6,7,8,9,10,11,12"; strings.Join(got, ",") != want {
+        t.Errorf("ids = %s, want %s", strings.Join(got, ","), want)
+    }
+}
+
+// a limit too big for any int is out of range, the same 400 as one that's just over maxListLimit.
+func TestListLimitOverflow(t *testing.T) {
+    c := &Controller{DB: newMemUserStore()}
+
+    for _, limit := range []string{"99999999999999999999", strconv.Itoa(maxListLimit + 1)} {
+        req := httptest.NewRequest(http.MethodGet, "/v1/users?limit="+limit, nil)
+        _, err := c.handleGetAllUsers(req.Context(), req)
+        if errStatus(err) != http.StatusBadRequest || !strings.Contains(err.Error(), "limit out of range") {
+            t.Errorf("limit=%s error = %v, want a 400 saying limit is out of range", limit, err)
+        }
+    }
+}
+
+// ?state= can list up to maxFilterValues states. one more is a 400, before anything reaches the store.
+func TestListStateFilterCap(t *testing.T) {
+    c := &Controller{DB: newMemUserStore()}
+    states := sortedStates()
+
+    tests := []struct {
+        n int
+        wantStatus int
+    }{
+        {maxFilterValues, 0},
+        {maxFilterValues + 1, http.StatusBadRequest},
+    }
+
+    for _, tt := range tests {
+        req := httptest.NewRequest(http.MethodGet, "/v1/users?state="+strings.Join(states[:tt.n], ","), nil)
+        _, err := c.handleGetAllUsers(req.Context(), req)
+        if status := errStatus(err); status != tt.wantStatus {
+            t.Errorf("%d states: status = %d, want %d (err %v)", tt.n, status, tt.wantStatus, err)
+        }
+    }
+}
+
+func TestCursorPaginationBadRequests(t *testing.T) {
+    c := &Controller{DB: newMemUserStore()}
+    cursor := encodeCursor("2")
+
+    tests := []struct {
+        name string
+        query string
+    }{
+        {"cursor and offset", "cursor=" + cursor + "&offset=0"},
+        {"cursor with another sort", "cursor=" + cursor + "&sort=city"},
+        {"not base64", "cursor=%25%25"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodGet, "/v1/users?"+tt.query, nil)
+            _, err := c.handleGetAllUsers(req.Context(), req)
+            if status := errStatus(err); status != http.StatusBadRequest {
+                t.Errorf("status = %d, want %d (err %v)", status, http.StatusBadRequest, err)
+            }
+        })
+    }
+}
+
+// a page starts at a cursor or at an offset. sending both is a 400 that names them, whatever the offset is.
+func TestCursorWithOffsetRejected(t *testing.T) {
+    c := &Controller{DB: newMemUserStore()}
+
+    for _, offset := range []string{"0", "5", ""} {
+        req := httptest.NewRequest(http.MethodGet, "/v1/users?cursor="+encodeCursor("2")+"&offset="+offset, nil)
+        _, err := c.handleGetAllUsers(req.Context(), req)
+        if errStatus(err) != http.StatusBadRequest || !strings.Contains(err.Error(), "cursor") || !strings.Contains(err.Error(), "offset") {
+            t.Errorf("offset=%q: error = %v, want a 400 naming cursor and offset", offset, err)
+        }
+    }
+}
+
+func TestSetPaginationHeadersByCursor(t *testing.T) {
+    u, _ := url.Parse("/v1/users?cursor=" + encodeCursor("2") + "&state=CA")
+    h := http.Header{}
+
+    setPaginationHeaders(h, u, listUsersResponse{Total: 9, Limit: 2, NextCursor: encodeCursor("4")})
+
+    want := `</v1/users?cursor=` + encodeCursor("4") + `&limit=2&state=CA>; rel="next"`
+    if got := h.Get("Link"); got != want {
+        t.Errorf("Link = %s, want %s", got, want)
+    }
+}
@@ -0,0 +1,139 @@
+/*
+Log format and level.
+
+Locally, logrus's text format is the easiest to read. In production our log pipeline ingests json, so
+every line has to be a json object or it's dropped. main() calls ConfigureLogging before anything
+else logs, with LOG_FORMAT and LOG_LEVEL from the environment.
+
+Every line also gets the same base fields (standardFields), so lines from every service can be
+filtered the same way in the pipeline.
+
+Debug logs for every request would cost more than they're worth, so only a sample of requests log at
+debug level (SamplingMiddleware). A request that ends in a 5xx always gets the detailed finish line
+from RequestLogMiddleware, sampled or not. its debug lines from earlier in the request are gone by
+then, which is the trade off for not buffering every request's logs.
+*/
+package examplePackage
+
+import (
+    "math/rand"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+    "github.com/sirupsen/logrus"
+)
+
+const (
+    logFormatText = "text"
+    logFormatJSON = "json"
+
+    defaultLogLevel = logrus.InfoLevel
+
+    // serviceName is the "service" field on every line.
+    serviceName = "users"
+
+    // 1 request in 100 logs at debug level unless settings say otherwise.
+    defaultLogSampleRate = 0.01
+)
+
+// the hook only needs adding once, however many times ConfigureLogging is called.
+var addStandardFieldsOnce sync.Once
+
+// ConfigureLogging sets logrus's format ("json" or "text") and level (eg. "debug", "warn").
+// an empty value means the default: text at info. an invalid one also gets the default, with a
+//   warning, because failing to start over a log setting would be worse than logging at info.
+func ConfigureLogging(format, level string) {
+    warnings := []string{}
+
+    switch strings.ToLower(strings.TrimSpace(format)) {
+    case logFormatJSON:
+        logrus.SetFormatter(&logrus.JSONFormatter{
+            // nanoseconds so lines logged in the same millisecond still sort correctly.
+            TimestampFormat: time.RFC3339Nano,
+        })
+    case "", logFormatText:
+        logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+    default:
+        logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+        warnings = append(warnings, "unknown log format "+format+". using text")
+    }
+
+    lvl := defaultLogLevel
+    if strings.TrimSpace(level) != "" {
+        parsed, err := logrus.ParseLevel(strings.TrimSpace(level))
+        if err != nil {
+            warnings = append(warnings, "unknown log level "+level+". using "+defaultLogLevel.String())
+        } else {
+            lvl = parsed
+        }
+    }
+    logrus.SetLevel(lvl)
+
+    addStandardFieldsOnce.Do(func() {
+        logrus.AddHook(newStandardFields())
+    })
+
+    // logged last, so the warnings come out in the format that was settled on.
+    for _, w := range warnings {
+        logrus.Warn(w)
+    }
+}
+
+// standardFields is a logrus hook that adds the service and host to every line.
+type standardFields struct {
+    host string
+}
+
+func newStandardFields() standardFields {
+    // an unknown host is still worth logging as such rather than leaving the field out.
+    host, err := os.Hostname()
+    if err != nil {
+        host = "unknown"
+    }
+
+    return standardFields{host: host}
+}
+
+func (sf standardFields) Levels() []logrus.Level {
+    return logrus.AllLevels
+}
+
+// Fire doesn't overwrite fields a caller already set.
+func (sf standardFields) Fire(e *logrus.Entry) error {
+    if _, ok := e.Data["service"]; !ok {
+        e.Data["service"] = serviceName
+    }
+    if _, ok := e.Data["host"]; !ok {
+        e.Data["host"] = sf.host
+    }
+
+    return nil
+}
+
+// logSampleRate is the fraction of requests to sample, from settings. it's read per request so a
+//   settings reload changes it.
+func (c *Controller) logSampleRate() float64 {
+    rate := c.currentSettings().LogSampleRate
+    if rate == nil {
+        return defaultLogSampleRate
+    }
+
+    return *rate
+}
+
+// SamplingMiddleware decides whether the request is sampled and records it in the request's context,
+//   where ctxpkg.Logger and RequestLogMiddleware read it. MainContextMiddleware keeps what's already in
+//   the context, so the two can run in either order.
+func (c *Controller) SamplingMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        if rand.Float64() < c.logSampleRate() {
+            req = req.WithContext(ctxpkg.SetSampled(req.Context(), true))
+        }
+
+        next.ServeHTTP(rw, req)
+    })
+}
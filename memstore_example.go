@@ -0,0 +1,512 @@
+/*
+memUserStore is an in-memory UserStore for handler tests.
+
+Handler tests plug it into Controller.DB and exercise the whole handler, including how store errors
+map to http statuses, without a database. FailNextInsert lets a test force the error paths.
+*/
+package examplePackage
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// memUser is a stored user. createUserRequest is what was inserted, and version/deleted are what the
+//   database would track alongside it.
+type memUser struct {
+    req createUserRequest
+    version int
+    createdAt time.Time
+    updatedAt time.Time
+    deleted bool
+    deletedAt time.Time
+}
+
+type memUserStore struct {
+    mu sync.Mutex
+    users map[string]memUser
+    nextID int
+    // ids makes new ids when it's set. otherwise they count up from 1, which reads easily in tests.
+    ids IDGenerator
+
+    // failNextInsert is returned (once) by the next InsertUser.
+    failNextInsert error
+
+    // outbox is every event ever inserted, in order. an event's id is its index plus one.
+    outbox []memEvent
+    // failNextEvent is returned (once) by the next outbox insert.
+    failNextEvent error
+}
+
+type memEvent struct {
+    ev event
+    dispatched bool
+}
+
+// newMemUserStore returns an empty store ready to be used as Controller.DB.
+func newMemUserStore() *memUserStore {
+    return &memUserStore{users: make(map[string]memUser)}
+}
+
+// FailNextInsert makes the next InsertUser return err instead of inserting.
+func (m *memUserStore) FailNextInsert(err error) {
+    m.mu.Lock()
+    m.failNextInsert = err
+    m.mu.Unlock()
+}
+
+// FailNextEvent makes the next outbox insert return err, including the one in InsertUserWithEvent.
+func (m *memUserStore) FailNextEvent(err error) {
+    m.mu.Lock()
+    m.failNextEvent = err
+    m.mu.Unlock()
+}
+
+func (m *memUserStore) InsertUser(ctx context.Context, cur createUserRequest) (userRecord, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.insert(cur)
+}
+
+// InsertUserWithEvent holds mu for the user and the event, so nothing sees one without the other, and
+//   takes the user back out if the event fails, like the sql store's rollback.
+func (m *memUserStore) InsertUserWithEvent(ctx context.Context, cur createUserRequest, newEvent func(userRecord) (event, error)) (userRecord, event, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u, err := m.insert(cur)
+    if err != nil {
+        return userRecord{}, event{}, err
+    }
+
+    ev, err := newEvent(u)
+    if err == nil {
+        ev.ID, err = m.insertEvent(ev)
+    }
+    if err != nil {
+        delete(m.users, u.ID)
+        return userRecord{}, event{}, err
+    }
+
+    return u, ev, nil
+}
+
+// BulkInsertUsers checks ctx before each user, like the sql store. anything that stops it part way,
+//   ctx included, takes back out the users and events already inserted, like the sql store's rollback.
+func (m *memUserStore) BulkInsertUsers(ctx context.Context, curs []createUserRequest, newEvent func(userRecord) (event, error)) ([]userRecord, []event, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    outboxLen := len(m.outbox)
+    users := make([]userRecord, 0, len(curs))
+    events := make([]event, 0, len(curs))
+    rollback := func(err error) ([]userRecord, []event, error) {
+        for _, u := range users {
+            delete(m.users, u.ID)
+        }
+        m.outbox = m.outbox[:outboxLen]
+        return nil, nil, err
+    }
+
+    for i, cur := range curs {
+        if err := ctx.Err(); err != nil {
+            return rollback(fmt.Errorf("bulk insert stopped after %d of %d users. %w", i, len(curs), err))
+        }
+
+        u, err := m.insert(cur)
+        if err != nil {
+            return rollback(fmt.Errorf("user %d. %w", i, err))
+        }
+        users = append(users, u)
+
+        ev, err := newEvent(u)
+        if err == nil {
+            ev.ID, err = m.insertEvent(ev)
+        }
+        if err != nil {
+            return rollback(err)
+        }
+        events = append(events, ev)
+    }
+
+    return users, events, nil
+}
+
+// insert must be called with mu held.
+func (m *memUserStore) insert(cur createUserRequest) (userRecord, error) {
+    if err := m.failNextInsert; err != nil {
+        m.failNextInsert = nil
+        return userRecord{}, err
+    }
+
+    // the same rule as the unique constraint on users.email.
+    if cur.Email != "" && m.emailTaken(cur.Email) {
+        return userRecord{}, fmt.Errorf("email %s is taken. %w", cur.Email, errConflict)
+    }
+
+    m.nextID++
+    id := strconv.Itoa(m.nextID)
+    if m.ids != nil {
+        id = m.ids.NewID()
+    }
+    now := time.Now().UTC()
+    u := memUser{req: cur, version: 1, createdAt: now, updatedAt: now}
+    m.users[id] = u
+
+    return u.record(id), nil
+}
+
+func (m *memUserStore) EmailExists(ctx context.Context, email string) (bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.emailTaken(email), nil
+}
+
+// emailTaken must be called with mu held. deleted users still hold their email, like in sql.
+func (m *memUserStore) emailTaken(email string) bool {
+    for _, u := range m.users {
+        if u.req.Email == email {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (m *memUserStore) GetUser(ctx context.Context, userID string) (userRecord, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u, ok := m.users[userID]
+    if !ok || u.deleted {
+        return userRecord{}, fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+
+    return u.record(userID), nil
+}
+
+func (m *memUserStore) GetUserIncludingDeleted(ctx context.Context, userID string) (userRecord, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u, ok := m.users[userID]
+    if !ok {
+        return userRecord{}, fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+
+    return u.record(userID), nil
+}
+
+func (m *memUserStore) GetUsersByIDs(ctx context.Context, ids []string) ([]userRecord, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    users := make([]userRecord, 0, len(ids))
+    for _, id := range ids {
+        if u, ok := m.users[id]; ok && !u.deleted {
+            users = append(users, u.record(id))
+        }
+    }
+
+    return users, nil
+}
+
+func (m *memUserStore) UserVersion(ctx context.Context, userID string) (int, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u, ok := m.users[userID]
+    if !ok || u.deleted {
+        return 0, fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+
+    return u.version, nil
+}
+
+func (m *memUserStore) ListUsers(ctx context.Context, q listUsersQuery) ([]userRecord, bool, error) {
+    users := m.matching(q.Filter)
+    sortRecords(users, q.OrderBy)
+
+    if q.AfterID != "" {
+        // users is sorted by id, so the page starts at the first id past the cursor. the ids are
+        //   compared padded, like sortRecords does, or "10" would come before "9".
+        after := recordColumn(userRecord{ID: q.AfterID}, "id")
+        start := sort.Search(len(users), func(i int) bool { return recordColumn(users[i], "id") > after })
+        users = users[start:]
+    }
+
+    if q.Offset >= len(users) {
+        return []userRecord{}, false, nil
+    }
+    users = users[q.Offset:]
+    if q.Limit < len(users) {
+        users = users[:q.Limit]
+    }
+
+    return users, false, nil
+}
+
+func (m *memUserStore) CountUsers(ctx context.Context, f userFilter) (int, error) {
+    return len(m.matching(f)), nil
+}
+
+func (m *memUserStore) StreamUsers(ctx context.Context, f userFilter, fn func(userRecord) error) error {
+    users := m.matching(f)
+    sortRecords(users, "id ASC")
+
+    for _, u := range users {
+        if err := fn(u); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (m *memUserStore) UpdateUser(ctx context.Context, p userPatch) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.update(p)
+}
+
+// BulkUpdateUsers has the same per-item semantics as the sql store. there's no transaction to roll back
+//   because nothing here can fail part way through.
+// ctx is only checked before anything is updated for the same reason. the sql store checks between items.
+func (m *memUserStore) BulkUpdateUsers(ctx context.Context, ps []userPatch) ([]error, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    results := make([]error, len(ps))
+    for i, p := range ps {
+        results[i] = m.update(p)
+    }
+
+    return results, nil
+}
+
+func (m *memUserStore) SoftDeleteUser(ctx context.Context, userID string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u, ok := m.users[userID]
+    if !ok || u.deleted {
+        return fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+
+    u.deleted = true
+    u.deletedAt = time.Now().UTC()
+    m.users[userID] = u
+    return nil
+}
+
+func (m *memUserStore) RestoreUser(ctx context.Context, userID string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u, ok := m.users[userID]
+    if !ok {
+        return fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+    if !u.deleted {
+        return fmt.Errorf("user %s is not deleted. %w", userID, errConflict)
+    }
+
+    u.deleted = false
+    u.deletedAt = time.Time{}
+    u.version++
+    u.updatedAt = time.Now().UTC()
+    m.users[userID] = u
+    return nil
+}
+
+// update applies a patch. the caller must hold m.mu.
+func (m *memUserStore) update(p userPatch) error {
+    u, ok := m.users[p.ID]
+    if !ok || u.deleted {
+        return fmt.Errorf("user %s. %w", p.ID, errNotFound)
+    }
+
+    if u.version != p.Version {
+        return fmt.Errorf("user %s is not at version %d. %w", p.ID, p.Version, errConflict)
+    }
+
+    for col, val := range p.Fields {
+        switch col {
+        case "full_name":
+            u.req.FullName = val.(string)
+        case "address":
+            u.req.Address = val.(string)
+        case "city":
+            u.req.City = val.(string)
+        case "state":
+            u.req.State = val.(string)
+        case "zip_code":
+            u.req.ZipCode = val.(int)
+        case "phone":
+            u.req.Phone = val.(string)
+        }
+    }
+    u.version++
+    u.updatedAt = time.Now().UTC()
+    m.users[p.ID] = u
+
+    return nil
+}
+
+// matching returns copies of the users that pass f.
+func (m *memUserStore) matching(f userFilter) []userRecord {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    users := make([]userRecord, 0, len(m.users))
+    for id, u := range m.users {
+        if u.deleted && !f.IncludeDeleted {
+            continue
+        }
+        if f.City != "" && u.req.City != f.City {
+            continue
+        }
+        if len(f.States) > 0 && !containsString(f.States, u.req.State) {
+            continue
+        }
+        users = append(users, u.record(id))
+    }
+
+    return users
+}
+
+func (u memUser) record(id string) userRecord {
+    r := userRecord{
+        ID: id,
+        Version: u.version,
+        FullName: u.req.FullName,
+        Address: u.req.Address,
+        City: u.req.City,
+        State: u.req.State,
+        ZipCode: u.req.ZipCode,
+        Phone: u.req.Phone,
+        Email: u.req.Email,
+        CreatedAt: u.createdAt,
+        UpdatedAt: u.updatedAt,
+    }
+    if u.deleted {
+        deletedAt := u.deletedAt
+        r.DeletedAt = &deletedAt
+    }
+
+    return r
+}
+
+// sortRecords sorts by an ORDER BY clause built by parseSort, eg. "state ASC, zip_code DESC, id ASC".
+func sortRecords(users []userRecord, orderBy string) {
+    if orderBy == "" {
+        orderBy = "id ASC"
+    }
+    clauses := strings.Split(orderBy, ", ")
+
+    sort.SliceStable(users, func(i, j int) bool {
+        for _, clause := range clauses {
+            parts := strings.Fields(clause)
+            a, b := recordColumn(users[i], parts[0]), recordColumn(users[j], parts[0])
+            if a == b {
+                continue
+            }
+
+            if len(parts) > 1 && parts[1] == "DESC" {
+                return a > b
+            }
+            return a < b
+        }
+        return false
+    })
+}
+
+// recordColumn returns a column's value as a sortable string.
+// zip codes are zero padded so "09000" sorts before "10000" like the number would.
+func recordColumn(u userRecord, col string) string {
+    switch col {
+    case "full_name":
+        return u.FullName
+    case "city":
+        return u.City
+    case "state":
+        return u.State
+    case "zip_code":
+        return fmt.Sprintf("%05d", u.ZipCode)
+    }
+
+    // ids are numeric strings here, so they're padded for the same reason.
+    return fmt.Sprintf("%020s", u.ID)
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (m *memUserStore) InsertEvent(ctx context.Context, ev event) (string, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.insertEvent(ev)
+}
+
+// insertEvent must be called with mu held.
+func (m *memUserStore) insertEvent(ev event) (string, error) {
+    if err := m.failNextEvent; err != nil {
+        m.failNextEvent = nil
+        return "", err
+    }
+
+    ev.ID = strconv.Itoa(len(m.outbox) + 1)
+    m.outbox = append(m.outbox, memEvent{ev: ev})
+
+    return ev.ID, nil
+}
+
+func (m *memUserStore) PendingEvents(ctx context.Context, limit int) ([]event, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    pending := make([]event, 0, limit)
+    for _, e := range m.outbox {
+        if len(pending) == limit {
+            break
+        }
+        if !e.dispatched {
+            pending = append(pending, e.ev)
+        }
+    }
+
+    return pending, nil
+}
+
+func (m *memUserStore) MarkDispatched(ctx context.Context, eventID string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    i, err := strconv.Atoi(eventID)
+    if err != nil || i < 1 || i > len(m.outbox) {
+        return fmt.Errorf("event %s. %w", eventID, errNotFound)
+    }
+    m.outbox[i-1].dispatched = true
+
+    return nil
+}
@@ -0,0 +1,111 @@
+/*
+Validation messages by locale.
+
+Validation produces message KEYS, not sentences. The key is looked up in the caller's locale and falls
+back to english when the locale, or just that one key, hasn't been translated yet. So a partially
+translated catalog still works, it's just partly english.
+*/
+package examplePackage
+
+import (
+    "fmt"
+    "strings"
+)
+
+const defaultLocale = "en"
+
+// message keys.
+const (
+    msgFullNameRequired = "full_name.required"
+    msgAddressRequired = "address.required"
+    msgCityRequired = "city.required"
+    msgStateInvalid = "state.invalid"
+    msgZipRequired = "zip_code.required"
+    msgZipOutOfRange = "zip_code.out_of_range"
+    msgPhoneInvalid = "phone.invalid"
+    msgEmailInvalid = "email.invalid"
+    msgFullNameTooLong = "full_name.too_long"
+    msgAddressTooLong = "address.too_long"
+    msgCityTooLong = "city.too_long"
+    msgPasswordTooLong = "password.too_long"
+)
+
+// messages is the catalog. the english entries are the original messages and are the fallback for everything else.
+var messages = map[string]map[string]string{
+    "en": {
+        msgFullNameRequired: "full name is required",
+        msgAddressRequired: "address is required",
+        msgCityRequired: "city is required",
+        msgStateInvalid: "state is required and must be a two letter US state code",
+        msgZipRequired: "zip code is required",
+        msgZipOutOfRange: "zip_code out of range",
+        msgPhoneInvalid: "phone must be E.164 format",
+        msgEmailInvalid: "email is not a valid address",
+        msgFullNameTooLong: "full name must be at most %d characters",
+        msgAddressTooLong: "address must be at most %d characters",
+        msgCityTooLong: "city must be at most %d characters",
+        msgPasswordTooLong: "password must be at most %d bytes",
+    },
+    "es": {
+        msgFullNameRequired: "el nombre completo es obligatorio",
+        msgAddressRequired: "la dirección es obligatoria",
+        msgCityRequired: "la ciudad es obligatoria",
+        msgStateInvalid: "el estado es obligatorio y debe ser un código de estado de EE. UU. de dos letras",
+        msgZipRequired: "el código postal es obligatorio",
+        msgPhoneInvalid: "el teléfono debe estar en formato E.164",
+        msgEmailInvalid: "el correo electrónico no es válido",
+        msgFullNameTooLong: "el nombre completo debe tener como máximo %d caracteres",
+        msgAddressTooLong: "la dirección debe tener como máximo %d caracteres",
+        msgCityTooLong: "la ciudad debe tener como máximo %d caracteres",
+        msgPasswordTooLong: "la contraseña debe tener como máximo %d bytes",
+    },
+}
+
+// translate returns the message for key in locale, falling back to english, then to the key itself.
+// returning the key is the last resort so a missing translation is visible rather than an empty string.
+func translate(locale, key string) string {
+    if msg, ok := messages[locale][key]; ok {
+        return msg
+    }
+
+    if msg, ok := messages[defaultLocale][key]; ok {
+        return msg
+    }
+
+    return key
+}
+
+// formatMessage translates key and fills in its args, if it has any.
+func formatMessage(locale, key string, args []interface{}) string {
+    msg := translate(locale, key)
+    if len(args) == 0 {
+        return msg
+    }
+
+    return fmt.Sprintf(msg, args...)
+}
+
+// localize returns a copy of ve with every Message in locale.
+func (ve validationErrors) localize(locale string) validationErrors {
+    out := make(validationErrors, len(ve))
+    for i, fe := range ve {
+        fe.Message = formatMessage(locale, fe.Key, fe.Args)
+        out[i] = fe
+    }
+
+    return out
+}
+
+// parseLocale returns the primary language of the first entry in an Accept-Language header.
+// "es-MX,es;q=0.9,en;q=0.8" gives "es". the region is dropped because the catalog is by language.
+func parseLocale(acceptLanguage string) string {
+    first := strings.TrimSpace(strings.Split(acceptLanguage, ",")[0])
+    first = strings.Split(first, ";")[0]
+    lang := strings.ToLower(strings.Split(first, "-")[0])
+
+    if lang == "" || lang == "*" {
+        return defaultLocale
+    }
+
+    return lang
+}
@@ -0,0 +1,143 @@
+/*
+405 Method Not Allowed, with the Allow header.
+
+RFC 9110 says a 405 must say which methods the path does support, in Allow. vestigo's own 405 doesn't,
+and the api gateway's conformance tests flag it. MethodNotAllowedMiddleware answers those requests
+before vestigo sees them, with the methods taken from Routes(), so Allow is always what's actually
+registered:
+
+DELETE /v1/users/count
+405 Method Not Allowed
+Allow: GET, HEAD
+{"error": {"code": "METHOD_NOT_ALLOWED", "message": "DELETE is not allowed on /v1/users/count"}}
+
+A path no route matches is left to the router, so it's still a 404.
+*/
+package examplePackage
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// routePattern is one registered pattern and the methods registered for it.
+type routePattern struct {
+    segments []string
+    methods map[string]bool
+}
+
+// matches reports whether path's segments fit the pattern. a ":param" segment matches any one segment.
+func (p routePattern) matches(segments []string) bool {
+    if len(segments) != len(p.segments) {
+        return false
+    }
+    for i, s := range p.segments {
+        if strings.HasPrefix(s, ":") {
+            if segments[i] == "" {
+                return false
+            }
+            continue
+        }
+        if s != segments[i] {
+            return false
+        }
+    }
+
+    return true
+}
+
+// static is how many of the pattern's segments are literal. vestigo prefers a literal segment to a
+//   param, so the pattern with the most of them is the one a path is routed to.
+func (p routePattern) static() int {
+    n := 0
+    for _, s := range p.segments {
+        if !strings.HasPrefix(s, ":") {
+            n++
+        }
+    }
+
+    return n
+}
+
+func splitPath(path string) []string {
+    return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// newRoutePatterns groups routes by pattern. it's built once, in MethodNotAllowedMiddleware, not per request.
+func newRoutePatterns(routes []Route) []routePattern {
+    byPattern := map[string]*routePattern{}
+    order := []string{}
+    for _, r := range routes {
+        p, ok := byPattern[r.Pattern]
+        if !ok {
+            p = &routePattern{segments: splitPath(r.Pattern), methods: map[string]bool{}}
+            byPattern[r.Pattern] = p
+            order = append(order, r.Pattern)
+        }
+        p.methods[r.Method] = true
+        // vestigo answers HEAD with the GET handler, so it's allowed wherever GET is.
+        if r.Method == http.MethodGet {
+            p.methods[http.MethodHead] = true
+        }
+    }
+
+    patterns := make([]routePattern, 0, len(order))
+    for _, pattern := range order {
+        patterns = append(patterns, *byPattern[pattern])
+    }
+
+    return patterns
+}
+
+// allowedMethods is the methods registered for the pattern path is routed to. nil means no pattern matches.
+func allowedMethods(patterns []routePattern, path string) map[string]bool {
+    segments := splitPath(path)
+    var best *routePattern
+    for i := range patterns {
+        p := &patterns[i]
+        if p.matches(segments) && (best == nil || p.static() > best.static()) {
+            best = p
+        }
+    }
+    if best == nil {
+        return nil
+    }
+
+    return best.methods
+}
+
+// MethodNotAllowedMiddleware goes right around the router, so the path it sees is already canonical.
+// OPTIONS is always passed through. preflights are answered by the CORS middleware further out.
+func MethodNotAllowedMiddleware(routes []Route) func(http.Handler) http.Handler {
+    patterns := newRoutePatterns(routes)
+
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            methods := allowedMethods(patterns, req.URL.Path)
+            if methods == nil || methods[req.Method] || req.Method == http.MethodOptions {
+                next.ServeHTTP(rw, req)
+                return
+            }
+
+            allow := make([]string, 0, len(methods))
+            for m := range methods {
+                allow = append(allow, m)
+            }
+            // sorted, so the header is the same on every request.
+            sort.Strings(allow)
+            rw.Header().Set("Allow", strings.Join(allow, ", "))
+
+            getNegotiator(req).Respond(rw, http.StatusMethodNotAllowed, errorEnvelope{
+                Error: errorBody{
+                    Code: codeMethodNotAllowed,
+                    // the path is the client's, so it's sanitized the same as when it's logged.
+                    Message: req.Method + " is not allowed on " + ctxpkg.SanitizeLogValue(req.URL.Path),
+                    RequestID: ctxpkg.GetRequestID(req.Context()),
+                },
+            })
+        })
+    }
+}
@@ -0,0 +1,653 @@
+/*
+Middleware for the handlers in http_handler_example.go.
+
+Every middleware here has the signature func(http.Handler) http.Handler. That's the standard library's
+"shape" for middleware, so these compose with anything else in the Go ecosystem, not just vestigo.
+*/
+package examplePackage
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
+    "golang.org/x/time/rate"
+)
+
+// an incoming X-Request-ID longer than this is ignored and a new one is generated.
+const maxRequestIDLength = 128
+
+// how long a client can go without a request before its limiter is thrown away.
+// how often the map is swept for those idle limiters.
+const (
+    rateLimitIdleTTL = 10 * time.Minute
+    rateLimitSweepInterval = time.Minute
+)
+
+// ipLimiter pairs a token bucket with the last time it was used so idle entries can be evicted.
+type ipLimiter struct {
+    limiter *rate.Limiter
+    lastSeen time.Time
+}
+
+// ipRateLimiter holds one token bucket per client ip.
+// the map is guarded by a mutex because every request goroutine reads and writes it.
+// i use a plain sync.Mutex instead of sync.RWMutex because almost every access is a write (lastSeen).
+type ipRateLimiter struct {
+    mu sync.Mutex
+    limiters map[string]*ipLimiter
+    rps rate.Limit
+    burst int
+}
+
+func newIPRateLimiter(rps float64, burst int) *ipRateLimiter {
+    return &ipRateLimiter{
+        limiters: make(map[string]*ipLimiter),
+        rps: rate.Limit(rps),
+        burst: burst,
+    }
+}
+
+// get returns the limiter for ip, creating it on first use.
+func (rl *ipRateLimiter) get(ip string) *rate.Limiter {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+
+    l, ok := rl.limiters[ip]
+    if !ok {
+        l = &ipLimiter{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+        rl.limiters[ip] = l
+    }
+    l.lastSeen = time.Now()
+
+    return l.limiter
+}
+
+// evict removes limiters that haven't been used within the ttl.
+// without this, every ip that ever hit the service would live in memory forever.
+func (rl *ipRateLimiter) evict(ttl time.Duration) {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+
+    for ip, l := range rl.limiters {
+        if time.Since(l.lastSeen) > ttl {
+            delete(rl.limiters, ip)
+        }
+    }
+}
+
+// sweep evicts idle limiters every rateLimitSweepInterval until ctx is done.
+func (rl *ipRateLimiter) sweep(ctx context.Context) {
+    ticker := time.NewTicker(rateLimitSweepInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            rl.evict(rateLimitIdleTTL)
+        }
+    }
+}
+
+// clientIP prefers the ip the main context middleware already resolved (which may have come from
+//   a trusted proxy header) and falls back to the connection's address.
+func clientIP(req *http.Request) string {
+    if ip := ctxpkg.GetIPAddress(req.Context()); ip != "" {
+        return ip
+    }
+
+    // RemoteAddr is "host:port". if it can't be split, use it as is rather than failing the request.
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+
+    return host
+}
+
+// how long a request waits for a ConcurrencyLimit slot before it's turned away. long enough to ride out
+//   a blip, short enough that a client isn't left hanging when the route really is saturated.
+const concurrencyAcquireTimeout = 100 * time.Millisecond
+
+// ConcurrencyLimit lets at most n requests through at once. the rest wait up to
+//   concurrencyAcquireTimeout for a slot and then get a 503 with Retry-After.
+// rate limiting caps how often one client can call. this caps how much work is running at once from
+//   every client together, which is what the database and settings service actually feel.
+// the slots are a buffered channel used as a semaphore: sending takes a slot and receiving gives it back.
+// every call makes its own semaphore, so each route needs its own ConcurrencyLimit. see Route.MaxConcurrent.
+func ConcurrencyLimit(n int) func(http.Handler) http.Handler {
+    slots := make(chan struct{}, n)
+
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            timer := time.NewTimer(concurrencyAcquireTimeout)
+            defer timer.Stop()
+
+            select {
+            case slots <- struct{}{}:
+            case <-timer.C:
+                // a slot frees up as soon as any request finishes, so 1 second is the shortest honest answer.
+                rw.Header().Set("Retry-After", "1")
+                getNegotiator(req).Respond(rw, http.StatusServiceUnavailable, response.Error(nil))
+                return
+            case <-req.Context().Done():
+                // the client gave up (or the request timed out) while waiting. nobody to respond to.
+                return
+            }
+            defer func() { <-slots }()
+
+            next.ServeHTTP(rw, req)
+        })
+    }
+}
+
+// rateLimitStatus is what a client needs to throttle itself.
+// Reset is how many seconds until the bucket is full again.
+type rateLimitStatus struct {
+    Limit int `json:"limit"`
+    Remaining int `json:"remaining"`
+    Reset int `json:"reset"`
+}
+
+// status reads the bucket for ip without taking a token.
+// an ip with no limiter yet has a full bucket, and no limiter is created just to report that.
+func (rl *ipRateLimiter) status(ip string) rateLimitStatus {
+    rl.mu.Lock()
+    l, ok := rl.limiters[ip]
+    rl.mu.Unlock()
+
+    rs := rateLimitStatus{Limit: rl.burst, Remaining: rl.burst}
+    if !ok {
+        return rs
+    }
+
+    // Tokens can be fractional (a token is refilling) or negative (reservations outstanding).
+    // only whole tokens can be spent, so round down and never report below zero.
+    tokens := l.limiter.Tokens()
+    rs.Remaining = int(math.Max(0, math.Floor(tokens)))
+
+    // time to refill the missing tokens at rps tokens per second.
+    if missing := float64(rl.burst) - tokens; missing > 0 && rl.rps > 0 {
+        rs.Reset = int(math.Ceil(missing / float64(rl.rps)))
+    }
+
+    return rs
+}
+
+// setHeaders writes the X-RateLimit-* headers so every response tells the client where it stands.
+func (rs rateLimitStatus) setHeaders(h http.Header) {
+    h.Set("X-RateLimit-Limit", strconv.Itoa(rs.Limit))
+    h.Set("X-RateLimit-Remaining", strconv.Itoa(rs.Remaining))
+    h.Set("X-RateLimit-Reset", strconv.Itoa(rs.Reset))
+}
+
+// middleware limits each client ip to rps requests per second with bursts up to burst.
+// over-limit requests get a 429 with a Retry-After header telling the client when to try again.
+func (rl *ipRateLimiter) middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        ip := clientIP(req)
+
+        // Reserve (instead of Allow) tells me how long the client would have to wait,
+        //   which is exactly what Retry-After needs.
+        r := rl.get(ip).Reserve()
+        if !r.OK() {
+            // burst is 0, so this client can never be served.
+            rw.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+
+        if delay := r.Delay(); delay > 0 {
+            // give the token back. we aren't going to wait for it.
+            r.Cancel()
+
+            rl.status(ip).setHeaders(rw.Header())
+            // Retry-After is in whole seconds. round up so the client doesn't retry too early.
+            rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+            rw.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+
+        // the headers reflect the token this request just used.
+        rl.status(ip).setHeaders(rw.Header())
+        next.ServeHTTP(rw, req)
+    })
+}
+
+// StatusHandler serves the caller's current rate limit status. it doesn't use up a token.
+// GET /v1/ratelimit
+func (rl *ipRateLimiter) StatusHandler(rw http.ResponseWriter, req *http.Request) {
+    rs := rl.status(clientIP(req))
+    rs.setHeaders(rw.Header())
+
+    getNegotiator(req).Respond(rw, http.StatusOK, response.Success(rs))
+}
+
+// CORSMiddleware allows cross-origin requests from allowedOrigins using allowedMethods.
+// use newCORSMiddleware directly when the origins need to change at runtime.
+func CORSMiddleware(allowedOrigins []string, allowedMethods []string) func(http.Handler) http.Handler {
+    return newCORSMiddleware(func() []string { return allowedOrigins }, allowedMethods)
+}
+
+// newCORSMiddleware calls origins on every request so the allowed list can come from settings.
+//
+// if origins contains "*", any origin is allowed, but the browser won't send cookies or auth headers.
+// otherwise the request's Origin must match exactly, and because we know exactly who is calling,
+//   credentialed requests are allowed.
+func newCORSMiddleware(origins func() []string, allowedMethods []string) func(http.Handler) http.Handler {
+    methods := strings.Join(allowedMethods, ", ")
+
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            origin := req.Header.Get("Origin")
+
+            // not a cross-origin request. nothing to do.
+            if origin == "" {
+                next.ServeHTTP(rw, req)
+                return
+            }
+
+            // the response now depends on the Origin header, so caches must key on it.
+            rw.Header().Add("Vary", "Origin")
+
+            allowOrigin, credentials := matchOrigin(origin, origins())
+            if allowOrigin != "" {
+                rw.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+                if credentials {
+                    rw.Header().Set("Access-Control-Allow-Credentials", "true")
+                }
+            }
+
+            // a preflight is an OPTIONS request with Access-Control-Request-Method.
+            // any other OPTIONS request is left for vestigo to route.
+            if req.Method != http.MethodOptions || req.Header.Get("Access-Control-Request-Method") == "" {
+                next.ServeHTTP(rw, req)
+                return
+            }
+
+            if allowOrigin != "" {
+                rw.Header().Set("Access-Control-Allow-Methods", methods)
+                if h := req.Header.Get("Access-Control-Request-Headers"); h != "" {
+                    rw.Header().Set("Access-Control-Allow-Headers", h)
+                }
+            }
+
+            // a disallowed origin still gets a 204. the missing Allow-Origin header is what makes
+            //   the browser block the real request.
+            rw.WriteHeader(http.StatusNoContent)
+        })
+    }
+}
+
+// matchOrigin returns the value for Access-Control-Allow-Origin and whether credentials are allowed.
+// an empty string means the origin isn't allowed.
+// an exact match wins over "*" so a listed origin keeps its credentials even when "*" is also configured.
+func matchOrigin(origin string, allowed []string) (string, bool) {
+    wildcard := false
+    for _, o := range allowed {
+        if o == origin {
+            return origin, true
+        }
+
+        if o == "*" {
+            wildcard = true
+        }
+    }
+
+    if wildcard {
+        return "*", false
+    }
+
+    return "", false
+}
+
+// defaultRequestTimeout is the whole budget for a request: settings, the database, everything.
+const defaultRequestTimeout = 10 * time.Second
+
+const (
+    // requestTimeoutHeader lets a trusted caller ask for a different budget, in whole seconds.
+    requestTimeoutHeader = "X-Request-Timeout"
+    // maxRequestTimeout caps what requestTimeoutHeader can ask for.
+    maxRequestTimeout = 60 * time.Second
+    // internalScope is held by our own services, eg. batch jobs. only they can use requestTimeoutHeader.
+    internalScope = "users:internal"
+)
+
+// RequestTimeout gives every request a deadline d from now. settings and db calls take the request's
+//   context, so they all share the one budget instead of each having their own timeout.
+//
+// running out of budget is a 504, not a 500. the handlers turn a failed db call into a 500 without
+//   knowing why it failed, so timeoutWriter rewrites a 500 to a 504 when the deadline is what expired.
+//
+// a caller with internalScope can change d for its own request with requestTimeoutHeader. see requestTimeout.
+func RequestTimeout(d time.Duration) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            ctx, cancel := context.WithTimeout(req.Context(), requestTimeout(req, d))
+            // always release the timer, even when the handler finishes early.
+            defer cancel()
+
+            tw := &timeoutWriter{ResponseWriter: rw, ctx: ctx}
+            req = req.WithContext(ctx)
+            next.ServeHTTP(tw, req)
+
+            // the handler gave up without responding at all.
+            if !tw.wroteHeader && errs.Is(ctx.Err(), context.DeadlineExceeded) {
+                getNegotiator(req).Respond(rw, http.StatusGatewayTimeout, response.Error(nil))
+            }
+        })
+    }
+}
+
+// requestTimeout is the budget the caller asked for with requestTimeoutHeader, capped at
+//   maxRequestTimeout, or def.
+// the header is ignored (not rejected) from a caller without internalScope, and when it isn't a
+//   positive whole number. either way the request still runs, just with the default budget.
+// the scope is read from the claims AuthMiddleware put in the context before routing. RequireScope on
+//   the route would come too late, since RequestTimeout wraps it.
+func requestTimeout(req *http.Request, def time.Duration) time.Duration {
+    raw := strings.TrimSpace(req.Header.Get(requestTimeoutHeader))
+    if raw == "" {
+        return def
+    }
+
+    ctx := req.Context()
+    lf := ctxpkg.LogFields(ctx)
+    lf["requested_timeout"] = ctxpkg.SanitizeLogValue(raw)
+
+    if !ctxpkg.HasScope(ctx, internalScope) {
+        ctxpkg.Logger(ctx).WithFields(lf).Debug("ignored " + requestTimeoutHeader + " from an untrusted caller")
+        return def
+    }
+
+    secs, err := strconv.Atoi(raw)
+    if err != nil || secs <= 0 {
+        ctxpkg.Logger(ctx).WithFields(lf).Debug("ignored an invalid " + requestTimeoutHeader)
+        return def
+    }
+
+    // compared in seconds, so a huge value can't overflow the multiplication into a negative duration.
+    if secs > int(maxRequestTimeout/time.Second) {
+        return maxRequestTimeout
+    }
+
+    return time.Duration(secs) * time.Second
+}
+
+// timeoutWriter turns a 500 into a 504 when the request's deadline has passed.
+type timeoutWriter struct {
+    http.ResponseWriter
+    ctx context.Context
+    wroteHeader bool
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+    tw.wroteHeader = true
+    if status == http.StatusInternalServerError && errs.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+        status = http.StatusGatewayTimeout
+    }
+    tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+    if !tw.wroteHeader {
+        tw.WriteHeader(http.StatusOK)
+    }
+    return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+    if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+// Chain composes middlewares into one. the first is the outermost: it sees the request first and the
+//   response last. Chain(a, b)(h) is the same as a(b(h)).
+// by convention, list them from the most general to the most specific, the way main does:
+// MainContextMiddleware first, so everything inside has the request id, then RequestLogMiddleware, so
+//   rejected requests are still logged, then AuthMiddleware and RequireScope, so nothing after them runs
+//   for a caller who isn't allowed.
+func Chain(middlewares ...func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+    return func(h http.Handler) http.Handler {
+        // wrap from the inside out so middlewares[0] ends up outermost.
+        for i := len(middlewares) - 1; i >= 0; i-- {
+            h = middlewares[i](h)
+        }
+        return h
+    }
+}
+
+// statusRecorder remembers the status code a handler wrote so middleware can see it afterwards.
+// embedding http.ResponseWriter means only WriteHeader has to be overridden.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func newStatusRecorder(rw http.ResponseWriter) *statusRecorder {
+    // a handler that never calls WriteHeader gets a 200 from net/http.
+    return &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+    sr.status = status
+    sr.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through to the real writer, otherwise wrapping would hide http.Flusher from streaming
+//   handlers (eg. the ndjson user list).
+func (sr *statusRecorder) Flush() {
+    if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+// TracingMiddleware starts a span for every request to route.
+//
+// route is the vestigo pattern (eg. "/v1/user/:user_id"), not the request's path. naming spans after
+//   the path would create a new span name for every user id, which tracing backends handle badly.
+// tp is passed in (instead of using the global otel provider) so tests can use an in-memory provider.
+//
+// an incoming traceparent header continues the caller's trace instead of starting a new one.
+// the span is stored in the request's context, so anything downstream (eg. the store) can start child
+//   spans with trace.SpanFromContext(ctx).TracerProvider().
+func TracingMiddleware(tp trace.TracerProvider, route string) func(http.Handler) http.Handler {
+    tracer := tp.Tracer("examplePackage")
+    propagator := propagation.TraceContext{}
+
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+            ctx, span := tracer.Start(ctx, req.Method+" "+route,
+                trace.WithSpanKind(trace.SpanKindServer),
+                trace.WithAttributes(
+                    attribute.String("http.method", req.Method),
+                    attribute.String("http.route", route),
+                ),
+            )
+            defer span.End()
+
+            // the trace id goes in mainContext too so it ends up in the logs next to the request id.
+            ctx = ctxpkg.SetTraceID(ctx, span.SpanContext().TraceID().String())
+
+            sr := newStatusRecorder(rw)
+            next.ServeHTTP(sr, req.WithContext(ctx))
+
+            span.SetAttributes(attribute.Int("http.status_code", sr.status))
+            if sr.status >= http.StatusInternalServerError {
+                span.SetStatus(codes.Error, http.StatusText(sr.status))
+            }
+        })
+    }
+}
+
+// MainContextMiddleware populates the request's mainContext (context_package_example.go) so every
+//   handler and middleware after it can use ctxpkg.GetRequestID, ctxpkg.GetIPAddress, etc.
+//
+// an X-Request-ID from the client (or a proxy in front of us) is reused so their logs and ours share
+//   an id. the chosen id is always echoed back in the X-Request-ID response header.
+// only the fields BuildMainContext fills are set. anything already in the context, eg. claims from a
+//   middleware that ran first, is kept.
+func MainContextMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        data := BuildMainContext(req)
+        // one context.WithValue for every field BuildMainContext fills. see context_package_example.go.
+        ctx := ctxpkg.WithValues(req.Context(), func(d *ctxpkg.MainContext) {
+            d.RequestID = data.RequestID
+            d.IPAddress = data.IPAddress
+            d.Locale = data.Locale
+            d.TraceID = data.TraceID
+        })
+
+        // set before next runs. headers written after the handler calls WriteHeader are ignored.
+        rw.Header().Set("X-Request-ID", data.RequestID)
+
+        next.ServeHTTP(rw, req.WithContext(ctx))
+    })
+}
+
+// BuildMainContext works out every field of mainContext that comes straight from the request: the
+//   request id, the client's ip, its locale and, when the caller sent a traceparent, the trace id.
+// it only reads req, so the result doesn't depend on which middleware ran first. the fields that
+//   depend on other things (claims from auth, the sampling decision, the span TracingMiddleware
+//   starts) are still set by the middleware that knows them.
+func BuildMainContext(req *http.Request) ctxpkg.MainContext {
+    data := ctxpkg.MainContext{
+        RequestID: req.Header.Get("X-Request-ID"),
+        IPAddress: clientIP(req),
+        Locale: parseLocale(req.Header.Get("Accept-Language")),
+    }
+    if !validRequestID(data.RequestID) {
+        data.RequestID = newRequestID()
+    }
+
+    // the caller's trace id is known before routing, so even a request that's never routed (eg. a 404)
+    //   logs it. TracingMiddleware sets it again once its span has started.
+    incoming := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(req.Header))
+    if sc := trace.SpanContextFromContext(incoming); sc.IsValid() {
+        data.TraceID = sc.TraceID().String()
+    }
+
+    return data
+}
+
+// validRequestID only accepts ids that are safe to put in logs and headers.
+// anything else (too long, newlines, spaces, etc.) is replaced rather than trusted.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+
+    for _, r := range id {
+        isAlnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+        if !isAlnum && r != '-' && r != '_' && r != '.' && r != ':' {
+            return false
+        }
+    }
+
+    return true
+}
+
+// newRequestID returns 16 random bytes as hex.
+func newRequestID() string {
+    b := make([]byte, 16)
+    // crypto/rand.Read only fails if the os can't provide randomness, and then nothing else will work either.
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+
+    return hex.EncodeToString(b)
+}
+
+// RequireAPIKey rejects requests whose X-API-Key header doesn't match the api key in settings.
+// the key is read from settings on every request, so a rotated key takes effect on the next reload.
+func (c *Controller) RequireAPIKey(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        want := c.currentSettings().apiKey()
+        got := req.Header.Get("X-API-Key")
+
+        // ConstantTimeCompare takes the same time no matter where the strings differ, so an attacker
+        //   can't guess the key one character at a time by measuring response times.
+        if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+            c.negotiator(req).Respond(rw, http.StatusUnauthorized, response.Error(nil))
+            return
+        }
+
+        next.ServeHTTP(rw, req)
+    })
+}
+
+// RequestLogMiddleware writes ONE log line per request when it finishes, with the status, the total
+//   duration, and how long each recorded phase took (ctxpkg.Timer).
+// one line that explains where the time went is often all you need, without a tracing backend.
+func RequestLogMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        start := time.Now()
+        ctx := ctxpkg.StartTimings(req.Context())
+
+        sr := newStatusRecorder(rw)
+        next.ServeHTTP(sr, req.WithContext(ctx))
+
+        lf := ctxpkg.LogFields(ctx)
+        // everything from the request line and headers is the client's, so it's sanitized for the log.
+        lf["method"] = ctxpkg.SanitizeLogValue(req.Method)
+        lf["path"] = ctxpkg.SanitizeLogValue(req.URL.Path)
+        lf["status"] = sr.status
+        lf["duration_ms"] = time.Since(start).Milliseconds()
+        for phase, d := range ctxpkg.GetTimings(ctx) {
+            lf[phase+"_ms"] = d.Milliseconds()
+        }
+
+        // the details are only worth their volume for sampled requests and for every server error.
+        if ctxpkg.IsSampled(ctx) || sr.status >= http.StatusInternalServerError {
+            lf["query"] = ctxpkg.SanitizeLogValue(req.URL.RawQuery)
+            lf["user_agent"] = ctxpkg.SanitizeLogValue(req.UserAgent())
+            lf["referer"] = ctxpkg.SanitizeLogValue(req.Referer())
+            lf["content_length"] = req.ContentLength
+        }
+
+        ctxpkg.Logger(ctx).WithFields(lf).Info("request finished")
+    })
+}
+
+// RequireScope only lets callers whose claims include scope through.
+//
+// the two failures are different statuses on purpose:
+// 401 means we don't know who you are (no claims at all). authenticating might fix it.
+// 403 means we know who you are and you aren't allowed. authenticating again won't help.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            ctx := req.Context()
+
+            if ctxpkg.GetClaims(ctx).Subject == "" {
+                writeErrorEnvelope(rw, req, http.StatusUnauthorized, codeUnauthorized, "authentication required")
+                return
+            }
+
+            if !ctxpkg.HasScope(ctx, scope) {
+                writeErrorEnvelope(rw, req, http.StatusForbidden, codeForbidden, "missing scope "+scope)
+                return
+            }
+
+            next.ServeHTTP(rw, req)
+        })
+    }
+}
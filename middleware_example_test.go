@@ -0,0 +1,240 @@
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+func TestRequestTimeout(t *testing.T) {
+    const def = 10 * time.Second
+    internal := []string{internalScope}
+
+    tests := []struct {
+        name string
+        header string
+        scopes []string
+        want time.Duration
+    }{
+        {"no header", "", internal, def},
+        {"internal caller", "30", internal, 30 * time.Second},
+        {"clamped to the max", "600", internal, maxRequestTimeout},
+        {"huge value can't overflow", "9223372036854775807", internal, maxRequestTimeout},
+        {"exactly the max", "60", internal, maxRequestTimeout},
+        {"zero falls back", "0", internal, def},
+        {"negative falls back", "-5", internal, def},
+        {"not a number falls back", "5s", internal, def},
+        {"untrusted caller falls back", "30", []string{"users:read"}, def},
+        {"anonymous caller falls back", "30", nil, def},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+            if tt.header != "" {
+                req.Header.Set(requestTimeoutHeader, tt.header)
+            }
+            if tt.scopes != nil {
+                ctx := ctxpkg.SetClaims(req.Context(), ctxpkg.Claims{Subject: "svc", Scopes: tt.scopes})
+                req = req.WithContext(ctx)
+            }
+
+            if got := requestTimeout(req, def); got != tt.want {
+                t.Errorf("requestTimeout() = %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
+
+// the override only works if the claims are in place before routing, which is AuthMiddleware's job.
+func TestRequestTimeoutThroughAuthMiddleware(t *testing.T) {
+    exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+    token := signTestToken(testSigningKey, `{"alg":"HS256"}`, `{"sub":"svc","scope":"`+internalScope+`","exp":`+exp+`}`)
+
+    var got time.Duration
+    h := AuthMiddleware(newHS256Verifier(testSigningKey))(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        got = requestTimeout(req, time.Second)
+    }))
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set(requestTimeoutHeader, "20")
+    h.ServeHTTP(httptest.NewRecorder(), req)
+
+    if got != 20*time.Second {
+        t.Errorf("requestTimeout() = %s, want 20s", got)
+    }
+}
+
+// ctxWithScope is ctx with an authenticated caller that has scope. an empty scope means no claims at all.
+func ctxWithScope(ctx context.Context, scope string) context.Context {
+    if scope == "" {
+        return ctx
+    }
+
+    return ctxpkg.SetClaims(ctx, ctxpkg.Claims{Subject: "u_test", Scopes: []string{scope}})
+}
+
+// Chain(a, b)(h) has to be a(b(h)): a sees the request first and the response last.
+func TestChain(t *testing.T) {
+    order := []string{}
+    mark := func(name string) func(http.Handler) http.Handler {
+        return func(next http.Handler) http.Handler {
+            return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+                order = append(order, name+" in")
+                next.ServeHTTP(rw, req)
+                order = append(order, name+" out")
+            })
+        }
+    }
+    h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        order = append(order, "handler")
+    })
+
+    Chain(mark("a"), mark("b"), mark("c"))(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+    want := "a in, b in, c in, handler, c out, b out, a out"
+    if got := strings.Join(order, ", "); got != want {
+        t.Errorf("order = %s, want %s", got, want)
+    }
+}
+
+// a middleware that answers by itself stops everything inside it from running.
+func TestChainShortCircuits(t *testing.T) {
+    reject := func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            rw.WriteHeader(http.StatusForbidden)
+        })
+    }
+    ran := false
+    inner := func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+            ran = true
+            next.ServeHTTP(rw, req)
+        })
+    }
+
+    rw := httptest.NewRecorder()
+    Chain(reject, inner)(http.NotFoundHandler()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+    if rw.Code != http.StatusForbidden || ran {
+        t.Errorf("status = %d and inner ran = %v, want %d and false", rw.Code, ran, http.StatusForbidden)
+    }
+}
+
+func TestChainEmpty(t *testing.T) {
+    rw := httptest.NewRecorder()
+    Chain()(http.NotFoundHandler()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+    if rw.Code != http.StatusNotFound {
+        t.Errorf("status = %d, want the handler's %d", rw.Code, http.StatusNotFound)
+    }
+}
+
+// MainContextMiddleware adds its fields to what's already in the context instead of replacing it.
+func TestMainContextMiddlewareKeepsValues(t *testing.T) {
+    var got ctxpkg.MainContext
+    h := MainContextMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        got = ctxpkg.GetMainContext(req.Context())
+    }))
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+    req.Header.Set("X-Request-ID", "req-1")
+    ctx := ctxpkg.WithValues(ctxWithScope(req.Context(), internalScope), func(d *ctxpkg.MainContext) { d.UserID = "u_1" })
+    req = req.WithContext(ctx)
+    h.ServeHTTP(httptest.NewRecorder(), req)
+
+    if got.RequestID != "req-1" {
+        t.Errorf("RequestID = %q, want %q", got.RequestID, "req-1")
+    }
+    if got.UserID != "u_1" || len(got.Claims.Scopes) == 0 {
+        t.Errorf("UserID %q and claims %+v, want the ones set before the middleware", got.UserID, got.Claims)
+    }
+}
+
+// every response says where the client stands. the one that's over the limit also says when to retry.
+func TestRateLimitHeaders(t *testing.T) {
+    rl := newIPRateLimiter(1, 2)
+    h := rl.middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+    tests := []struct {
+        wantStatus int
+        wantRemaining string
+        wantRetryAfter string
+    }{
+        {http.StatusOK, "1", ""},
+        {http.StatusOK, "0", ""},
+        {http.StatusTooManyRequests, "0", "1"},
+    }
+
+    for i, tt := range tests {
+        req := httptest.NewRequest(http.MethodPost, "/v1/user", nil)
+        req.RemoteAddr = "203.0.113.7:1234"
+        rw := httptest.NewRecorder()
+        h.ServeHTTP(rw, req)
+
+        got := rw.Header()
+        if rw.Code != tt.wantStatus {
+            t.Errorf("request %d status = %d, want %d", i, rw.Code, tt.wantStatus)
+        }
+        if got.Get("X-RateLimit-Limit") != "2" || got.Get("X-RateLimit-Remaining") != tt.wantRemaining || got.Get("X-RateLimit-Reset") == "" {
+            t.Errorf("request %d X-RateLimit-* = %s/%s/%s, want 2/%s/a reset", i,
+                got.Get("X-RateLimit-Limit"), got.Get("X-RateLimit-Remaining"), got.Get("X-RateLimit-Reset"), tt.wantRemaining)
+        }
+        if got.Get("Retry-After") != tt.wantRetryAfter {
+            t.Errorf("request %d Retry-After = %q, want %q", i, got.Get("Retry-After"), tt.wantRetryAfter)
+        }
+    }
+}
+
+// the phases timed anywhere inside the handler end up on the one "request finished" line.
+func TestRequestLogPhaseTimings(t *testing.T) {
+    lc := captureLogs(t)
+    h := RequestLogMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        stop := ctxpkg.Timer(req.Context(), "db")
+        time.Sleep(5 * time.Millisecond)
+        stop()
+        ctxpkg.Timer(req.Context(), "validation")()
+    }))
+
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+
+    var finished map[string]interface{}
+    for _, e := range lc.entries {
+        if e.Message == "request finished" {
+            finished = e.Data
+        }
+    }
+    if finished == nil {
+        t.Fatal("no request finished line")
+    }
+    if ms, ok := finished["db_ms"].(int64); !ok || ms < 5 {
+        t.Errorf("db_ms = %v, want at least 5", finished["db_ms"])
+    }
+    if _, ok := finished["validation_ms"]; !ok {
+        t.Errorf("fields = %v, want validation_ms", finished)
+    }
+}
+
+// a field that isn't known is left out, not logged as "", so every line only has what was set.
+func TestLogFieldsOmitsEmpty(t *testing.T) {
+    ctx := ctxpkg.WithValues(context.Background(), func(d *ctxpkg.MainContext) {
+        d.RequestID = "req-1"
+        d.UserID = ""
+    })
+
+    lf := ctxpkg.LogFields(ctx)
+    if len(lf) != 1 || lf["request_id"] != "req-1" {
+        t.Errorf("LogFields() = %v, want only request_id", lf)
+    }
+
+    if lf := ctxpkg.LogFields(context.Background()); len(lf) != 0 {
+        t.Errorf("LogFields() of an empty context = %v, want nothing", lf)
+    }
+}
@@ -0,0 +1,578 @@
+/*
+The negotiate package from our private repo picks a response format for a request and writes the body.
+Features that change HOW a response is written (format, indentation, compression) live in this
+local negotiator so they're in one place rather than repeated in every handler.
+
+Handlers use it exactly like the private package, through the Controller so tests can replace it:
+
+n := c.negotiator(req)
+n.Respond(rw, http.StatusOK, response.Success(data))
+*/
+package examplePackage
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+    "github.com/sirupsen/logrus"
+)
+
+const (
+    mediaTypeJSON = "application/json"
+    mediaTypeXML = "application/xml"
+    mediaTypeNDJSON = "application/x-ndjson"
+)
+
+// errNotAcceptable means the client's Accept header rules out every format we have.
+var errNotAcceptable = errs.New("not acceptable")
+
+// responses smaller than this aren't worth compressing. the gzip header and cpu cost outweigh the savings.
+const gzipThreshold = 1024
+
+// Negotiator writes response bodies. handlers depend on this instead of the concrete negotiator so
+//   a test can swap in one that records the status and body (see Controller.newNegotiator).
+type Negotiator interface {
+    Respond(rw http.ResponseWriter, status int, body interface{})
+    // MediaType is the negotiated response media type, for handlers that write the body themselves.
+    MediaType() string
+}
+
+// negotiator holds the decisions made from the request so Respond doesn't have to look at the request again.
+type negotiator struct {
+    // ctx is only used to time serialization. the negotiator lives exactly as long as the request,
+    //   so holding the request's context here is safe.
+    ctx context.Context
+    mediaType string
+    pretty bool
+    gzip bool
+}
+
+// formatMediaTypes maps ?format= values to media types.
+var formatMediaTypes = map[string]string{
+    "json": mediaTypeJSON,
+    "xml": mediaTypeXML,
+}
+
+// getNegotiator reads everything Respond needs from the request up front.
+// a conflicting or unknown ?format= has already been rejected by NegotiationMiddleware, so the
+//   error from negotiateMediaType is ignored here and json is used.
+func getNegotiator(req *http.Request) negotiator {
+    mediaType, _ := negotiateMediaType(req)
+
+    return negotiator{
+        ctx: req.Context(),
+        mediaType: mediaType,
+        // ?pretty=true is for humans hitting the api by hand. compact is the default because
+        //   indentation is wasted bytes for every other client.
+        pretty: req.URL.Query().Get("pretty") == "true",
+        gzip: acceptsGzip(req.Header.Get("Accept-Encoding")),
+    }
+}
+
+// negotiator returns the Negotiator for req from c.newNegotiator, or getNegotiator when it isn't set.
+func (c *Controller) negotiator(req *http.Request) Negotiator {
+    if c.newNegotiator != nil {
+        return c.newNegotiator(req)
+    }
+
+    return getNegotiator(req)
+}
+
+func (n negotiator) MediaType() string {
+    return n.mediaType
+}
+
+// negotiateMediaType picks the response media type from ?format= and the Accept header.
+//
+// precedence: ?format= wins over Accept, because it's easier to set (eg. from a browser's address bar).
+// it's only an error when the two genuinely disagree. Accept must list specific types and none of
+//   them can be the format's type. a missing Accept, */*, or application/* never conflicts.
+func negotiateMediaType(req *http.Request) (string, error) {
+    accept := req.Header.Get("Accept")
+
+    format := req.URL.Query().Get("format")
+    if format == "" {
+        return responseMediaType(accept)
+    }
+
+    mt, ok := formatMediaTypes[format]
+    if !ok {
+        return mediaTypeJSON, fmt.Errorf("unsupported format %q. %w", format, errBadRequest)
+    }
+
+    if accept == "" {
+        return mt, nil
+    }
+
+    for _, e := range parseAccept(accept) {
+        if e.mediaType == "*/*" || e.mediaType == mt || e.mediaType == strings.Split(mt, "/")[0]+"/*" {
+            return mt, nil
+        }
+    }
+
+    return mediaTypeJSON, fmt.Errorf("format=%s conflicts with Accept: %s. %w", format, accept, errBadRequest)
+}
+
+// NegotiationMiddleware rejects requests whose response format can't be settled:
+// 406 when Accept only lists types we can't produce, and 400 when ?format= and Accept ask for
+//   different things. guessing would hand the client a format it can't read.
+func NegotiationMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        if _, err := negotiateMediaType(req); err != nil {
+            // respond in json. the client's format preference is exactly what's in question.
+            n := negotiator{ctx: req.Context(), mediaType: mediaTypeJSON}
+
+            if errs.Is(err, errNotAcceptable) {
+                n.Respond(rw, http.StatusNotAcceptable, response.Error(err))
+            } else {
+                n.Respond(rw, http.StatusBadRequest, response.Error(err))
+            }
+            return
+        }
+
+        next.ServeHTTP(rw, req)
+    })
+}
+
+// acceptEntry is one media range from an Accept header with its quality (q) value.
+type acceptEntry struct {
+    mediaType string
+    q float64
+}
+
+// parseAccept splits an Accept header into entries, highest q first.
+// entries with the same q keep the order the client sent them in.
+// q=0 means "not acceptable", so those entries are dropped.
+func parseAccept(accept string) []acceptEntry {
+    entries := make([]acceptEntry, 0, strings.Count(accept, ",")+1)
+    for _, part := range strings.Split(accept, ",") {
+        params := strings.Split(part, ";")
+        mt := strings.ToLower(strings.TrimSpace(params[0]))
+        if mt == "" {
+            continue
+        }
+
+        if q := qValue(params[1:]); q > 0 {
+            entries = append(entries, acceptEntry{mediaType: mt, q: q})
+        }
+    }
+
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].q > entries[j].q
+    })
+
+    return entries
+}
+
+// qValue is the q in one Accept or Accept-Encoding entry's params, eg. ["charset=utf-8", " q=0.5"].
+// a missing or malformed q is 1, the rfc's default. any spelling of zero (0, 0.0, 0.000) is 0.
+func qValue(params []string) float64 {
+    q := 1.0
+    for _, p := range params {
+        kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+        if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "q") {
+            if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+                q = v
+            }
+        }
+    }
+
+    return q
+}
+
+// responseMediaType picks the response format from an Accept header.
+// the highest priority media type with a registered serializer wins (serializer_example.go).
+// a missing Accept or */* gets json. errNotAcceptable means the client listed specific types and
+//   we can serve none of them.
+func responseMediaType(accept string) (string, error) {
+    if strings.TrimSpace(accept) == "" {
+        return mediaTypeJSON, nil
+    }
+
+    for _, e := range parseAccept(accept) {
+        if e.mediaType == "*/*" {
+            return mediaTypeJSON, nil
+        }
+
+        // a range like application/* matches any registered type with that prefix.
+        if strings.HasSuffix(e.mediaType, "/*") {
+            if mt, ok := lookupWildcard(strings.TrimSuffix(e.mediaType, "*")); ok {
+                return mt, nil
+            }
+            continue
+        }
+
+        if _, ok := lookupSerializer(e.mediaType); ok {
+            return e.mediaType, nil
+        }
+    }
+
+    return mediaTypeJSON, fmt.Errorf("none of %q can be served. %w", accept, errNotAcceptable)
+}
+
+// decodeRequestBody decodes the request body into v using the request's Content-Type.
+// a body that can't be decoded is the client's fault, so the error is wrapped with errBadRequest.
+// json and xml get the same rules: at most maxBodyBytes, a missing body is called out, and a field
+//   the target doesn't have is rejected.
+func decodeRequestBody(req *http.Request, v interface{}) error {
+    // the limit goes on before the format is known, so no decoder ever reads past it.
+    b, err := readBody(req.Body)
+    if err != nil {
+        return err
+    }
+
+    // ParseMediaType strips parameters like ";charset=utf-8". an unparseable header falls back to json.
+    mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+    // decodeJSON already wraps its errors with errBadRequest.
+    if mt != mediaTypeXML && mt != "text/xml" {
+        return decodeJSON(bytes.NewReader(b), v)
+    }
+
+    if len(bytes.TrimSpace(b)) == 0 {
+        return fmt.Errorf("%s. %w", bodyRequiredMessage, errBadRequest)
+    }
+    if err := xml.Unmarshal(b, v); err != nil {
+        return fmt.Errorf("failed to decode. %s. %w", err, errBadRequest)
+    }
+    if name := unknownXMLElement(b, reflect.TypeOf(v)); name != "" {
+        return fmt.Errorf("unknown field %q. %w", name, errBadRequest)
+    }
+
+    return nil
+}
+
+// requireJSONBody is a 415 for a body that isn't json. it's for the bodies that have no xml form, eg. a
+//   PATCH, whose fields are a map that xml can't decode into. a missing Content-Type is taken as json,
+//   the same as decodeRequestBody does.
+func requireJSONBody(req *http.Request) error {
+    ct := req.Header.Get("Content-Type")
+    if ct == "" {
+        return nil
+    }
+
+    if mt, _, err := mime.ParseMediaType(ct); err == nil && mt == mediaTypeJSON {
+        return nil
+    }
+
+    return &HTTPError{
+        Status: http.StatusUnsupportedMediaType,
+        Msg: fmt.Sprintf("this endpoint only accepts %s bodies", mediaTypeJSON),
+    }
+}
+
+// unknownXMLElement is the first child of the root element that t has no field for, or "" if there
+//   isn't one. encoding/xml has nothing like json's DisallowUnknownFields, so this is it.
+// only the root's children are checked. every xml request body is a flat struct.
+func unknownXMLElement(b []byte, t reflect.Type) string {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    if t.Kind() != reflect.Struct {
+        return ""
+    }
+
+    known := map[string]bool{}
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        name := strings.Split(f.Tag.Get("xml"), ",")[0]
+        if f.PkgPath != "" || f.Name == "XMLName" || name == "-" {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        known[name] = true
+    }
+
+    // b has already been unmarshalled without error, so the tokens are well formed.
+    dec := xml.NewDecoder(bytes.NewReader(b))
+    depth := 0
+    for {
+        tok, err := dec.Token()
+        if err != nil {
+            return ""
+        }
+        switch el := tok.(type) {
+        case xml.StartElement:
+            depth++
+            if depth == 2 && !known[el.Name.Local] {
+                return el.Name.Local
+            }
+        case xml.EndElement:
+            depth--
+        }
+    }
+}
+
+// bodyRequiredMessage is the error for a request that needed a body and didn't send one.
+const bodyRequiredMessage = "request body is required"
+
+// maxBodyBytes is the largest body readBody reads, json or xml. the biggest legitimate one is a full
+//   bulk update, which is well under this.
+var maxBodyBytes int64 = 1 << 20
+
+// readBody reads all of r, up to maxBodyBytes. a longer body is an errBadRequest.
+func readBody(r io.Reader) ([]byte, error) {
+    // one byte more than the limit is read, so "the limit was hit" can be told apart from a body of
+    //   exactly maxBodyBytes.
+    b, err := io.ReadAll(io.LimitReader(r, maxBodyBytes+1))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read request body. %s. %w", err, errBadRequest)
+    }
+    if int64(len(b)) > maxBodyBytes {
+        return nil, fmt.Errorf("request body must be at most %d bytes. %w", maxBodyBytes, errBadRequest)
+    }
+
+    return b, nil
+}
+
+// decodeJSON is how every json body is decoded. use it instead of json.NewDecoder or json.Unmarshal.
+// every error is wrapped with errBadRequest and has a message written for the client:
+// - a missing body (empty, whitespace or null), a body over maxBodyBytes, and a body that isn't json are each called out.
+// - a field the target doesn't have is rejected, so a typo like "zipcode" isn't silently dropped.
+// - a value of the wrong type names the field by its json key, eg. "field zip_code expected a number, got string".
+//
+// it decodes with UseNumber. that only changes numbers going into an interface{} (eg. a PATCH body's
+//   map[string]interface{}). they become a json.Number, the number's exact text, instead of a float64,
+//   which can't hold integers past 2^53 and would silently change a big id.
+// so code reading a number out of a map gets a json.Number and converts it with Int64() (or Float64()
+//   for a genuinely fractional field) at the point it knows which one the field is. numbers decoded
+//   into struct fields are unaffected.
+func decodeJSON(r io.Reader, v interface{}) error {
+    // the body is read in full (it's bounded) so an empty one can be recognized before decoding.
+    b, err := readBody(r)
+    if err != nil {
+        return err
+    }
+
+    // whitespace decodes as EOF, and a bare null decodes into a struct without error and leaves it
+    //   zero. both mean the client didn't send a body, so they get the same answer as no body at all.
+    if trimmed := bytes.TrimSpace(b); len(trimmed) == 0 || string(trimmed) == "null" {
+        return fmt.Errorf("%s. %w", bodyRequiredMessage, errBadRequest)
+    }
+
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    dec.DisallowUnknownFields()
+
+    err = dec.Decode(v)
+    if err == nil {
+        return nil
+    }
+
+    var se *json.SyntaxError
+    if errs.As(err, &se) {
+        return fmt.Errorf("request body is not valid json (at byte %d). %w", se.Offset, errBadRequest)
+    }
+    if errs.Is(err, io.ErrUnexpectedEOF) {
+        return fmt.Errorf("request body is not valid json (it ends early). %w", errBadRequest)
+    }
+
+    var ute *json.UnmarshalTypeError
+    if errs.As(err, &ute) && ute.Field != "" {
+        field := jsonFieldPath(reflect.TypeOf(v), ute.Field)
+
+        // ute.Value is "number 1.5" when a number didn't fit a numeric field.
+        if lit := strings.TrimPrefix(ute.Value, "number "); lit != ute.Value {
+            return jsonNumberError(field, lit, ute.Type)
+        }
+        // eg. "field zip_code expected a number, got string".
+        return fmt.Errorf("field %s expected %s, got %s. %w", field, jsonTypeName(ute.Type.Kind()), ute.Value, errBadRequest)
+    }
+
+    // encoding/json has no error type for this one. the message is `json: unknown field "zipcode"`.
+    if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+        return fmt.Errorf("unknown field %s. %w", field, errBadRequest)
+    }
+
+    return fmt.Errorf("failed to decode. %s. %w", err, errBadRequest)
+}
+
+// jsonNumberError is why the number lit didn't fit field, whose type is t.
+// a number too big for its field (eg. a zip_code past the int range) is out of range. anything else
+//   that doesn't parse, like 1.5 or 1e3 for an int, isn't an integer at all. only the parse's ErrRange
+//   tells the two apart.
+func jsonNumberError(field, lit string, t reflect.Type) error {
+    var err error
+    want := "an integer"
+    switch t.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        _, err = strconv.ParseInt(lit, 10, t.Bits())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        _, err = strconv.ParseUint(lit, 10, t.Bits())
+        want = "a non-negative integer"
+    case reflect.Float32, reflect.Float64:
+        _, err = strconv.ParseFloat(lit, t.Bits())
+        want = "a number"
+    default:
+        return fmt.Errorf("field %s expected %s, got number. %w", field, jsonTypeName(t.Kind()), errBadRequest)
+    }
+
+    if errs.Is(err, strconv.ErrRange) {
+        return fmt.Errorf("%s out of range. %w", field, errBadRequest)
+    }
+    return fmt.Errorf("field %s expected %s, got %s. %w", field, want, lit, errBadRequest)
+}
+
+// jsonFieldPath returns path ("a.b.c", as UnmarshalTypeError.Field has it) with every segment as the
+//   json key the client sent, by walking t's struct tags. depending on the Go version, Field holds
+//   either the json keys already or the Go field names, so segments are matched both ways.
+// a segment that can't be matched is kept as it is.
+func jsonFieldPath(t reflect.Type, path string) string {
+    segments := strings.Split(path, ".")
+    for i, seg := range segments {
+        for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map) {
+            t = t.Elem()
+        }
+        if t == nil || t.Kind() != reflect.Struct {
+            break
+        }
+
+        var next reflect.Type
+        for j := 0; j < t.NumField(); j++ {
+            f := t.Field(j)
+            if f.Name == seg || fieldName(f) == seg {
+                segments[i] = fieldName(f)
+                next = f.Type
+                break
+            }
+        }
+        t = next
+    }
+
+    return strings.Join(segments, ".")
+}
+
+// jsonTypeName describes a Go kind as the json type a client would have to send, for error messages.
+func jsonTypeName(k reflect.Kind) string {
+    switch k {
+    case reflect.Bool:
+        return "a boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+        reflect.Float32, reflect.Float64:
+        return "a number"
+    case reflect.String:
+        return "a string"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    case reflect.Struct, reflect.Map:
+        return "an object"
+    }
+
+    return "a different type"
+}
+
+// encodeBody writes body to w with the negotiated media type's serializer.
+func (n negotiator) encodeBody(w io.Writer, body interface{}) error {
+    s, _ := lookupSerializer(n.mediaType)
+    if s == nil {
+        return fmt.Errorf("no serializer for %q", n.mediaType)
+    }
+
+    return s.Serialize(w, body, n.pretty)
+}
+
+// fallbackToJSON is the safety net for a media type that was selected but has no serializer
+//   (eg. a format that was registered before its serializer was finished).
+// the client gets json and we get a warning, instead of the client getting an empty body.
+func (n negotiator) fallbackToJSON() negotiator {
+    if s, _ := lookupSerializer(n.mediaType); s != nil {
+        return n
+    }
+
+    logrus.WithField("media_type", n.mediaType).Warn("no serializer for negotiated media type. falling back to json")
+    n.mediaType = mediaTypeJSON
+    return n
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+// a gzip entry decides on its own, and "gzip;q=0" (or q=0.0) means the client explicitly does NOT want
+//   gzip. without one, "*" decides, so "*;q=0" refuses it too. with neither, the response isn't compressed.
+func acceptsGzip(acceptEncoding string) bool {
+    // -1 means the header doesn't mention it.
+    gzipQ, anyQ := -1.0, -1.0
+    for _, enc := range strings.Split(acceptEncoding, ",") {
+        params := strings.Split(enc, ";")
+        switch strings.ToLower(strings.TrimSpace(params[0])) {
+        case "gzip":
+            gzipQ = qValue(params[1:])
+        case "*":
+            anyQ = qValue(params[1:])
+        }
+    }
+
+    if gzipQ >= 0 {
+        return gzipQ > 0
+    }
+
+    return anyQ > 0
+}
+
+// Respond writes body in the negotiated format with the given status.
+//
+// pretty only changes the bytes written to the client. anything that hashes a response
+//   (eg. an ETag) must use json.Marshal on the value, never the bytes written here,
+//   otherwise ?pretty=true would change the hash for identical data.
+//
+// if the client accepts gzip and the body is over gzipThreshold, the body is compressed.
+func (n negotiator) Respond(rw http.ResponseWriter, status int, body interface{}) {
+    // n is a copy (value receiver), so this never changes the caller's negotiator.
+    n = n.fallbackToJSON()
+
+    // encode into a buffer first. i need to know the size to decide on compression, and an
+    //   encode error can still become a 500 because nothing has been written yet.
+    buf := bytes.Buffer{}
+    stopSerialization := ctxpkg.Timer(n.ctx, "serialization")
+    err := n.encodeBody(&buf, body)
+    stopSerialization()
+    if err != nil {
+        logrus.WithError(err).Error("failed to encode response")
+        rw.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", n.mediaType)
+    // the body depends on Accept-Encoding, so caches must key on it whether we compress or not.
+    rw.Header().Add("Vary", "Accept-Encoding")
+
+    if !n.gzip || buf.Len() < gzipThreshold {
+        rw.WriteHeader(status)
+        if _, err := rw.Write(buf.Bytes()); err != nil {
+            logrus.WithError(err).Error("failed to write response")
+        }
+        return
+    }
+
+    // the compressed length isn't known until it's written, so Content-Length must not be sent.
+    rw.Header().Set("Content-Encoding", "gzip")
+    rw.Header().Del("Content-Length")
+    rw.WriteHeader(status)
+
+    gz := gzip.NewWriter(rw)
+    // Close flushes the gzip footer. without it the client gets a truncated body.
+    // the deferred Close guarantees that happens even if Write fails.
+    defer func() {
+        if err := gz.Close(); err != nil {
+            logrus.WithError(err).Error("failed to close gzip writer")
+        }
+    }()
+
+    if _, err := gz.Write(buf.Bytes()); err != nil {
+        logrus.WithError(err).Error("failed to write gzipped response")
+    }
+}
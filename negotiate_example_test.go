@@ -0,0 +1,241 @@
+package examplePackage
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    errs "errors"
+)
+
+// xml bodies get the same size limit and unknown field check as json ones.
+func TestDecodeRequestBody(t *testing.T) {
+    tooBig := "<user><full_name>" + strings.Repeat("a", int(maxBodyBytes)) + "</full_name></user>"
+
+    tests := []struct {
+        name string
+        contentType string
+        body string
+        wantErr bool
+    }{
+        {"json", mediaTypeJSON, `{"full_name":"Ada","city":"Austin"}`, false},
+        {"json unknown field", mediaTypeJSON, `{"full_name":"Ada","zipcode":1}`, true},
+        {"json too big", mediaTypeJSON, `{"full_name":"` + strings.Repeat("a", int(maxBodyBytes)) + `"}`, true},
+        {"xml", mediaTypeXML, `<user><full_name>Ada</full_name><city>Austin</city></user>`, false},
+        {"text/xml with charset", "text/xml; charset=utf-8", `<user><full_name>Ada</full_name></user>`, false},
+        {"xml unknown element", mediaTypeXML, `<user><full_name>Ada</full_name><zipcode>1</zipcode></user>`, true},
+        {"xml too big", mediaTypeXML, tooBig, true},
+        {"xml empty", mediaTypeXML, "  ", true},
+        {"xml malformed", mediaTypeXML, `<user><full_name>Ada</user>`, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(tt.body))
+            req.Header.Set("Content-Type", tt.contentType)
+
+            cur := createUserRequest{}
+            err := decodeRequestBody(req, &cur)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("decodeRequestBody() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if err != nil && !errs.Is(err, errBadRequest) {
+                t.Errorf("error %v isn't an errBadRequest", err)
+            }
+            if err == nil && cur.FullName != "Ada" {
+                t.Errorf("FullName = %q, want %q", cur.FullName, "Ada")
+            }
+        })
+    }
+}
+
+func TestAcceptsGzip(t *testing.T) {
+    tests := []struct {
+        header string
+        want bool
+    }{
+        {"", false},
+        {"gzip", true},
+        {"gzip, deflate, br", true},
+        {"deflate, GZIP;q=0.5", true},
+        {"gzip;q=0", false},
+        {"gzip;q=0.0", false},
+        {"gzip; q=0.000", false},
+        {"gzip;Q=0", false},
+        {"*", true},
+        {"*;q=0", false},
+        {"*;q=0, deflate", false},
+        {"gzip;q=0, *", false},
+        {"*;q=0, gzip", true},
+        {"deflate", false},
+    }
+
+    for _, tt := range tests {
+        if got := acceptsGzip(tt.header); got != tt.want {
+            t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestParseAcceptDropsZeroQ(t *testing.T) {
+    got := parseAccept("application/xml;q=0.0, application/json;q=0.5, text/html;q=0")
+    if len(got) != 1 || got[0].mediaType != mediaTypeJSON {
+        t.Errorf("parseAccept() = %v, want only %s", got, mediaTypeJSON)
+    }
+}
+
+// a number too big for its field is out of range. one with a fraction isn't an integer, however small.
+// the highest q wins wherever it is in the header. equal q keeps the client's order.
+func TestParseAcceptWeighted(t *testing.T) {
+    tests := []struct {
+        accept string
+        want []string
+    }{
+        {"application/json;q=0.5, application/xml;q=0.9, text/csv;q=0.7", []string{mediaTypeXML, "text/csv", mediaTypeJSON}},
+        {"text/csv;q=0.2, application/xml, application/json;q=0.8", []string{mediaTypeXML, mediaTypeJSON, "text/csv"}},
+        {"application/xml;q=0.5, application/json;q=0.5", []string{mediaTypeXML, mediaTypeJSON}},
+    }
+
+    for _, tt := range tests {
+        got := []string{}
+        for _, e := range parseAccept(tt.accept) {
+            got = append(got, e.mediaType)
+        }
+        if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+            t.Errorf("parseAccept(%q) = %v, want %v", tt.accept, got, tt.want)
+        }
+    }
+
+    // and responseMediaType serves the highest one it can.
+    if mt, err := responseMediaType("text/csv;q=1, application/json;q=0.4, application/xml;q=0.6"); err != nil || mt != mediaTypeXML {
+        t.Errorf("responseMediaType() = %q, %v, want %q", mt, err, mediaTypeXML)
+    }
+}
+
+func TestDecodeRequestBodyNumbers(t *testing.T) {
+    tests := []struct {
+        name string
+        zip string
+        wantMsg string
+    }{
+        {"overflow", "99999999999999999999", "zip_code out of range"},
+        {"negative overflow", "-99999999999999999999", "zip_code out of range"},
+        {"fraction", "1.5", "zip_code expected an integer, got 1.5"},
+        {"exponent", "1e3", "zip_code expected an integer, got 1e3"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(`{"zip_code":`+tt.zip+`}`))
+            req.Header.Set("Content-Type", mediaTypeJSON)
+
+            err := decodeRequestBody(req, &createUserRequest{})
+            if errStatus(err) != http.StatusBadRequest {
+                t.Fatalf("decodeRequestBody() = %v, want a 400", err)
+            }
+            if !strings.Contains(err.Error(), tt.wantMsg) {
+                t.Errorf("error = %q, want it to say %q", err, tt.wantMsg)
+            }
+        })
+    }
+}
+
+// ?pretty=true indents the same data. compacting it gives back exactly the default output.
+func TestRespondPretty(t *testing.T) {
+    body := createUserResponse{ID: "1", CreatedAt: "2024-01-02T03:04:05Z", UpdatedAt: "2024-01-02T03:04:05Z"}
+    respond := func(target string) string {
+        rw := httptest.NewRecorder()
+        getNegotiator(httptest.NewRequest(http.MethodGet, target, nil)).Respond(rw, http.StatusOK, body)
+        return rw.Body.String()
+    }
+
+    compact := respond("/v1/user/1")
+    pretty := respond("/v1/user/1?pretty=true")
+
+    if want := `{"id":"1","created_at":"2024-01-02T03:04:05Z","updated_at":"2024-01-02T03:04:05Z"}` + "\n"; compact != want {
+        t.Errorf("compact = %q, want %q", compact, want)
+    }
+    if !strings.Contains(pretty, "\n  \"id\": \"1\"") {
+        t.Errorf("pretty = %q, want it indented by two spaces", pretty)
+    }
+
+    buf := bytes.Buffer{}
+    if err := json.Compact(&buf, []byte(pretty)); err != nil {
+        t.Fatal(err)
+    }
+    if buf.String() != strings.TrimSpace(compact) {
+        t.Errorf("compacted pretty = %s, want %s", buf.String(), compact)
+    }
+}
+
+// a type we can't serve never gets an empty body. the handler's negotiator falls back to json, and
+//   so does a type that's registered without a serializer.
+func TestNegotiatorFallsBackToJSON(t *testing.T) {
+    const unfinished = "application/x-unfinished"
+    registerTestSerializer(t, unfinished, nil)
+
+    tests := []struct {
+        accept string
+        want string
+    }{
+        {"text/csv", mediaTypeJSON},
+        {"text/csv, application/xml", mediaTypeXML},
+        {unfinished, mediaTypeJSON},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.accept, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodGet, "/v1/user/1", nil)
+            req.Header.Set("Accept", tt.accept)
+            rw := httptest.NewRecorder()
+            getNegotiator(req).Respond(rw, http.StatusOK, createUserResponse{ID: "1"})
+
+            if got := rw.Header().Get("Content-Type"); got != tt.want {
+                t.Errorf("Content-Type = %q, want %q", got, tt.want)
+            }
+            if rw.Body.Len() == 0 {
+                t.Error("empty body")
+            }
+        })
+    }
+
+    // the middleware still turns the unsupported one into a 406 before a handler runs.
+    if _, err := responseMediaType("text/csv"); !errs.Is(err, errNotAcceptable) {
+        t.Errorf("responseMediaType(text/csv) error = %v, want %v", err, errNotAcceptable)
+    }
+}
+
+// ?format= wins over Accept, unless Accept rules the format out. then it's a 400, not a guess.
+func TestNegotiationFormatConflict(t *testing.T) {
+    tests := []struct {
+        format string
+        accept string
+        wantStatus int
+    }{
+        {"xml", "", http.StatusOK},
+        {"xml", "*/*", http.StatusOK},
+        {"xml", "application/*", http.StatusOK},
+        {"xml", "application/json, application/xml;q=0.1", http.StatusOK},
+        {"xml", "application/json", http.StatusBadRequest},
+        {"json", "application/xml", http.StatusBadRequest},
+        {"csv", "", http.StatusBadRequest},
+    }
+
+    h := NegotiationMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+    for _, tt := range tests {
+        t.Run(tt.format+" "+tt.accept, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodGet, "/v1/users?format="+tt.format, nil)
+            if tt.accept != "" {
+                req.Header.Set("Accept", tt.accept)
+            }
+            rw := httptest.NewRecorder()
+            h.ServeHTTP(rw, req)
+
+            if rw.Code != tt.wantStatus {
+                t.Errorf("status = %d, want %d", rw.Code, tt.wantStatus)
+            }
+        })
+    }
+}
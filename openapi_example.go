@@ -0,0 +1,171 @@
+/*
+GET /openapi.json serves an OpenAPI 3 document for api gateways and client generators.
+
+The document is generated, not written by hand, from the same Routes() that are registered with the
+router (routes_example.go). Each Route names the Go types it reads and writes, and the schemas come from
+those types by reflection (schemaOf in schema_example.go). Adding a route or a field to a response
+struct changes the document with no extra step.
+
+Success bodies are described as the payload that handlers pass to response.Success. Errors are
+described with the error envelope (envelope_example.go).
+*/
+package examplePackage
+
+import (
+    "net/http"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// queryParamTypes are the query params that aren't strings.
+var queryParamTypes = map[string]string{
+    "limit": "integer",
+    "offset": "integer",
+    "partial": "boolean",
+    "dry_run": "boolean",
+    "include_deleted": "boolean",
+    "fail_fast": "boolean",
+}
+
+type openAPIDoc struct {
+    OpenAPI string `json:"openapi"`
+    Info openAPIInfo `json:"info"`
+    // path -> lower case method -> operation.
+    Paths map[string]map[string]*openAPIOperation `json:"paths"`
+    Components openAPIComponents `json:"components"`
+}
+
+type openAPIInfo struct {
+    Title string `json:"title"`
+    Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+    Schemas map[string]*jsonSchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+    Summary string `json:"summary,omitempty"`
+    Parameters []openAPIParameter `json:"parameters,omitempty"`
+    RequestBody *openAPIRequestBody `json:"requestBody,omitempty"`
+    Responses map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+    Name string `json:"name"`
+    In string `json:"in"`
+    Required bool `json:"required,omitempty"`
+    Schema *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+    Required bool `json:"required"`
+    Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+    Schema *jsonSchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+    Description string `json:"description"`
+    Content map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+// newOpenAPIDoc builds and marshals the document for routes.
+func newOpenAPIDoc(routes []Route) (cachedSchema, error) {
+    doc := openAPIDoc{
+        OpenAPI: "3.0.3",
+        Info: openAPIInfo{Title: "users", Version: "v1"},
+        Paths: map[string]map[string]*openAPIOperation{},
+        Components: openAPIComponents{
+            Schemas: map[string]*jsonSchema{
+                "ErrorEnvelope": schemaOf(reflect.TypeOf(errorEnvelope{})),
+            },
+        },
+    }
+
+    for _, r := range routes {
+        path, params := openAPIPath(r.Pattern)
+        if doc.Paths[path] == nil {
+            doc.Paths[path] = map[string]*openAPIOperation{}
+        }
+        doc.Paths[path][strings.ToLower(r.Method)] = openAPIOperationFor(r, params)
+    }
+
+    return newCachedSchema(doc)
+}
+
+// openAPIPath turns vestigo's "/v1/user/:user_id" into OpenAPI's "/v1/user/{user_id}" and returns
+//   the path params.
+func openAPIPath(pattern string) (string, []string) {
+    segments := strings.Split(pattern, "/")
+    params := []string{}
+    for i, seg := range segments {
+        if strings.HasPrefix(seg, ":") {
+            params = append(params, seg[1:])
+            segments[i] = "{" + seg[1:] + "}"
+        }
+    }
+
+    return strings.Join(segments, "/"), params
+}
+
+func openAPIOperationFor(r Route, pathParams []string) *openAPIOperation {
+    op := &openAPIOperation{
+        Summary: r.Summary,
+        Responses: make(map[string]openAPIResponse, len(r.Statuses)),
+    }
+
+    for _, p := range pathParams {
+        op.Parameters = append(op.Parameters, openAPIParameter{
+            Name: p, In: "path", Required: true, Schema: &jsonSchema{Type: "string"},
+        })
+    }
+
+    // sorted so the document (and its ETag) is the same on every start.
+    query := append([]string{}, r.Query...)
+    sort.Strings(query)
+    for _, q := range query {
+        t := queryParamTypes[q]
+        if t == "" {
+            t = "string"
+        }
+        op.Parameters = append(op.Parameters, openAPIParameter{Name: q, In: "query", Schema: &jsonSchema{Type: t}})
+    }
+
+    if r.Request != nil {
+        op.RequestBody = &openAPIRequestBody{
+            Required: true,
+            Content: map[string]openAPIMediaType{
+                mediaTypeJSON: {Schema: schemaOf(reflect.TypeOf(r.Request))},
+            },
+        }
+    }
+
+    for _, status := range r.Statuses {
+        resp := openAPIResponse{Description: http.StatusText(status)}
+
+        switch {
+        case status >= 400:
+            resp.Content = map[string]openAPIMediaType{
+                mediaTypeJSON: {Schema: &jsonSchema{Ref: "#/components/schemas/ErrorEnvelope"}},
+            }
+        case r.Response != nil && status != http.StatusNotModified:
+            resp.Content = map[string]openAPIMediaType{
+                mediaTypeJSON: {Schema: schemaOf(reflect.TypeOf(r.Response))},
+            }
+        }
+
+        op.Responses[strconv.Itoa(status)] = resp
+    }
+
+    return op
+}
+
+// GET /openapi.json
+func (c *Controller) OpenAPIHandler(rw http.ResponseWriter, req *http.Request) {
+    c.openAPIDoc.serve(rw, req, mediaTypeJSON)
+}
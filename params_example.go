@@ -0,0 +1,115 @@
+/*
+Parsing numbers that come from clients.
+
+strconv's errors are written for Go developers ("strconv.Atoi: parsing "99999999999999999999": value out of range").
+A client shouldn't see that. Every integer a client sends goes through parseBoundedInt so the
+messages are consistent and an overflow reads the same as any other out of range value.
+
+Query params are read through queryParams, so every handler parses them the same way and a bad value
+is always an errBadRequest that names the param.
+*/
+package examplePackage
+
+import (
+    "fmt"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    errs "errors"
+)
+
+// maxOffset keeps offsets well inside int range on every platform.
+const maxOffset = math.MaxInt32
+
+// parseBoundedInt parses raw as an integer between min and max inclusive.
+// name is the parameter's name as the client knows it, so the error tells them what to fix.
+// every error wraps errBadRequest.
+func parseBoundedInt(name, raw string, min, max int) (int, error) {
+    // ParseInt with a bit size of 64 instead of Atoi so overflow is reported the same on 32 and 64 bit builds.
+    v, err := strconv.ParseInt(raw, 10, 64)
+    if errs.Is(err, strconv.ErrRange) {
+        return 0, fmt.Errorf("%s out of range. must be between %d and %d. %w", name, min, max, errBadRequest)
+    }
+    if err != nil {
+        return 0, fmt.Errorf("%s must be a whole number. %w", name, errBadRequest)
+    }
+
+    if v < int64(min) || v > int64(max) {
+        return 0, fmt.Errorf("%s out of range. must be between %d and %d. %w", name, min, max, errBadRequest)
+    }
+
+    return int(v), nil
+}
+
+// queryValues is a request's query params with typed getters.
+// a param that's missing or empty (?limit=) gets the default. one that's there but doesn't parse is an
+//   errBadRequest, never silently the default, so a client's typo doesn't go unnoticed.
+type queryValues struct {
+    q url.Values
+}
+
+func queryParams(req *http.Request) queryValues {
+    return queryValues{q: req.URL.Query()}
+}
+
+// String is the param with surrounding spaces trimmed.
+func (qv queryValues) String(name, def string) string {
+    v := strings.TrimSpace(qv.q.Get(name))
+    if v == "" {
+        return def
+    }
+
+    return v
+}
+
+// Int accepts anything that fits in an int32, so it means the same on 32 and 64 bit builds.
+func (qv queryValues) Int(name string, def int) (int, error) {
+    return qv.IntBetween(name, def, math.MinInt32, math.MaxInt32)
+}
+
+// IntBetween is Int for a param that has to be between min and max inclusive. see parseBoundedInt.
+func (qv queryValues) IntBetween(name string, def, min, max int) (int, error) {
+    raw := qv.String(name, "")
+    if raw == "" {
+        return def, nil
+    }
+
+    return parseBoundedInt(name, raw, min, max)
+}
+
+// Bool accepts what strconv.ParseBool does, eg. true, false, 1 and 0.
+func (qv queryValues) Bool(name string, def bool) (bool, error) {
+    raw := qv.String(name, "")
+    if raw == "" {
+        return def, nil
+    }
+
+    v, err := strconv.ParseBool(raw)
+    if err != nil {
+        return false, fmt.Errorf("%s must be true or false. %w", name, errBadRequest)
+    }
+
+    return v, nil
+}
+
+// mutuallyExclusive returns an errBadRequest when more than one of the named query params is present.
+// eg. mutuallyExclusive(req, "cursor", "offset"), because a page can't start at a cursor AND an offset.
+// a param counts as present even when it's empty (?offset=), since the client still sent it.
+func mutuallyExclusive(req *http.Request, names ...string) error {
+    q := req.URL.Query()
+
+    present := make([]string, 0, len(names))
+    for _, name := range names {
+        if _, ok := q[name]; ok {
+            present = append(present, name)
+        }
+    }
+
+    if len(present) > 1 {
+        return fmt.Errorf("%s cannot be used together. %w", strings.Join(present, " and "), errBadRequest)
+    }
+
+    return nil
+}
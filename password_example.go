@@ -0,0 +1,66 @@
+/*
+Passwords are never stored. Only a hash of the password is stored, and a login hashes what the user
+typed and compares.
+
+The hashing algorithm is behind an interface because algorithms age. bcrypt is the default today,
+but swapping to argon2 (or raising the cost as hardware gets faster) should be a one line change
+in main(), not a hunt through the handlers.
+*/
+package examplePackage
+
+import (
+    "fmt"
+    errs "errors"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes and verifies passwords.
+// Verify returns a nil error on a match. anything else is a failed login.
+type PasswordHasher interface {
+    Hash(password string) (string, error)
+    Verify(hash, password string) error
+}
+
+// maxPasswordBytes is the longest password bcrypt hashes. it refuses anything longer, so a create
+//   has to reject it with a 422 before it gets that far. it's bytes, not characters.
+const maxPasswordBytes = 72
+
+// errPasswordMismatch lets callers tell a wrong password apart from a broken hash.
+var errPasswordMismatch = errs.New("password does not match")
+
+// bcryptHasher is the default PasswordHasher.
+// Cost is the log2 number of rounds. every +1 doubles the time it takes to hash (and to brute force).
+type bcryptHasher struct {
+    Cost int
+}
+
+func newBcryptHasher(cost int) bcryptHasher {
+    if cost < bcrypt.MinCost {
+        cost = bcrypt.DefaultCost
+    }
+
+    return bcryptHasher{Cost: cost}
+}
+
+// bcrypt generates and embeds its own salt, so the same password hashes differently every time.
+func (b bcryptHasher) Hash(password string) (string, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+    if err != nil {
+        return "", fmt.Errorf("failed to hash password. %w", err)
+    }
+
+    return string(hash), nil
+}
+
+func (b bcryptHasher) Verify(hash, password string) error {
+    err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+    if errs.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+        return errPasswordMismatch
+    }
+    if err != nil {
+        return fmt.Errorf("failed to verify password. %w", err)
+    }
+
+    return nil
+}
@@ -0,0 +1,74 @@
+package examplePackage
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    errs "errors"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+func TestBcryptHasher(t *testing.T) {
+    h := newBcryptHasher(bcrypt.MinCost)
+
+    hash, err := h.Hash("correct horse")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(hash, "correct horse") {
+        t.Errorf("hash %q contains the password", hash)
+    }
+
+    if err := h.Verify(hash, "correct horse"); err != nil {
+        t.Errorf("Verify() with the right password = %v, want nil", err)
+    }
+    if err := h.Verify(hash, "wrong horse"); !errs.Is(err, errPasswordMismatch) {
+        t.Errorf("Verify() with the wrong password = %v, want %v", err, errPasswordMismatch)
+    }
+}
+
+// the store only ever sees the hash. a password bcrypt can't hash is a 422, not a 500.
+func TestCreateUserPassword(t *testing.T) {
+    body := func(password string) string {
+        return `{"full_name":"Ada","address":"1 Main St","city":"Austin","state":"TX","zip_code":78701,"password":"` + password + `"}`
+    }
+
+    tests := []struct {
+        name string
+        password string
+        wantStatus int
+    }{
+        {"hashed", "correct horse", 0},
+        {"at the bcrypt limit", strings.Repeat("a", maxPasswordBytes), 0},
+        {"over the bcrypt limit", strings.Repeat("a", maxPasswordBytes+1), http.StatusUnprocessableEntity},
+        // 37 two byte characters is 74 bytes.
+        {"multibyte over the bcrypt limit", strings.Repeat("é", 37), http.StatusUnprocessableEntity},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := newMemUserStore()
+            h := newBcryptHasher(bcrypt.MinCost)
+            c := &Controller{DB: store, passwordHasher: h}
+
+            req := httptest.NewRequest(http.MethodPost, "/v1/user", strings.NewReader(body(tt.password)))
+            resp, err := c.handleCreateUser(req.Context(), req)
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Fatalf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+            if err != nil {
+                return
+            }
+
+            stored := store.users[resp.ID].req
+            if stored.Password != "" || stored.PasswordHash == tt.password {
+                t.Fatalf("stored password %q and hash %q, want only a hash", stored.Password, stored.PasswordHash)
+            }
+            if err := h.Verify(stored.PasswordHash, tt.password); err != nil {
+                t.Errorf("stored hash doesn't verify the password: %v", err)
+            }
+        })
+    }
+}
@@ -0,0 +1,29 @@
+/*
+Phone numbers are stored in E.164 (eg. +14155550100) because our SMS provider rejects anything else.
+
+People type numbers with spaces, dashes, dots and parentheses, so those are stripped first.
+"+1 (415) 555-0100" is accepted and stored as "+14155550100". Anything still not E.164 after that
+is rejected rather than guessed at. eg. a number without the leading + and country code.
+*/
+package examplePackage
+
+import (
+    "regexp"
+    "strings"
+)
+
+// e164Pattern is a + then up to 15 digits, the first of which (the country code) can't be 0.
+var e164Pattern = regexp.MustCompile(`^\+[1-9]\d{1,14}$`)
+
+// phoneSeparators are the characters people use to group digits. they carry no meaning.
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// normalizePhone strips separators. it doesn't validate. an empty phone stays empty.
+func normalizePhone(phone string) string {
+    return phoneSeparators.Replace(strings.TrimSpace(phone))
+}
+
+// validPhone reports whether an already normalized phone is E.164.
+func validPhone(phone string) bool {
+    return e164Pattern.MatchString(phone)
+}
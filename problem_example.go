@@ -0,0 +1,80 @@
+/*
+RFC 7807 (https://tools.ietf.org/html/rfc7807) defines "problem details", a standard json shape for http errors.
+The content type is application/problem+json.
+
+The benefit of following a standard over a home grown error envelope is that clients (and api gateways)
+already know how to read it. The standard also allows "extension members", extra keys that are specific
+to your api. I use an "errors" extension to carry field level validation failures so a 422 is
+machine-consumable instead of a sentence the client has to parse.
+*/
+package examplePackage
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "github.com/sirupsen/logrus"
+)
+
+const problemContentType = "application/problem+json"
+
+// problemDetails is the RFC 7807 body.
+// omitempty is used everywhere because the rfc says every member is optional.
+type problemDetails struct {
+    Type string `json:"type,omitempty"`
+    Title string `json:"title,omitempty"`
+    Status int `json:"status,omitempty"`
+    Detail string `json:"detail,omitempty"`
+    Instance string `json:"instance,omitempty"`
+
+    // Errors is an extension member. it is not part of the rfc.
+    Errors []problemFieldError `json:"errors,omitempty"`
+}
+
+// problemFieldError points at the part of the request body that was wrong.
+// Pointer is a JSON Pointer (RFC 6901), eg. "/zip_code", which is the convention most problem+json
+//   consumers expect rather than a bare field name.
+type problemFieldError struct {
+    Pointer string `json:"pointer"`
+    Message string `json:"message"`
+}
+
+// problemFieldErrors maps validation FieldErrors to the problem+json "errors" extension.
+// this is the one place the two formats meet, so neither side has to know about the other.
+func problemFieldErrors(ve validationErrors) []problemFieldError {
+    // i know the exact length up front so i make the slice with that capacity.
+    pfe := make([]problemFieldError, 0, len(ve))
+    for _, fe := range ve {
+        pfe = append(pfe, problemFieldError{
+            Pointer: "/" + fe.Field,
+            Message: fe.Message,
+        })
+    }
+
+    return pfe
+}
+
+// validationProblem builds the 422 problem body for a request that failed field validation.
+func validationProblem(req *http.Request, ve validationErrors) problemDetails {
+    return problemDetails{
+        Type: "about:blank",
+        Title: "request validation failed",
+        // the body was readable, it just broke the rules. see errUnprocessable.
+        Status: http.StatusUnprocessableEntity,
+        Detail: ve.Error(),
+        Instance: req.URL.Path,
+        Errors: problemFieldErrors(ve),
+    }
+}
+
+// writeProblem writes a problem+json response.
+// it takes a value, not a pointer, for the same reasons discussed in http_handler_example.go.
+func writeProblem(rw http.ResponseWriter, pd problemDetails) {
+    rw.Header().Set("Content-Type", problemContentType)
+    rw.WriteHeader(pd.Status)
+
+    // the status is already written, so there's nothing left to tell the client. just log it.
+    if err := json.NewEncoder(rw).Encode(pd); err != nil {
+        logrus.WithError(err).Error("failed to encode problem details")
+    }
+}
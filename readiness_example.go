@@ -0,0 +1,177 @@
+/*
+Readiness for rolling deploys.
+
+During a deploy the load balancer has to stop sending traffic to an instance BEFORE the instance stops
+accepting it. Otherwise requests arrive at a closed port and clients see 502s.
+
+So shutdown happens in two steps:
+1. BeginShutdown flips /readyz to 503 and keeps serving as normal for readinessGrace. the load
+   balancer only notices on its next health check, and until then it keeps routing requests here.
+   the grace has to be at least its health check interval (times however many failed checks it
+   needs), or those requests are turned away. READINESS_GRACE sets it, eg. READINESS_GRACE=15s.
+2. then BeginShutdown drains writes and waits for the requests already in flight to finish.
+3. only then does main call server.Shutdown.
+
+Writes can be drained on their own before that, eg. while a migration needs the data to stop changing
+but reads can carry on. SIGUSR1 (or drainWrites) makes every POST, PUT, PATCH and DELETE respond 503
+until the instance is restarted. reads and /readyz are unaffected until shutdown.
+*/
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "github.com/sirupsen/logrus"
+)
+
+// how often BeginShutdown checks whether the in-flight requests have finished.
+const drainPollInterval = 50 * time.Millisecond
+
+// defaultReadinessGrace covers the load balancer's 5s health check interval twice over, in case one check
+//   was already under way when /readyz flipped.
+const defaultReadinessGrace = 10 * time.Second
+
+// inFlightTracker counts requests being served and knows whether the instance is ready for more.
+// both fields are atomics because every request touches them.
+type inFlightTracker struct {
+    count int64
+    draining int32
+    // writesDraining makes WriteDrainMiddleware turn writes away. it's set before draining and never unset.
+    writesDraining int32
+    // dbHealth also fails /readyz while the database is unreachable. nil means it isn't checked.
+    dbHealth *dbHealth
+    // readinessGrace is how long BeginShutdown keeps serving after /readyz fails. see parseReadinessGrace.
+    readinessGrace time.Duration
+}
+
+func newInFlightTracker() *inFlightTracker {
+    return &inFlightTracker{readinessGrace: defaultReadinessGrace}
+}
+
+// parseReadinessGrace is READINESS_GRACE, eg. "15s". empty or invalid is defaultReadinessGrace. 0 turns
+//   the grace off, which is only right when nothing load balances the instance, eg. running it locally.
+func parseReadinessGrace(s string) time.Duration {
+    if s == "" {
+        return defaultReadinessGrace
+    }
+
+    d, err := time.ParseDuration(s)
+    if err != nil || d < 0 {
+        logrus.WithField("readiness_grace", s).Warn("invalid readiness grace. using the default")
+        return defaultReadinessGrace
+    }
+
+    return d
+}
+
+// Middleware counts the request as in flight until the handler returns.
+func (t *inFlightTracker) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        atomic.AddInt64(&t.count, 1)
+        defer atomic.AddInt64(&t.count, -1)
+
+        next.ServeHTTP(rw, req)
+    })
+}
+
+// InFlight is the number of requests being served right now.
+func (t *inFlightTracker) InFlight() int64 {
+    return atomic.LoadInt64(&t.count)
+}
+
+// BeginShutdown makes /readyz fail, waits out readinessGrace, then drains writes and waits until no
+//   requests are in flight, or ctx is done.
+// it returns ctx's error when the deadline wins. the caller shuts down anyway, it just knows some
+//   requests were still running.
+func (t *inFlightTracker) BeginShutdown(ctx context.Context) error {
+    atomic.StoreInt32(&t.draining, 1)
+
+    // writes aren't drained yet either. the load balancer is still sending them here until it sees /readyz fail.
+    grace := time.NewTimer(t.readinessGrace)
+    defer grace.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-grace.C:
+    }
+
+    t.drainWrites()
+
+    ticker := time.NewTicker(drainPollInterval)
+    defer ticker.Stop()
+
+    for t.InFlight() > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+
+    return nil
+}
+
+// drainWrites makes every write route respond 503 from now on. reads carry on.
+func (t *inFlightTracker) drainWrites() {
+    if atomic.CompareAndSwapInt32(&t.writesDraining, 0, 1) {
+        logrus.Info("draining writes. write routes now respond 503")
+    }
+}
+
+// drainWritesOnSIGUSR1 calls drainWrites when the process gets SIGUSR1, eg. from a deploy's pre-stop step.
+func (t *inFlightTracker) drainWritesOnSIGUSR1() {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGUSR1)
+
+    for range sigs {
+        t.drainWrites()
+    }
+}
+
+// WriteDrainMiddleware responds 503 once writes are draining. withWriteDrain puts it on the write routes.
+// Retry-After isn't set, because there's no knowing when writes will be back. a client should retry
+//   against another instance, which is where the load balancer will send it.
+func (t *inFlightTracker) WriteDrainMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        if atomic.LoadInt32(&t.writesDraining) == 1 {
+            getNegotiator(req).Respond(rw, http.StatusServiceUnavailable, response.Error(nil))
+            return
+        }
+
+        next.ServeHTTP(rw, req)
+    })
+}
+
+// GET /readyz
+// 200 while the instance takes traffic, 503 once shutdown has begun or while the database is down.
+// the body is plain text because load balancers only look at the status. the database's last good
+//   ping is in it for operators, so they can see how stale it is.
+func (t *inFlightTracker) ReadyzHandler(rw http.ResponseWriter, req *http.Request) {
+    if atomic.LoadInt32(&t.draining) == 1 {
+        http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+        return
+    }
+
+    if t.dbHealth == nil {
+        rw.Write([]byte("ok"))
+        return
+    }
+
+    st := t.dbHealth.Status()
+    lastOK := "never"
+    if !st.LastOK.IsZero() {
+        lastOK = st.LastOK.UTC().Format(time.RFC3339)
+    }
+    if !st.Healthy {
+        http.Error(rw, "database unavailable. last ok: "+lastOK, http.StatusServiceUnavailable)
+        return
+    }
+
+    rw.Write([]byte("ok. database last ok: " + lastOK))
+}
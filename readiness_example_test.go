@@ -0,0 +1,83 @@
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    errs "errors"
+)
+
+// during the grace /readyz already fails but writes are still served, since the load balancer hasn't
+//   stopped sending them yet.
+func TestBeginShutdownWaitsOutReadinessGrace(t *testing.T) {
+    tr := newInFlightTracker()
+    tr.readinessGrace = 100 * time.Millisecond
+
+    write := tr.WriteDrainMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        rw.WriteHeader(http.StatusOK)
+    }))
+    serve := func(h http.Handler, method, path string) int {
+        rw := httptest.NewRecorder()
+        h.ServeHTTP(rw, httptest.NewRequest(method, path, nil))
+        return rw.Code
+    }
+
+    start := time.Now()
+    done := make(chan error, 1)
+    go func() { done <- tr.BeginShutdown(context.Background()) }()
+
+    // BeginShutdown flips /readyz before anything else, but from another goroutine.
+    deadline := time.Now().Add(time.Second)
+    for serve(http.HandlerFunc(tr.ReadyzHandler), http.MethodGet, "/readyz") != http.StatusServiceUnavailable {
+        if time.Now().After(deadline) {
+            t.Fatal("/readyz never started failing")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    if code := serve(write, http.MethodPost, "/v1/user"); code != http.StatusOK {
+        t.Errorf("write during the grace = %d, want %d", code, http.StatusOK)
+    }
+
+    if err := <-done; err != nil {
+        t.Fatalf("BeginShutdown() = %v", err)
+    }
+    if elapsed := time.Since(start); elapsed < tr.readinessGrace {
+        t.Errorf("BeginShutdown returned after %s, before the %s grace", elapsed, tr.readinessGrace)
+    }
+    if code := serve(write, http.MethodPost, "/v1/user"); code != http.StatusServiceUnavailable {
+        t.Errorf("write after the grace = %d, want %d", code, http.StatusServiceUnavailable)
+    }
+}
+
+func TestBeginShutdownDeadlineDuringGrace(t *testing.T) {
+    tr := newInFlightTracker()
+    tr.readinessGrace = time.Hour
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+
+    if err := tr.BeginShutdown(ctx); !errs.Is(err, context.DeadlineExceeded) {
+        t.Errorf("BeginShutdown() = %v, want %v", err, context.DeadlineExceeded)
+    }
+}
+
+func TestParseReadinessGrace(t *testing.T) {
+    tests := []struct {
+        in string
+        want time.Duration
+    }{
+        {"", defaultReadinessGrace},
+        {"15s", 15 * time.Second},
+        {"0", 0},
+        {"-1s", defaultReadinessGrace},
+        {"soon", defaultReadinessGrace},
+    }
+
+    for _, tt := range tests {
+        if got := parseReadinessGrace(tt.in); got != tt.want {
+            t.Errorf("parseReadinessGrace(%q) = %s, want %s", tt.in, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,188 @@
+/*
+retryableDB retries transient database errors so a deadlock or a dropped connection doesn't become a 500.
+
+Only errors that say "try again and it'll probably work" are retried: deadlocks, serialization
+failures and broken connections. Constraint violations, not found, version conflicts and a cancelled
+or expired context are returned straight away, since retrying can't change the answer.
+
+Only the reads are retried. A write whose error arrives after the database committed it (eg. the
+connection dropped on the way back) would be applied twice, and for UpdateUser the retry would fail
+its own version check and report a conflict that never happened. So writes pass straight through to
+the wrapped store.
+*/
+package examplePackage
+
+import (
+    "context"
+    "database/sql/driver"
+    "math/rand"
+    "syscall"
+    "time"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// a request is waiting, so retries are quick and few.
+var defaultDBRetry = retryConfig{
+    MaxAttempts: 3,
+    BaseDelay: 20 * time.Millisecond,
+    MaxDelay: 200 * time.Millisecond,
+}
+
+// transientSQLStates are the SQLSTATEs that mean the transaction was rolled back and can be run again.
+var transientSQLStates = map[string]bool{
+    // serialization_failure.
+    "40001": true,
+    // deadlock_detected.
+    "40P01": true,
+}
+
+// sqlStateError is implemented by driver errors that carry a SQLSTATE (eg. pgx's PgError).
+type sqlStateError interface {
+    SQLState() string
+}
+
+// isTransientDBError reports whether err is worth retrying.
+func isTransientDBError(err error) bool {
+    if err == nil {
+        return false
+    }
+
+    // the caller gave up. retrying would only waste the database's time.
+    if errs.Is(err, context.Canceled) || errs.Is(err, context.DeadlineExceeded) {
+        return false
+    }
+
+    if errs.Is(err, driver.ErrBadConn) || errs.Is(err, syscall.ECONNREFUSED) || errs.Is(err, syscall.ECONNRESET) {
+        return true
+    }
+
+    var se sqlStateError
+    return errs.As(err, &se) && transientSQLStates[se.SQLState()]
+}
+
+type retryableDB struct {
+    // the embedded store handles every method that isn't overridden below, ie. all the writes.
+    UserStore
+    rc retryConfig
+}
+
+func newRetryableDB(store UserStore, rc retryConfig) *retryableDB {
+    return &retryableDB{UserStore: store, rc: rc}
+}
+
+func (r *retryableDB) GetUser(ctx context.Context, userID string) (userRecord, error) {
+    var user userRecord
+    err := r.retry(ctx, "GetUser", func() error {
+        var err error
+        user, err = r.UserStore.GetUser(ctx, userID)
+        return err
+    })
+
+    return user, err
+}
+
+func (r *retryableDB) GetUserIncludingDeleted(ctx context.Context, userID string) (userRecord, error) {
+    var user userRecord
+    err := r.retry(ctx, "GetUserIncludingDeleted", func() error {
+        var err error
+        user, err = r.UserStore.GetUserIncludingDeleted(ctx, userID)
+        return err
+    })
+
+    return user, err
+}
+
+func (r *retryableDB) GetUsersByIDs(ctx context.Context, ids []string) ([]userRecord, error) {
+    var users []userRecord
+    err := r.retry(ctx, "GetUsersByIDs", func() error {
+        var err error
+        users, err = r.UserStore.GetUsersByIDs(ctx, ids)
+        return err
+    })
+
+    return users, err
+}
+
+func (r *retryableDB) UserVersion(ctx context.Context, userID string) (int, error) {
+    var version int
+    err := r.retry(ctx, "UserVersion", func() error {
+        var err error
+        version, err = r.UserStore.UserVersion(ctx, userID)
+        return err
+    })
+
+    return version, err
+}
+
+func (r *retryableDB) EmailExists(ctx context.Context, email string) (bool, error) {
+    var exists bool
+    err := r.retry(ctx, "EmailExists", func() error {
+        var err error
+        exists, err = r.UserStore.EmailExists(ctx, email)
+        return err
+    })
+
+    return exists, err
+}
+
+func (r *retryableDB) ListUsers(ctx context.Context, q listUsersQuery) ([]userRecord, bool, error) {
+    var users []userRecord
+    var partial bool
+    err := r.retry(ctx, "ListUsers", func() error {
+        var err error
+        users, partial, err = r.UserStore.ListUsers(ctx, q)
+        return err
+    })
+
+    return users, partial, err
+}
+
+func (r *retryableDB) CountUsers(ctx context.Context, f userFilter) (int, error) {
+    var total int
+    err := r.retry(ctx, "CountUsers", func() error {
+        var err error
+        total, err = r.UserStore.CountUsers(ctx, f)
+        return err
+    })
+
+    return total, err
+}
+
+// retry calls fn until it succeeds, fails with a non transient error, or the attempts run out.
+// the backoff is the same full jitter as getSettingsWithRetry.
+// like there, a config with no attempts means defaultDBRetry. otherwise fn would never run and the
+//   caller would take its zero values for a success.
+func (r *retryableDB) retry(ctx context.Context, op string, fn func() error) error {
+    rc := r.rc
+    if rc.MaxAttempts < 1 {
+        rc = defaultDBRetry
+    }
+
+    delay := rc.BaseDelay
+    var err error
+    for attempt := 1; attempt <= rc.MaxAttempts; attempt++ {
+        if err = fn(); !isTransientDBError(err) || attempt == rc.MaxAttempts {
+            return err
+        }
+
+        lf := ctxpkg.LogFields(ctx)
+        lf["db_op"] = op
+        lf["attempt"] = attempt
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Warn("transient db error. retrying")
+
+        select {
+        case <-ctx.Done():
+            return err
+        case <-time.After(time.Duration(rand.Int63n(int64(delay) + 1))):
+        }
+
+        delay *= 2
+        if delay > rc.MaxDelay {
+            delay = rc.MaxDelay
+        }
+    }
+
+    return err
+}
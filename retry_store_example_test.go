@@ -0,0 +1,100 @@
+package examplePackage
+
+import (
+    "context"
+    "database/sql/driver"
+    "fmt"
+    "syscall"
+    "testing"
+    "time"
+    errs "errors"
+)
+
+// sqlStateErr is a driver error with a SQLSTATE, like pgx's PgError.
+type sqlStateErr string
+
+func (e sqlStateErr) Error() string { return "sqlstate " + string(e) }
+func (e sqlStateErr) SQLState() string { return string(e) }
+
+func TestIsTransientDBError(t *testing.T) {
+    tests := []struct {
+        name string
+        err error
+        want bool
+    }{
+        {"nil", nil, false},
+        {"bad conn", driver.ErrBadConn, true},
+        {"wrapped bad conn", fmt.Errorf("failed to get user. %w", driver.ErrBadConn), true},
+        {"connection refused", syscall.ECONNREFUSED, true},
+        {"connection reset", syscall.ECONNRESET, true},
+        {"serialization failure", sqlStateErr("40001"), true},
+        {"deadlock", sqlStateErr("40P01"), true},
+        {"unique violation", sqlStateErr("23505"), false},
+        {"not found", fmt.Errorf("user 1. %w", errNotFound), false},
+        {"conflict", errConflict, false},
+        {"cancelled", context.Canceled, false},
+        {"deadline", fmt.Errorf("query. %w", context.DeadlineExceeded), false},
+        {"anything else", errs.New("syntax error"), false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := isTransientDBError(tt.err); got != tt.want {
+                t.Errorf("isTransientDBError(%v) = %v, want %v", tt.err, got, tt.want)
+            }
+        })
+    }
+}
+
+// countingStore fails GetUser with errs[i] on the i'th call, and succeeds after it runs out.
+type countingStore struct {
+    UserStore
+    errs []error
+    calls int
+}
+
+func (s *countingStore) GetUser(ctx context.Context, userID string) (userRecord, error) {
+    s.calls++
+    if s.calls <= len(s.errs) {
+        return userRecord{}, s.errs[s.calls-1]
+    }
+
+    return userRecord{ID: userID}, nil
+}
+
+func TestRetryableDBRetry(t *testing.T) {
+    fast := retryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+    notFound := fmt.Errorf("user 1. %w", errNotFound)
+
+    tests := []struct {
+        name string
+        rc retryConfig
+        errs []error
+        wantCalls int
+        wantErr error
+    }{
+        {"success", fast, nil, 1, nil},
+        {"non transient fails fast", fast, []error{notFound}, 1, errNotFound},
+        {"transient then success", fast, []error{driver.ErrBadConn}, 2, nil},
+        {"transient then non transient", fast, []error{driver.ErrBadConn, notFound}, 2, errNotFound},
+        {"attempts run out", fast, []error{driver.ErrBadConn, driver.ErrBadConn, driver.ErrBadConn, driver.ErrBadConn}, 3, driver.ErrBadConn},
+        // a zero config falls back to defaultDBRetry instead of never calling the store.
+        {"zero config still calls the store", retryConfig{}, []error{notFound}, 1, errNotFound},
+        {"negative attempts", retryConfig{MaxAttempts: -1}, nil, 1, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := &countingStore{errs: tt.errs}
+            r := newRetryableDB(store, tt.rc)
+
+            _, err := r.GetUser(context.Background(), "1")
+            if store.calls != tt.wantCalls {
+                t.Errorf("calls = %d, want %d", store.calls, tt.wantCalls)
+            }
+            if (tt.wantErr == nil && err != nil) || (tt.wantErr != nil && !errs.Is(err, tt.wantErr)) {
+                t.Errorf("err = %v, want %v", err, tt.wantErr)
+            }
+        })
+    }
+}
@@ -0,0 +1,213 @@
+/*
+Every route the service serves, in one place.
+
+Routes() is the single list both main() and tests register, and the OpenAPI document is generated from
+the same list (openapi_example.go), so the docs can't drift from what's actually routed.
+
+Each route declares its own middleware (auth, rate limiting, ...) right next to it, instead of the
+wrapping being spread through main().
+*/
+package examplePackage
+
+import (
+    "net/http"
+    "time"
+
+    "gihub.com/husobee/vestigo"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// Route is one method + pattern and everything about it.
+// a nil Handler means the route isn't written yet. it's registered with notImplementedHandler.
+// Middlewares wrap Handler in Chain's order. the first one is the outermost, ie. it runs first.
+// the remaining fields only describe the route for the OpenAPI document:
+// Request and Response are zero values of the body types, eg. createUserRequest{}. nil means no body.
+// Statuses are every status the handler can respond with.
+type Route struct {
+    Method string
+    Pattern string
+    Handler http.HandlerFunc
+    Middlewares []func(http.Handler) http.Handler
+    // Streaming routes write for as long as the client keeps reading, so they get no request timeout.
+    Streaming bool
+    // MaxConcurrent caps how many of this route's requests run at once. 0 means no cap. see ConcurrencyLimit.
+    MaxConcurrent int
+
+    Summary string
+    Query []string
+    Request interface{}
+    Response interface{}
+    Statuses []int
+}
+
+// Routes returns every route. c.createLimiter and c.inFlight must be set first.
+func (c *Controller) Routes() []Route {
+    type mw = func(http.Handler) http.Handler
+
+    // i include versions in the routes from the start so versioning is easier to manage moving forward.
+    return []Route{
+        // CreateUser is the endpoint most worth abusing, so it's rate limited per client ip.
+        {Method: http.MethodPost, Pattern: "/v1/user", Handler: c.CreateUserHandler,
+            Middlewares: []mw{c.createLimiter.middleware},
+            Summary: "Create a user. ?dry_run=true only validates", Query: []string{"dry_run"},
+            Request: createUserRequest{}, Response: createUserResponse{},
+            Statuses: []int{http.StatusCreated, http.StatusOK, http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+        {Method: http.MethodGet, Pattern: "/v1/ratelimit", Handler: c.createLimiter.StatusHandler,
+            Summary: "The caller's rate limit status", Response: rateLimitStatus{},
+            Statuses: []int{http.StatusOK}},
+
+        // reloading settings changes how the service behaves, so both reload routes require the api key.
+        // /v1/update-settings is the original name for the same action. it's kept so existing callers don't break.
+        {Method: http.MethodPost, Pattern: "/v1/settings/reload", Handler: c.ReloadSettingsHandler,
+            Middlewares: []mw{c.RequireAPIKey},
+            Summary: "Reload settings", Response: reloadSettingsResponse{},
+            Statuses: []int{http.StatusOK, http.StatusUnauthorized, http.StatusInternalServerError}},
+        {Method: http.MethodPost, Pattern: "/v1/update-settings", Handler: c.UpdateUserSettingsHandler,
+            Middlewares: []mw{c.RequireAPIKey},
+            Summary: "Reload settings (original name)",
+            Statuses: []int{http.StatusOK, http.StatusUnauthorized, http.StatusInternalServerError}},
+        {Method: http.MethodGet, Pattern: "/v1/settings", Handler: c.GetSettingsHandler,
+            Summary: "Current settings", Response: userSettingsData{},
+            Statuses: []int{http.StatusOK, http.StatusNotModified, http.StatusInternalServerError}},
+
+        // the load balancer's health check. it starts failing when shutdown begins.
+        {Method: http.MethodGet, Pattern: "/readyz", Handler: c.inFlight.ReadyzHandler,
+            Summary: "Readiness for traffic",
+            Statuses: []int{http.StatusOK, http.StatusServiceUnavailable}},
+
+        // pool stats are operational detail, so they're behind the api key like the settings routes.
+        {Method: http.MethodGet, Pattern: "/debug/db", Handler: c.DBStatsHandler,
+            Middlewares: []mw{c.RequireAPIKey},
+            Summary: "Database connection pool stats", Response: dbPoolStats{},
+            Statuses: []int{http.StatusOK, http.StatusUnauthorized}},
+
+        {Method: http.MethodGet, Pattern: "/v1/schemas/create-user", Handler: c.SchemaHandler,
+            Summary: "JSON Schema for creating a user",
+            Statuses: []int{http.StatusOK, http.StatusNotModified}},
+        {Method: http.MethodGet, Pattern: "/openapi.json", Handler: c.OpenAPIHandler,
+            Summary: "This document",
+            Statuses: []int{http.StatusOK, http.StatusNotModified}},
+
+        {Method: http.MethodGet, Pattern: "/v1/user/:user_id", Handler: c.GetUserHandler,
+            Summary: "Get a user", Query: []string{"fields", "include_deleted"}, Response: userRecord{},
+            Statuses: []int{http.StatusOK, http.StatusNotModified, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError}},
+        {Method: http.MethodHead, Pattern: "/v1/user/:user_id", Handler: c.HeadUserHandler,
+            Summary: "Check a user exists and get its ETag",
+            Statuses: []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError}},
+        // updates need If-Match with the ETag from the GET. see user_handler_example.go.
+        {Method: http.MethodPatch, Pattern: "/v1/user/:user_id", Handler: c.UpdateUserHandler,
+            Summary: "Update a user. requires If-Match", Request: map[string]interface{}{}, Response: userRecord{},
+            Statuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusPreconditionRequired, http.StatusInternalServerError}},
+        // PUT replaces the whole user. the body is validated like a create, but without email and password.
+        {Method: http.MethodPut, Pattern: "/v1/user/:user_id", Handler: c.ReplaceUserHandler,
+            Summary: "Replace a user, except email and password, which are a 400. requires If-Match", Request: createUserRequest{}, Response: userRecord{},
+            Statuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusPreconditionRequired, http.StatusInternalServerError}},
+        // to demonstrate RESTful API design, i include this route but the logic isn't provided here.
+        //   with no Handler it's a 501 until it is.
+        // deleting a user requires the users:delete scope from the caller's token.
+        {Method: http.MethodDelete, Pattern: "/v1/user/:user_id",
+            Middlewares: []mw{RequireScope("users:delete")},
+            Summary: "Delete a user",
+            Statuses: []int{http.StatusNoContent, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusNotImplemented}},
+
+        // restoring is the admin's undo for a delete.
+        {Method: http.MethodPost, Pattern: "/v1/user/:user_id/restore", Handler: c.RestoreUserHandler,
+            Middlewares: []mw{RequireScope(adminScope)},
+            Summary: "Restore a deleted user", Response: userRecord{},
+            Statuses: []int{http.StatusOK, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError}},
+
+        // pagination is handled with query params. eg. /v1/users?limit=10&offset=5
+        // see list_handler_example.go.
+        // the list is streaming because it can be asked for as ndjson. GetAllUsersHandler gives every
+        //   other kind of list request the default timeout itself.
+        // the routes that hold a database connection the longest are capped, so a spike on them can't
+        //   take every connection in the pool (DBConfig.MaxOpenConns is 25 by default).
+        {Method: http.MethodGet, Pattern: "/v1/users", Handler: c.GetAllUsersHandler, Streaming: true, MaxConcurrent: 20,
+            Summary: "List users. ?ids=a,b,c fetches up to 100 users by id instead", Query: []string{"limit", "offset", "cursor", "sort", "state", "city", "partial", "include_deleted", "ids"}, Response: listUsersResponse{},
+            Statuses: []int{http.StatusOK, http.StatusPartialContent, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+        {Method: http.MethodGet, Pattern: "/v1/users/count", Handler: c.CountUsersHandler,
+            Summary: "Count users", Query: []string{"state", "city", "include_deleted"}, Response: countUsersResponse{},
+            Statuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError}},
+        {Method: http.MethodGet, Pattern: "/v1/users/export", Handler: c.ExportUsersHandler, Streaming: true, MaxConcurrent: 2,
+            Summary: "Export users as csv", Query: []string{"state", "city", "include_deleted"},
+            Statuses: []int{http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusServiceUnavailable}},
+        {Method: http.MethodPost, Pattern: "/v1/users/bulk", Handler: c.BulkCreateUsersHandler, MaxConcurrent: 5,
+            Middlewares: []mw{c.createLimiter.middleware},
+            Summary: "Create many users, all or nothing", Query: []string{"fail_fast"}, Request: []createUserRequest{}, Response: []createUserResponse{},
+            Statuses: []int{http.StatusCreated, http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+        {Method: http.MethodPatch, Pattern: "/v1/users/bulk", Handler: c.BulkUpdateUsersHandler, MaxConcurrent: 5,
+            Summary: "Update many users", Query: []string{"fail_fast"}, Request: []userPatch{}, Response: []bulkResult{},
+            Statuses: []int{http.StatusMultiStatus, http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+    }
+}
+
+// RegisterRoutes adds every route to router with its middleware applied.
+func RegisterRoutes(router *vestigo.Router, routes []Route) {
+    for _, r := range routes {
+        handler := r.Handler
+        if handler == nil {
+            handler = notImplementedHandler(r.Method + " " + r.Pattern)
+        }
+        h := Chain(r.Middlewares...)(handler)
+
+        // vestigo wants an http.HandlerFunc, so the wrapped handler is passed as its ServeHTTP method.
+        router.Add(r.Method, r.Pattern, h.ServeHTTP)
+    }
+}
+
+// withTracing returns routes with a span around each one, named after its pattern.
+// tracing goes outside the route's own middleware so a request rejected by auth or the rate limiter
+//   still shows up in traces.
+func withTracing(tp trace.TracerProvider, routes []Route) []Route {
+    traced := make([]Route, len(routes))
+    for i, r := range routes {
+        r.Middlewares = append([]func(http.Handler) http.Handler{TracingMiddleware(tp, r.Pattern)}, r.Middlewares...)
+        traced[i] = r
+    }
+
+    return traced
+}
+
+// withWriteDrain puts t's WriteDrainMiddleware on every route that can change something, ie. every
+//   POST, PUT, PATCH and DELETE. it goes first so a drained write doesn't even get as far as auth.
+func withWriteDrain(t *inFlightTracker, routes []Route) []Route {
+    drained := make([]Route, len(routes))
+    for i, r := range routes {
+        switch r.Method {
+        case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+            r.Middlewares = append([]func(http.Handler) http.Handler{t.WriteDrainMiddleware}, r.Middlewares...)
+        }
+        drained[i] = r
+    }
+
+    return drained
+}
+
+// withConcurrencyLimits adds a ConcurrencyLimit to every route with a MaxConcurrent.
+// it goes after the route's own middleware, so a request turned away by auth or the rate limiter
+//   never takes a slot.
+func withConcurrencyLimits(routes []Route) []Route {
+    limited := make([]Route, len(routes))
+    for i, r := range routes {
+        if r.MaxConcurrent > 0 {
+            r.Middlewares = append(append([]func(http.Handler) http.Handler{}, r.Middlewares...), ConcurrencyLimit(r.MaxConcurrent))
+        }
+        limited[i] = r
+    }
+
+    return limited
+}
+
+// withRequestTimeout gives every route except the streaming ones a deadline d. see RequestTimeout.
+// it goes in front of the route's own middleware so auth and rate limiting count against the budget too.
+func withRequestTimeout(d time.Duration, routes []Route) []Route {
+    timed := make([]Route, len(routes))
+    for i, r := range routes {
+        if !r.Streaming {
+            r.Middlewares = append([]func(http.Handler) http.Handler{RequestTimeout(d)}, r.Middlewares...)
+        }
+        timed[i] = r
+    }
+
+    return timed
+}
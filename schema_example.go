@@ -0,0 +1,211 @@
+/*
+A JSON Schema for createUserRequest, served at GET /v1/schemas/create-user so clients can validate
+a form before it's submitted.
+
+The schema is built from the struct itself, not written by hand:
+- properties and their types come from the json tags and the Go field types.
+- a field is required unless its json tag has omitempty.
+- the constraints validateCreateUserRequest enforces are repeated in createUserSchemaRules. a change
+  to one needs the same change to the other.
+
+It's built once at startup. the struct can't change while the process runs.
+*/
+package examplePackage
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+)
+
+const mediaTypeSchema = "application/schema+json"
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) we need.
+// the numeric constraints are pointers so a real 0 isn't dropped by omitempty.
+type jsonSchema struct {
+    Schema string `json:"$schema,omitempty"`
+    Title string `json:"title,omitempty"`
+    // Ref points at a shared schema (eg. in an OpenAPI document's components) instead of repeating it.
+    Ref string `json:"$ref,omitempty"`
+    // Type is empty for a value that can be anything, eg. an interface{} field.
+    Type string `json:"type,omitempty"`
+    Properties map[string]*jsonSchema `json:"properties,omitempty"`
+    Items *jsonSchema `json:"items,omitempty"`
+    Required []string `json:"required,omitempty"`
+    MinLength *int `json:"minLength,omitempty"`
+    MaxLength *int `json:"maxLength,omitempty"`
+    Minimum *int `json:"minimum,omitempty"`
+    Maximum *int `json:"maximum,omitempty"`
+    Pattern string `json:"pattern,omitempty"`
+    Format string `json:"format,omitempty"`
+    Enum []string `json:"enum,omitempty"`
+}
+
+func intPtr(i int) *int {
+    return &i
+}
+
+// createUserSchemaRules mirrors validateCreateUserRequest. the key is the json field name.
+var createUserSchemaRules = map[string]func(s *jsonSchema){
+    // the max lengths are read when the schema is built, so they reflect SetFieldLimits.
+    "full_name": func(s *jsonSchema) {
+        s.MinLength = intPtr(1)
+        s.MaxLength = intPtr(maxFullNameLength)
+    },
+    "address": func(s *jsonSchema) {
+        s.MinLength = intPtr(1)
+        s.MaxLength = intPtr(maxAddressLength)
+    },
+    "city": func(s *jsonSchema) {
+        s.MinLength = intPtr(1)
+        s.MaxLength = intPtr(maxCityLength)
+    },
+    "state": func(s *jsonSchema) {
+        s.MinLength = intPtr(2)
+        s.MaxLength = intPtr(2)
+        s.Enum = sortedStates()
+    },
+    "zip_code": func(s *jsonSchema) {
+        s.Minimum = intPtr(1)
+        s.Maximum = intPtr(99999)
+    },
+    // the server strips spaces and dashes before checking, so the schema describes the stored form.
+    "phone": func(s *jsonSchema) { s.Pattern = e164Pattern.String() },
+    "email": func(s *jsonSchema) { s.Format = "email" },
+    // maxLength counts characters and the real limit is bytes, so this is only exact for ascii.
+    "password": func(s *jsonSchema) { s.MaxLength = intPtr(maxPasswordBytes) },
+}
+
+// sortedStates returns validStates' keys in order, so the schema is the same on every start.
+func sortedStates() []string {
+    states := make([]string, 0, len(validStates))
+    for st := range validStates {
+        states = append(states, st)
+    }
+    sort.Strings(states)
+
+    return states
+}
+
+// cachedSchema is a schema (or any document describing the api) marshaled once, with its ETag.
+type cachedSchema struct {
+    body []byte
+    etag string
+}
+
+// newCreateUserSchema builds and marshals the createUserRequest schema.
+func newCreateUserSchema() (cachedSchema, error) {
+    s := schemaFor(reflect.TypeOf(createUserRequest{}), createUserSchemaRules)
+    s.Schema = "https://json-schema.org/draft/2020-12/schema"
+    s.Title = "createUserRequest"
+
+    return newCachedSchema(s)
+}
+
+// newCachedSchema marshals v once so every request can reuse the bytes.
+func newCachedSchema(v interface{}) (cachedSchema, error) {
+    body, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return cachedSchema{}, err
+    }
+
+    etag, err := computeETag(v)
+    if err != nil {
+        return cachedSchema{}, err
+    }
+
+    return cachedSchema{body: body, etag: etag}, nil
+}
+
+// schemaFor describes the exported, json visible fields of struct type t.
+func schemaFor(t reflect.Type, rules map[string]func(*jsonSchema)) *jsonSchema {
+    s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        tag := f.Tag.Get("json")
+        if !f.IsExported() || tag == "-" {
+            continue
+        }
+
+        name := fieldName(f)
+        prop := schemaOf(f.Type)
+        if rule, ok := rules[name]; ok {
+            rule(prop)
+        }
+        s.Properties[name] = prop
+
+        if !strings.Contains(tag, ",omitempty") {
+            s.Required = append(s.Required, name)
+        }
+    }
+
+    return s
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf describes any type. structs and slices are described all the way down.
+func schemaOf(t reflect.Type) *jsonSchema {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+
+    if t == timeType {
+        return &jsonSchema{Type: "string", Format: "date-time"}
+    }
+
+    switch t.Kind() {
+    case reflect.Struct:
+        return schemaFor(t, nil)
+    case reflect.Slice, reflect.Array:
+        // encoding/json writes []byte as a base64 string.
+        if t.Elem().Kind() == reflect.Uint8 {
+            return &jsonSchema{Type: "string", Format: "byte"}
+        }
+        return &jsonSchema{Type: "array", Items: schemaOf(t.Elem())}
+    case reflect.Interface:
+        return &jsonSchema{}
+    }
+
+    return &jsonSchema{Type: schemaType(t.Kind())}
+}
+
+// schemaType maps a Go kind to a JSON Schema type.
+func schemaType(k reflect.Kind) string {
+    switch k {
+    case reflect.Bool:
+        return "boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "integer"
+    case reflect.Float32, reflect.Float64:
+        return "number"
+    case reflect.Slice, reflect.Array:
+        return "array"
+    case reflect.Struct, reflect.Map:
+        return "object"
+    }
+
+    return "string"
+}
+
+// GET /v1/schemas/create-user
+func (c *Controller) SchemaHandler(rw http.ResponseWriter, req *http.Request) {
+    c.createUserSchema.serve(rw, req, mediaTypeSchema)
+}
+
+// serve writes the cached document as the body itself, not wrapped in response.Success, because schema
+//   tooling expects the document at the top level.
+func (cs cachedSchema) serve(rw http.ResponseWriter, req *http.Request, contentType string) {
+    if notModified(rw, req, cs.etag) {
+        return
+    }
+
+    rw.Header().Set("Content-Type", contentType)
+    rw.WriteHeader(http.StatusOK)
+    rw.Write(cs.body)
+}
@@ -0,0 +1,107 @@
+/*
+Response formats are pluggable. Each format is a Serializer registered under its media type, and
+the negotiator (negotiate_example.go) looks the Accept header's media types up in the registry.
+
+Adding a format is one RegisterSerializer call. No handler changes, and nothing in Respond changes.
+*/
+package examplePackage
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "io"
+    "strings"
+    "sync"
+)
+
+// Serializer writes v to w in one format.
+// pretty asks for human readable output. a format that has no such thing can ignore it.
+type Serializer interface {
+    Serialize(w io.Writer, v interface{}, pretty bool) error
+}
+
+// SerializerFunc lets a plain function be a Serializer, the same way http.HandlerFunc works for handlers.
+type SerializerFunc func(w io.Writer, v interface{}, pretty bool) error
+
+func (f SerializerFunc) Serialize(w io.Writer, v interface{}, pretty bool) error {
+    return f(w, v, pretty)
+}
+
+// serializerRegistry maps media types to serializers.
+// registration normally happens at startup, but the lock means it's also safe while requests are served.
+type serializerRegistry struct {
+    mu sync.RWMutex
+    byType map[string]Serializer
+}
+
+var serializers = serializerRegistry{byType: make(map[string]Serializer)}
+
+// RegisterSerializer makes mediaType available to Respond.
+// registering a nil Serializer reserves the media type without an implementation. Respond then falls back
+//   to json for it (see fallbackToJSON) instead of writing an empty body.
+func RegisterSerializer(mediaType string, s Serializer) {
+    serializers.mu.Lock()
+    serializers.byType[mediaType] = s
+    serializers.mu.Unlock()
+}
+
+// lookupSerializer returns the serializer for mediaType. ok is false when nothing is registered,
+//   and the Serializer can be nil even when ok is true.
+func lookupSerializer(mediaType string) (Serializer, bool) {
+    serializers.mu.RLock()
+    defer serializers.mu.RUnlock()
+
+    s, ok := serializers.byType[mediaType]
+    return s, ok
+}
+
+// lookupWildcard finds a registered media type starting with prefix (eg. "application/").
+// json is preferred when it matches, since it's the default everywhere else. otherwise the
+//   alphabetically first match is used so the choice is the same on every request.
+func lookupWildcard(prefix string) (string, bool) {
+    if strings.HasPrefix(mediaTypeJSON, prefix) {
+        return mediaTypeJSON, true
+    }
+
+    serializers.mu.RLock()
+    defer serializers.mu.RUnlock()
+
+    match := ""
+    for mt, s := range serializers.byType {
+        if s != nil && strings.HasPrefix(mt, prefix) && (match == "" || mt < match) {
+            match = mt
+        }
+    }
+
+    return match, match != ""
+}
+
+var jsonSerializer = SerializerFunc(func(w io.Writer, v interface{}, pretty bool) error {
+    enc := json.NewEncoder(w)
+    if pretty {
+        enc.SetIndent("", "  ")
+    }
+    return enc.Encode(v)
+})
+
+var xmlSerializer = SerializerFunc(func(w io.Writer, v interface{}, pretty bool) error {
+    enc := xml.NewEncoder(w)
+    if pretty {
+        enc.Indent("", "  ")
+    }
+    return enc.Encode(v)
+})
+
+// ndjsonSerializer writes v as a single json line. lists are streamed a line per record by the list
+//   handler instead, so this only covers single objects sent to an ndjson client.
+var ndjsonSerializer = SerializerFunc(func(w io.Writer, v interface{}, pretty bool) error {
+    // pretty is ignored. an indented object would span lines, which isn't ndjson.
+    return json.NewEncoder(w).Encode(v)
+})
+
+func init() {
+    RegisterSerializer(mediaTypeJSON, jsonSerializer)
+    RegisterSerializer(mediaTypeNDJSON, ndjsonSerializer)
+    RegisterSerializer(mediaTypeXML, xmlSerializer)
+    RegisterSerializer("text/xml", xmlSerializer)
+}
@@ -0,0 +1,41 @@
+package examplePackage
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// registerTestSerializer registers s under mediaType until the test ends.
+func registerTestSerializer(t *testing.T, mediaType string, s Serializer) {
+    RegisterSerializer(mediaType, s)
+    t.Cleanup(func() {
+        serializers.mu.Lock()
+        delete(serializers.byType, mediaType)
+        serializers.mu.Unlock()
+    })
+}
+
+// a registered format is picked from Accept and used by Respond, with no other changes.
+func TestRegisterSerializer(t *testing.T) {
+    const mediaType = "text/x-user"
+    registerTestSerializer(t, mediaType, SerializerFunc(func(w io.Writer, v interface{}, pretty bool) error {
+        _, err := fmt.Fprintf(w, "user %s", v.(createUserResponse).ID)
+        return err
+    }))
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/user/1", nil)
+    req.Header.Set("Accept", "application/xml;q=0.5, "+mediaType)
+    n := getNegotiator(req)
+    if n.MediaType() != mediaType {
+        t.Fatalf("MediaType() = %q, want %q", n.MediaType(), mediaType)
+    }
+
+    rw := httptest.NewRecorder()
+    n.Respond(rw, http.StatusOK, createUserResponse{ID: "1"})
+    if rw.Header().Get("Content-Type") != mediaType || rw.Body.String() != "user 1" {
+        t.Errorf("got %q %q, want %q %q", rw.Header().Get("Content-Type"), rw.Body.String(), mediaType, "user 1")
+    }
+}
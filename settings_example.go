@@ -0,0 +1,389 @@
+/*
+Helpers for the settings loaded in InitializeUserSettings (http_handler_example.go).
+*/
+package examplePackage
+
+import (
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "math/rand"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "time"
+
+    "github.com/fsnotify/fsnotify"
+    "github.com/sirupsen/logrus"
+)
+
+// editors and config management often write a file several times in a row. reloading is held off until
+//   the file has been quiet this long so those writes turn into one reload.
+const settingsReloadDebounce = 500 * time.Millisecond
+
+// SettingsClient is the one method the Controller uses from the private settings client.
+// settings.NewClient() satisfies it. depending on the interface instead of the concrete client means
+//   InitializeUserSettings can be tested without the settings service.
+type SettingsClient interface {
+    Get(v interface{}) error
+}
+
+// retryConfig controls getSettingsWithRetry.
+// the delay doubles after every failed attempt, starting at BaseDelay and never exceeding MaxDelay.
+type retryConfig struct {
+    MaxAttempts int
+    BaseDelay time.Duration
+    MaxDelay time.Duration
+}
+
+// defaultSettingsRetry gives the settings service roughly 15 seconds to come up.
+var defaultSettingsRetry = retryConfig{
+    MaxAttempts: 6,
+    BaseDelay: 500 * time.Millisecond,
+    MaxDelay: 5 * time.Second,
+}
+
+// settingsAlias has the same fields as userSettingsData but none of its methods.
+// the marshalers below convert to it so json.Marshal doesn't call MarshalJSON again forever.
+type settingsAlias userSettingsData
+
+// apiKey is the only way to read the real key. it's unexported so only this package can.
+func (usd userSettingsData) apiKey() string {
+    return usd.APIKey
+}
+
+// masked returns a copy with all but the last 4 characters of the api key replaced.
+// the last 4 are enough for an operator to tell which key is loaded.
+func (usd userSettingsData) masked() settingsAlias {
+    if n := len(usd.APIKey); n > 4 {
+        usd.APIKey = strings.Repeat("*", n-4) + usd.APIKey[n-4:]
+    } else {
+        usd.APIKey = strings.Repeat("*", n)
+    }
+
+    return settingsAlias(usd)
+}
+
+// MarshalJSON masks the api key every time the settings are sent to a client.
+// it has a value receiver so both userSettingsData and *userSettingsData are masked.
+func (usd userSettingsData) MarshalJSON() ([]byte, error) {
+    return json.Marshal(usd.masked())
+}
+
+// MarshalXML does the same for clients that negotiated xml.
+func (usd userSettingsData) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+    return e.EncodeElement(usd.masked(), start)
+}
+
+// String masks the api key when settings are logged with %v or %s.
+func (usd userSettingsData) String() string {
+    return fmt.Sprintf("%+v", usd.masked())
+}
+
+// the shortest api key accepted. anything shorter is guessable.
+const minAPIKeyLength = 16
+
+// Validate checks invariants between settings that a required tag can't express.
+// a value receiver because validating must never change the settings.
+func (usd userSettingsData) Validate() error {
+    if usd.Enabled && len(usd.APIKey) < minAPIKeyLength {
+        return fmt.Errorf("api_key must be at least %d characters when enabled", minAPIKeyLength)
+    }
+
+    // empty is allowed. it's the default.
+    if usd.TrailingSlash != "" && !trailingSlashPolicies[usd.TrailingSlash] {
+        return fmt.Errorf("trailing_slash must be redirect, rewrite or reject, got %q", usd.TrailingSlash)
+    }
+
+    return nil
+}
+
+// validateRequired checks every field tagged `required:"true"` is not its zero value.
+// v must be a struct (or a pointer to one).
+//
+// it uses reflection so adding a new required setting is just adding the tag. there's no
+//   validator function to remember to edit.
+// reflection is slow compared to plain field access, but settings are loaded rarely, so it doesn't matter here.
+// i wouldn't use this on a per-request path.
+func validateRequired(v interface{}) error {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() == reflect.Ptr {
+        rv = rv.Elem()
+    }
+
+    if rv.Kind() != reflect.Struct {
+        return fmt.Errorf("validateRequired expects a struct, got %s", rv.Kind())
+    }
+
+    missing := make([]string, 0, rv.NumField())
+    rt := rv.Type()
+    for i := 0; i < rt.NumField(); i++ {
+        f := rt.Field(i)
+        if f.Tag.Get("required") != "true" {
+            continue
+        }
+
+        if rv.Field(i).IsZero() {
+            missing = append(missing, fieldName(f))
+        }
+    }
+
+    if len(missing) > 0 {
+        return fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+    }
+
+    return nil
+}
+
+// DefaultSettings is what applyDefaults fills in for a setting left out. a zero field here means that
+//   setting has no default and its zero value stands.
+// it's a var so a deployment (or a test) can change the defaults before settings are loaded.
+//
+// a default only suits a setting whose zero value means nothing, like a pool size of 0. a setting
+//   where 0 or false is a real choice has to be a pointer (eg. LogSampleRate) so it can be told
+//   apart from left out.
+var DefaultSettings = userSettingsData{
+    DB: defaultDBConfig,
+    LogSampleRate: func() *float64 { r := defaultLogSampleRate; return &r }(),
+    TrailingSlash: trailingSlashRedirect,
+}
+
+// applyDefaults sets every zero field in usd to the same field in defaults and returns the names of
+//   the ones it set, eg. "db.max_open_conns". struct fields (eg. DB) are filled field by field, so a
+//   partial db config keeps what it has.
+// it's reflection for the same reason as validateRequired: a new setting only needs a default
+//   added to DefaultSettings.
+func applyDefaults(usd *userSettingsData, defaults userSettingsData) []string {
+    return fillZeroFields(reflect.ValueOf(usd).Elem(), reflect.ValueOf(defaults), "")
+}
+
+func fillZeroFields(dst, src reflect.Value, prefix string) []string {
+    applied := []string{}
+    rt := dst.Type()
+    for i := 0; i < rt.NumField(); i++ {
+        f := rt.Field(i)
+        // unexported fields can't be set by reflection.
+        if f.PkgPath != "" {
+            continue
+        }
+
+        name := prefix + fieldName(f)
+        d, s := dst.Field(i), src.Field(i)
+        if d.Kind() == reflect.Struct {
+            applied = append(applied, fillZeroFields(d, s, name+".")...)
+            continue
+        }
+
+        if d.IsZero() && !s.IsZero() {
+            d.Set(s)
+            applied = append(applied, name)
+        }
+    }
+
+    return applied
+}
+
+// fieldName returns the json name of a struct field since that's what the settings service calls it.
+// it falls back to the Go name when there's no json tag.
+func fieldName(f reflect.StructField) string {
+    name := strings.Split(f.Tag.Get("json"), ",")[0]
+    if name == "" || name == "-" {
+        return f.Name
+    }
+
+    return name
+}
+
+// getSettings calls settingsClient.Get but stops waiting when ctx is done.
+// the private client's Get doesn't take a context, so it runs in a goroutine and fills its own copy.
+//   if ctx wins, that goroutine finishes in the background and its result is thrown away, never
+//   written into usd while the caller might be reading it.
+func (c *Controller) getSettings(ctx context.Context, usd *userSettingsData) error {
+    type result struct {
+        usd userSettingsData
+        err error
+    }
+
+    // buffered, so the goroutine can always send and exit even when nobody is receiving anymore.
+    done := make(chan result, 1)
+    go func() {
+        r := result{}
+        r.err = c.settingsClient.Get(&r.usd)
+        done <- r
+    }()
+
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case r := <-done:
+        if r.err == nil {
+            *usd = r.usd
+        }
+        return r.err
+    }
+}
+
+// getSettingsWithRetry calls settingsClient.Get until it succeeds, the attempts run out, or ctx is done.
+// a transient blip in the settings service (eg. both services starting at once during a deploy)
+//   shouldn't take this service down.
+func (c *Controller) getSettingsWithRetry(ctx context.Context, usd *userSettingsData) error {
+    rc := c.settingsRetry
+    if rc.MaxAttempts < 1 {
+        rc = defaultSettingsRetry
+    }
+
+    delay := rc.BaseDelay
+    var err error
+    for attempt := 1; attempt <= rc.MaxAttempts; attempt++ {
+        if err = c.getSettings(ctx, usd); err == nil {
+            return nil
+        }
+
+        if attempt == rc.MaxAttempts {
+            break
+        }
+
+        logrus.WithError(err).WithField("attempt", attempt).Warn("failed to get user settings. retrying")
+
+        // full jitter: sleep a random amount up to delay. if several instances start together, they
+        //   spread their retries out instead of hitting the settings service in lock step.
+        sleep := time.Duration(rand.Int63n(int64(delay) + 1))
+
+        // a select instead of time.Sleep so a cancelled ctx (eg. shutdown) stops waiting immediately.
+        select {
+        case <-ctx.Done():
+            return fmt.Errorf("gave up getting user settings. %s. %w", ctx.Err(), errInternal)
+        case <-time.After(sleep):
+        }
+
+        delay *= 2
+        if delay > rc.MaxDelay {
+            delay = rc.MaxDelay
+        }
+    }
+
+    return fmt.Errorf("failed to get user settings after %d attempts. %s. %w", rc.MaxAttempts, err, errInternal)
+}
+
+// WatchSettingsFile reloads settings whenever the file at path changes, until ctx is done.
+//
+// the directory is watched instead of the file. kubernetes updates a mounted configmap by swapping a
+//   symlink, which a watch on the file itself never sees.
+// a failed reload is logged and the last good settings stay in place. InitializeUserSettings only
+//   calls setSettings once the new settings are fetched and validated.
+func (c *Controller) WatchSettingsFile(ctx context.Context, path string) error {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return fmt.Errorf("failed to create settings watcher. %w", err)
+    }
+    defer watcher.Close()
+
+    if err := watcher.Add(filepath.Dir(path)); err != nil {
+        return fmt.Errorf("failed to watch %s. %w", path, err)
+    }
+
+    reload := func() {
+        if err := c.InitializeUserSettings(ctx); err != nil {
+            logrus.WithError(err).Error("failed to reload settings from file. keeping the last good settings")
+            return
+        }
+        logrus.WithField("path", path).Info("reloaded settings from file")
+    }
+
+    // the timer is created stopped. every event resets it, so reload only runs once events stop.
+    debounce := time.AfterFunc(time.Hour, reload)
+    debounce.Stop()
+    defer debounce.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return nil
+            }
+
+            // a configmap update shows up as a create, not a write, so both count.
+            if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+                debounce.Reset(settingsReloadDebounce)
+            }
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return nil
+            }
+            logrus.WithError(err).Warn("settings watcher error")
+        }
+    }
+}
+
+// startupPolicy is what main does when settings can't be loaded at startup. it comes from
+//   SETTINGS_STARTUP_POLICY in the environment, since it can't come from the settings themselves.
+type startupPolicy string
+
+const (
+    // startupStrict panics, so a deploy fails instead of running without its settings.
+    startupStrict startupPolicy = "strict"
+    // startupLenient starts with the zero settings, where Enabled is false, and keeps trying to load
+    //   them in the background. until they load, the handlers gated on Enabled respond 503 SERVICE_DISABLED.
+    startupLenient startupPolicy = "lenient"
+)
+
+// parseStartupPolicy defaults to strict, which is how startup behaved before there was a policy.
+func parseStartupPolicy(s string) startupPolicy {
+    switch startupPolicy(strings.ToLower(strings.TrimSpace(s))) {
+    case "", startupStrict:
+        return startupStrict
+    case startupLenient:
+        return startupLenient
+    default:
+        logrus.WithField("policy", s).Warn("unknown settings startup policy. using strict")
+        return startupStrict
+    }
+}
+
+// LoadSettingsAtStartup is InitializeUserSettings for main.
+// under startupLenient a failure is logged instead of returned, and the settings keep being retried
+//   in the background until they load or ctx is done.
+func (c *Controller) LoadSettingsAtStartup(ctx context.Context, policy startupPolicy) error {
+    err := c.InitializeUserSettings(ctx)
+    if err == nil || policy != startupLenient {
+        return err
+    }
+
+    logrus.WithError(err).Error("failed to load user settings. starting disabled and retrying in the background")
+    // Enabled is false in the defaults, so nothing gated on it runs until the real settings load.
+    usd := userSettingsData{}
+    applyDefaults(&usd, DefaultSettings)
+    c.setSettings(usd)
+    go c.retrySettingsUntilLoaded(ctx)
+
+    return nil
+}
+
+// retrySettingsUntilLoaded keeps calling InitializeUserSettings, waiting the retry config's MaxDelay
+//   between rounds. each round is already getSettingsWithRetry's full set of attempts.
+func (c *Controller) retrySettingsUntilLoaded(ctx context.Context) {
+    rc := c.settingsRetry
+    if rc.MaxAttempts < 1 {
+        rc = defaultSettingsRetry
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(rc.MaxDelay):
+        }
+
+        if err := c.InitializeUserSettings(ctx); err != nil {
+            logrus.WithError(err).Warn("still failed to load user settings")
+            continue
+        }
+
+        // the pool was tuned with the defaults at startup and stays that way until a restart.
+        logrus.Info("loaded user settings in the background")
+        return
+    }
+}
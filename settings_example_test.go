@@ -0,0 +1,150 @@
+package examplePackage
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    errs "errors"
+)
+
+// fakeSettingsClient is a SettingsClient for tests. Get copies Data into the caller's struct, or returns
+//   Err when it's set.
+type fakeSettingsClient struct {
+    Data userSettingsData
+    Err error
+    // Calls counts Get calls, eg. to check retries. getSettings calls Get on its own goroutine, so it's
+    //   only touched atomically.
+    Calls int32
+}
+
+func (f *fakeSettingsClient) Get(v interface{}) error {
+    atomic.AddInt32(&f.Calls, 1)
+    if f.Err != nil {
+        return f.Err
+    }
+
+    usd, ok := v.(*userSettingsData)
+    if !ok {
+        return fmt.Errorf("fakeSettingsClient can only fill *userSettingsData, got %T", v)
+    }
+    *usd = f.Data
+
+    return nil
+}
+
+func TestGetSettingsWithRetry(t *testing.T) {
+    retry := retryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+    tests := []struct {
+        name string
+        err error
+        wantCalls int32
+        wantErr bool
+    }{
+        {"first try", nil, 1, false},
+        {"every try fails", errs.New("settings service unavailable"), 3, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fake := &fakeSettingsClient{Data: DefaultSettings, Err: tt.err}
+            c := &Controller{settingsClient: fake, settingsRetry: retry}
+
+            usd := userSettingsData{}
+            err := c.getSettingsWithRetry(context.Background(), &usd)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("getSettingsWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if err != nil && !errs.Is(err, errInternal) {
+                t.Errorf("error %v isn't an errInternal", err)
+            }
+            if calls := atomic.LoadInt32(&fake.Calls); calls != tt.wantCalls {
+                t.Errorf("Get called %d times, want %d", calls, tt.wantCalls)
+            }
+        })
+    }
+}
+
+// reloads replace the settings on another goroutine while requests read them. run with -race.
+func TestSettingsReloadWhileServing(t *testing.T) {
+    c := &Controller{}
+    c.setSettings(DefaultSettings)
+
+    h := c.FeatureFlagsMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 100; i++ {
+            usd := DefaultSettings
+            usd.Enabled = i%2 == 0
+            usd.FeatureFlags = map[string]bool{"new_list": i%2 == 0}
+            c.setSettings(usd)
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        for i := 0; i < 100; i++ {
+            h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+            _ = c.logSampleRate()
+            _ = c.trailingSlashPolicy()
+        }
+    }()
+    wg.Wait()
+}
+
+func TestValidateRequired(t *testing.T) {
+    err := validateRequired(userSettingsData{Enabled: true})
+    if err == nil || !strings.Contains(err.Error(), "api_key") {
+        t.Errorf("validateRequired() without an api key = %v, want an error naming api_key", err)
+    }
+
+    if err := validateRequired(&userSettingsData{APIKey: "0123456789abcdef"}); err != nil {
+        t.Errorf("validateRequired() with an api key = %v, want nil", err)
+    }
+}
+
+// a poller that sends back the ETag gets a 304 until the settings change.
+func TestGetSettingsETag(t *testing.T) {
+    c := &Controller{}
+    c.setSettings(DefaultSettings)
+
+    get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, "/v1/settings", nil)
+        if ifNoneMatch != "" {
+            req.Header.Set("If-None-Match", ifNoneMatch)
+        }
+        rw := httptest.NewRecorder()
+        c.GetSettingsHandler(rw, req)
+        return rw
+    }
+
+    first := get("")
+    etag := first.Header().Get("ETag")
+    if first.Code != http.StatusOK || etag == "" {
+        t.Fatalf("first GET = %d with ETag %q, want %d and an ETag", first.Code, etag, http.StatusOK)
+    }
+
+    if rw := get(etag); rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+        t.Errorf("GET with a matching If-None-Match = %d with %d bytes, want %d and no body", rw.Code, rw.Body.Len(), http.StatusNotModified)
+    }
+
+    usd := DefaultSettings
+    usd.Enabled = !usd.Enabled
+    c.setSettings(usd)
+
+    rw := get(etag)
+    if rw.Code != http.StatusOK {
+        t.Errorf("GET with the old ETag after a change = %d, want %d", rw.Code, http.StatusOK)
+    }
+    if newTag := rw.Header().Get("ETag"); newTag == "" || newTag == etag {
+        t.Errorf("ETag after a change = %q, want a new one", newTag)
+    }
+}
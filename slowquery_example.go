@@ -0,0 +1,115 @@
+/*
+Slow query logging.
+
+The "db" timer (ctxpkg.Timer) says how long a request spent in the database in total, but not which
+query it was. slowQueryDB wraps the *sql.DB the stores use and times every QueryContext,
+QueryRowContext and ExecContext. one that takes longer than the threshold is logged as a warning with
+the store method it came from, how long it took and the request id. a fast query logs nothing.
+
+The threshold is "slow_query_threshold" in the db settings (eg. "200ms"), and defaults to
+defaultSlowQueryThreshold.
+*/
+package examplePackage
+
+import (
+    "context"
+    "database/sql"
+    "runtime"
+    "strings"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+const defaultSlowQueryThreshold = 200 * time.Millisecond
+
+// slowQueryDB is a *sql.DB that logs slow queries. everything it doesn't override (BeginTx, Stats,
+//   etc.) is the embedded *sql.DB's.
+type slowQueryDB struct {
+    *sql.DB
+    // threshold is called per query so a settings reload changes it. nil means defaultSlowQueryThreshold.
+    threshold func() time.Duration
+}
+
+func newSlowQueryDB(db *sql.DB) *slowQueryDB {
+    return &slowQueryDB{DB: db}
+}
+
+func (d *slowQueryDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    // time.Now() is evaluated here, when the defer is declared, not when it runs.
+    defer d.logIfSlow(ctx, query, time.Now())
+    return d.DB.QueryContext(ctx, query, args...)
+}
+
+func (d *slowQueryDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+    defer d.logIfSlow(ctx, query, time.Now())
+    return d.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (d *slowQueryDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+    defer d.logIfSlow(ctx, query, time.Now())
+    return d.DB.ExecContext(ctx, query, args...)
+}
+
+// inTx is tx with the same slow query logging, for the queries a store runs inside a transaction.
+func (d *slowQueryDB) inTx(tx *sql.Tx) querier {
+    return slowQueryTx{Tx: tx, db: d}
+}
+
+type slowQueryTx struct {
+    *sql.Tx
+    db *slowQueryDB
+}
+
+func (t slowQueryTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+    defer t.db.logIfSlow(ctx, query, time.Now())
+    return t.Tx.QueryRowContext(ctx, query, args...)
+}
+
+func (t slowQueryTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+    defer t.db.logIfSlow(ctx, query, time.Now())
+    return t.Tx.ExecContext(ctx, query, args...)
+}
+
+func (d *slowQueryDB) logIfSlow(ctx context.Context, query string, start time.Time) {
+    took := time.Since(start)
+
+    threshold := defaultSlowQueryThreshold
+    if d.threshold != nil {
+        threshold = d.threshold()
+    }
+    if took < threshold {
+        return
+    }
+
+    // request_id is already in the log fields.
+    lf := ctxpkg.LogFields(ctx)
+    lf["op"] = queryOp()
+    lf["duration_ms"] = took.Milliseconds()
+    lf["threshold_ms"] = threshold.Milliseconds()
+    lf["query"] = query
+    ctxpkg.Logger(ctx).WithFields(lf).Warn("slow query")
+}
+
+// queryOp is the name of the store method that ran the query, eg. "GetUser".
+// it's only worked out for a slow query, so the cost of runtime.Caller isn't paid on every query.
+func queryOp() string {
+    // 0 is queryOp, 1 is logIfSlow, 2 is the wrapper method and 3 is whoever called it.
+    pc, _, _, ok := runtime.Caller(3)
+    if !ok {
+        return "unknown"
+    }
+    fn := runtime.FuncForPC(pc)
+    if fn == nil {
+        return "unknown"
+    }
+
+    // the full name is like "examplePackage.(*sqlUserStore).GetUser".
+    name := fn.Name()
+    return name[strings.LastIndex(name, ".")+1:]
+}
+
+// slowQueryThreshold is read per query from settings, so a reload changes it.
+func (c *Controller) slowQueryThreshold() time.Duration {
+    return c.currentSettings().DB.withDefaults().SlowQueryThreshold
+}
@@ -0,0 +1,767 @@
+/*
+The database layer.
+
+The Controller doesn't hold a *sql.DB directly. It holds a UserStore interface, so the handlers only
+know WHAT they can ask the database for, not HOW it's done. The sql implementation lives here and
+the handlers never see a query.
+*/
+package examplePackage
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    errs "errors"
+
+    ctxpkg "github.com/private-repo/context"
+)
+
+// a query starting with less time than this left on the request is likely to time out.
+const lowBudgetThreshold = 50 * time.Millisecond
+
+// UserStore is everything the handlers need from the database.
+type UserStore interface {
+    // InsertUser returns the new user, including the id and timestamps the store gave it. it's
+    //   errConflict when the email is already taken.
+    InsertUser(ctx context.Context, cur createUserRequest) (userRecord, error)
+    // InsertUserWithEvent is InsertUser plus the outbox row newEvent makes from the new user, in one
+    //   transaction. either both are stored or neither is, so a user never exists without its event.
+    //   the returned event has the id the outbox gave it.
+    InsertUserWithEvent(ctx context.Context, cur createUserRequest, newEvent func(userRecord) (event, error)) (userRecord, event, error)
+    // BulkInsertUsers is InsertUserWithEvent for every request in one transaction. it's all or nothing:
+    //   any error, including ctx being done part way through, and none of the users or events are stored.
+    BulkInsertUsers(ctx context.Context, curs []createUserRequest, newEvent func(userRecord) (event, error)) ([]userRecord, []event, error)
+    EmailExists(ctx context.Context, email string) (bool, error)
+    ListUsers(ctx context.Context, q listUsersQuery) ([]userRecord, bool, error)
+    // CountUsers is how many users match f, ignoring limit and offset.
+    CountUsers(ctx context.Context, f userFilter) (int, error)
+    // GetUser treats a soft deleted user as not found. GetUserIncludingDeleted doesn't, and is for admins.
+    GetUser(ctx context.Context, userID string) (userRecord, error)
+    GetUserIncludingDeleted(ctx context.Context, userID string) (userRecord, error)
+    // GetUsersByIDs is GetUser for several ids in one query. ids that aren't found are left out of the
+    //   result instead of being an error, and the order isn't ids' order.
+    GetUsersByIDs(ctx context.Context, ids []string) ([]userRecord, error)
+    // UserVersion is GetUser for when only existence and the version matter.
+    UserVersion(ctx context.Context, userID string) (int, error)
+    StreamUsers(ctx context.Context, f userFilter, fn func(userRecord) error) error
+    UpdateUser(ctx context.Context, p userPatch) error
+    BulkUpdateUsers(ctx context.Context, ps []userPatch) ([]error, error)
+    SoftDeleteUser(ctx context.Context, userID string) error
+    // RestoreUser undoes SoftDeleteUser. it's errNotFound for an unknown id and errConflict for a user
+    //   that isn't deleted.
+    RestoreUser(ctx context.Context, userID string) error
+}
+
+// querier is the part of *sql.DB and *sql.Tx the store uses.
+// writing the single-row logic against it means the same code runs inside or outside a transaction.
+type querier interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// userPatch is a partial update to one user.
+// Fields is keyed by column name and MUST already be checked against patchableColumns.
+// Version is the version the client last saw. the update only applies if it's still current.
+type userPatch struct {
+    ID string `json:"id"`
+    Version int `json:"version"`
+    Fields map[string]interface{} `json:"fields"`
+}
+
+// userRecord is a user as it's stored and returned to clients.
+type userRecord struct {
+    ID string `json:"id" xml:"id"`
+    Version int `json:"version" xml:"version"`
+    FullName string `json:"full_name" xml:"full_name"`
+    Address string `json:"address" xml:"address"`
+    City string `json:"city" xml:"city"`
+    State string `json:"state" xml:"state"`
+    ZipCode int `json:"zip_code" xml:"zip_code"`
+    Phone string `json:"phone,omitempty" xml:"phone,omitempty"`
+    Email string `json:"email,omitempty" xml:"email,omitempty"`
+    // CreatedAt and UpdatedAt are UTC. UpdatedAt changes with every version bump.
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+    UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+    // DeletedAt is only ever set for admins who asked for deleted users with ?include_deleted=true.
+    DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+}
+
+// userColumns is what every user SELECT reads, in the order scanUser scans it.
+const userColumns = `id, version, full_name, address, city, state, zip_code, phone, COALESCE(email, ''), created_at, updated_at, deleted_at`
+
+// rowScanner is the Scan of both *sql.Row and *sql.Rows.
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+// scanUser scans one row of userColumns.
+func scanUser(rs rowScanner) (userRecord, error) {
+    u := userRecord{}
+    var deletedAt sql.NullTime
+    if err := rs.Scan(&u.ID, &u.Version, &u.FullName, &u.Address, &u.City, &u.State, &u.ZipCode, &u.Phone, &u.Email, &u.CreatedAt, &u.UpdatedAt, &deletedAt); err != nil {
+        return u, err
+    }
+
+    // they're written in UTC, but some drivers hand times back in the local zone.
+    u.CreatedAt = u.CreatedAt.UTC()
+    u.UpdatedAt = u.UpdatedAt.UTC()
+    if deletedAt.Valid {
+        t := deletedAt.Time.UTC()
+        u.DeletedAt = &t
+    }
+    return u, nil
+}
+
+// listUsersQuery is everything that shapes the list query.
+// it's a struct so adding a new option doesn't change the UserStore interface.
+type listUsersQuery struct {
+    Limit int
+    Offset int
+    Filter userFilter
+    // AfterID starts the page after the user with this id, for cursor paging. it's only used with
+    //   OrderBy "id ASC", where "after" means the same thing as "id >".
+    AfterID string
+
+    // OrderBy is an already validated ORDER BY clause, without the keywords. eg. "full_name ASC, id ASC".
+    // it MUST only be built from sortColumns (list_handler_example.go). it's concatenated into the query.
+    OrderBy string
+}
+
+// logBudget logs how much of the request's time is left before a query runs.
+// a request that's doomed to time out shows up in the logs BEFORE the query, next to the operation name,
+//   instead of as a generic deadline exceeded error after it.
+func logBudget(ctx context.Context, op string) {
+    remaining, ok := ctxpkg.RemainingBudget(ctx)
+    if !ok {
+        return
+    }
+
+    lf := ctxpkg.LogFields(ctx)
+    lf["op"] = op
+    lf["remaining_ms"] = remaining.Milliseconds()
+
+    if remaining < lowBudgetThreshold {
+        ctxpkg.Logger(ctx).WithFields(lf).Warn("query starting with little time left on the request")
+        return
+    }
+
+    ctxpkg.Logger(ctx).WithFields(lf).Debug("query budget")
+}
+
+// userFilter narrows the user list. empty fields don't filter.
+type userFilter struct {
+    // States matches any of the listed states (an IN clause).
+    States []string
+    City string
+    // soft deleted users are left out unless IncludeDeleted is set. only admins can set it.
+    IncludeDeleted bool
+}
+
+// placeholders is n postgres placeholders numbered from first, eg. placeholders(3, 2) is "$3, $4".
+func placeholders(first, n int) string {
+    ps := make([]string, n)
+    for i := range ps {
+        ps[i] = "$" + strconv.Itoa(first+i)
+    }
+
+    return strings.Join(ps, ", ")
+}
+
+// where builds a WHERE clause and its args from the non-empty filters. its placeholders start at $1,
+//   so anything a caller adds after it is numbered from len(args)+1.
+// values ONLY ever go in as args for placeholders. the clause itself is built from constant strings,
+//   so nothing the client sends can change the shape of the query.
+func (f userFilter) where() (string, []interface{}) {
+    conds := make([]string, 0, 3)
+    args := make([]interface{}, 0, len(f.States)+1)
+
+    if !f.IncludeDeleted {
+        conds = append(conds, "deleted_at IS NULL")
+    }
+
+    if len(f.States) > 0 {
+        // one placeholder per value. eg. "state IN ($1, $2, $3)".
+        conds = append(conds, "state IN ("+placeholders(len(args)+1, len(f.States))+")")
+        for _, st := range f.States {
+            args = append(args, st)
+        }
+    }
+
+    if f.City != "" {
+        args = append(args, f.City)
+        conds = append(conds, "city = $"+strconv.Itoa(len(args)))
+    }
+
+    if len(conds) == 0 {
+        return "", nil
+    }
+
+    return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// db is wrapped so slow queries are logged. see slowquery_example.go.
+// ids makes the id for each new user. nil leaves it to the database. see idgen_example.go.
+type sqlUserStore struct {
+    db *slowQueryDB
+    ids IDGenerator
+}
+
+func newSQLUserStore(db *slowQueryDB, ids IDGenerator) *sqlUserStore {
+    return &sqlUserStore{db: db, ids: ids}
+}
+
+// InsertUser stores cur.PasswordHash. cur.Password is never read here.
+func (s *sqlUserStore) InsertUser(ctx context.Context, cur createUserRequest) (userRecord, error) {
+    logBudget(ctx, "InsertUser")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    return s.insertUser(ctx, s.db, cur)
+}
+
+func (s *sqlUserStore) InsertUserWithEvent(ctx context.Context, cur createUserRequest, newEvent func(userRecord) (event, error)) (userRecord, event, error) {
+    logBudget(ctx, "InsertUserWithEvent")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return userRecord{}, event{}, fmt.Errorf("failed to begin transaction. %w", err)
+    }
+    // Rollback after a successful Commit is a no-op, so deferring it is always safe.
+    defer tx.Rollback()
+
+    q := s.db.inTx(tx)
+    u, err := s.insertUser(ctx, q, cur)
+    if err != nil {
+        return userRecord{}, event{}, err
+    }
+
+    ev, err := newEvent(u)
+    if err != nil {
+        return userRecord{}, event{}, fmt.Errorf("failed to build event. %w", err)
+    }
+    if ev.ID, err = insertEvent(ctx, q, ev); err != nil {
+        return userRecord{}, event{}, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return userRecord{}, event{}, fmt.Errorf("failed to commit transaction. %w", err)
+    }
+
+    return u, ev, nil
+}
+
+func (s *sqlUserStore) BulkInsertUsers(ctx context.Context, curs []createUserRequest, newEvent func(userRecord) (event, error)) ([]userRecord, []event, error) {
+    logBudget(ctx, "BulkInsertUsers")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to begin transaction. %w", err)
+    }
+    // Rollback after a successful Commit is a no-op, so deferring it is always safe.
+    defer tx.Rollback()
+
+    q := s.db.inTx(tx)
+    users := make([]userRecord, 0, len(curs))
+    events := make([]event, 0, len(curs))
+    for i, cur := range curs {
+        // a client that went away (or a request that timed out) stops the loop, and the deferred
+        //   Rollback undoes the users already inserted. nobody is waiting for the rest.
+        if err := ctx.Err(); err != nil {
+            return nil, nil, fmt.Errorf("bulk insert stopped after %d of %d users. %w", i, len(curs), err)
+        }
+
+        u, err := s.insertUser(ctx, q, cur)
+        if err != nil {
+            return nil, nil, fmt.Errorf("user %d. %w", i, err)
+        }
+
+        ev, err := newEvent(u)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to build event. %w", err)
+        }
+        if ev.ID, err = insertEvent(ctx, q, ev); err != nil {
+            return nil, nil, err
+        }
+
+        users = append(users, u)
+        events = append(events, ev)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, nil, fmt.Errorf("failed to commit transaction. %w", err)
+    }
+
+    return users, events, nil
+}
+
+// insertUser is the insert shared by InsertUser, InsertUserWithEvent and BulkInsertUsers.
+func (s *sqlUserStore) insertUser(ctx context.Context, q querier, cur createUserRequest) (userRecord, error) {
+    // the timestamps come from here rather than the database's now(), so they're UTC whatever the
+    //   database's time zone is. a new user was last updated when it was created.
+    now := time.Now().UTC()
+    cols := `full_name, address, city, state, zip_code, phone, email, password_hash, created_at, updated_at`
+    args := []interface{}{
+        cur.FullName, cur.Address, cur.City, cur.State, cur.ZipCode, cur.Phone,
+        // no email is NULL, not "". the unique constraint on email ignores NULLs but would reject a second "".
+        sql.NullString{String: cur.Email, Valid: cur.Email != ""}, cur.PasswordHash, now, now,
+    }
+    // without a generator the id column is left out, so the database's default (eg. a sequence) fills it.
+    if s.ids != nil {
+        cols = `id, ` + cols
+        args = append([]interface{}{s.ids.NewID()}, args...)
+    }
+
+    u, err := scanUser(q.QueryRowContext(ctx,
+        `INSERT INTO users (`+cols+`) VALUES (`+placeholders(1, len(args))+`) RETURNING `+userColumns,
+        args...,
+    ))
+    if isUniqueViolation(err) {
+        return userRecord{}, fmt.Errorf("email %s is taken. %w", cur.Email, errConflict)
+    }
+    if err != nil {
+        return userRecord{}, fmt.Errorf("failed to insert user. %w", err)
+    }
+
+    return u, nil
+}
+
+// EmailExists reports whether any user, deleted or not, has email. the unique constraint covers
+//   deleted rows too, so they have to count here.
+func (s *sqlUserStore) EmailExists(ctx context.Context, email string) (bool, error) {
+    logBudget(ctx, "EmailExists")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    var exists int
+    err := s.db.QueryRowContext(ctx, `SELECT 1 FROM users WHERE email = $1 LIMIT 1`, email).Scan(&exists)
+    if errs.Is(err, sql.ErrNoRows) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to check email. %w", err)
+    }
+
+    return true, nil
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation, SQLSTATE 23505 (unique_violation).
+func isUniqueViolation(err error) bool {
+    var se sqlStateError
+    return errs.As(err, &se) && se.SQLState() == "23505"
+}
+
+// GetUser returns errNotFound when there's no user with userID.
+// translating sql.ErrNoRows here means the handlers never have to import database/sql.
+func (s *sqlUserStore) GetUser(ctx context.Context, userID string) (userRecord, error) {
+    logBudget(ctx, "GetUser")
+    return s.getUser(ctx, userID, `SELECT `+userColumns+` FROM users WHERE id = $1 AND deleted_at IS NULL`)
+}
+
+func (s *sqlUserStore) GetUserIncludingDeleted(ctx context.Context, userID string) (userRecord, error) {
+    logBudget(ctx, "GetUserIncludingDeleted")
+    return s.getUser(ctx, userID, `SELECT `+userColumns+` FROM users WHERE id = $1`)
+}
+
+func (s *sqlUserStore) GetUsersByIDs(ctx context.Context, ids []string) ([]userRecord, error) {
+    logBudget(ctx, "GetUsersByIDs")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    // "IN ()" is a syntax error, and there's nothing to look up anyway.
+    if len(ids) == 0 {
+        return []userRecord{}, nil
+    }
+
+    // one placeholder per id, the same as the state filter in userFilter.where.
+    args := make([]interface{}, 0, len(ids))
+    for _, id := range ids {
+        args = append(args, id)
+    }
+
+    rows, err := s.db.QueryContext(ctx,
+        `SELECT `+userColumns+` FROM users WHERE id IN (`+placeholders(1, len(ids))+`) AND deleted_at IS NULL`,
+        args...,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to query users by id. %w", err)
+    }
+    defer rows.Close()
+
+    users := make([]userRecord, 0, len(ids))
+    for rows.Next() {
+        u, err := scanUser(rows)
+        if err != nil {
+            return nil, fmt.Errorf("failed to scan user. %w", err)
+        }
+        users = append(users, u)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("failed to iterate users. %w", err)
+    }
+
+    return users, nil
+}
+
+// getUser runs query, which selects one user by id.
+func (s *sqlUserStore) getUser(ctx context.Context, userID, query string) (userRecord, error) {
+    defer ctxpkg.Timer(ctx, "db")()
+
+    u, err := scanUser(s.db.QueryRowContext(ctx, query, userID))
+    if errs.Is(err, sql.ErrNoRows) {
+        return u, fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+    if err != nil {
+        return u, fmt.Errorf("failed to get user. %w", err)
+    }
+
+    return u, nil
+}
+
+// UserVersion reads one indexed column instead of the whole row.
+func (s *sqlUserStore) UserVersion(ctx context.Context, userID string) (int, error) {
+    logBudget(ctx, "UserVersion")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    var version int
+    err := s.db.QueryRowContext(ctx, `SELECT version FROM users WHERE id = $1 AND deleted_at IS NULL`, userID).Scan(&version)
+    if errs.Is(err, sql.ErrNoRows) {
+        return 0, fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+    if err != nil {
+        return 0, fmt.Errorf("failed to get user version. %w", err)
+    }
+
+    return version, nil
+}
+
+// ListUsers returns a page of users.
+//
+// the bool is true when ctx's deadline was hit part way through reading the rows. in that case
+//   the users read so far are returned with a nil error, so the caller can decide whether a
+//   partial page is acceptable. any other error is returned as an error.
+func (s *sqlUserStore) ListUsers(ctx context.Context, q listUsersQuery) ([]userRecord, bool, error) {
+    logBudget(ctx, "ListUsers")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    orderBy := q.OrderBy
+    if orderBy == "" {
+        orderBy = "id ASC"
+    }
+
+    // placeholders can't be used for column names, so ORDER BY is the one part of the query built
+    //   with concatenation. that's only safe because OrderBy comes from a whitelist.
+    where, args := q.Filter.where()
+    // the cursor isn't part of the filter, since CountUsers counts every page, not the ones left.
+    if q.AfterID != "" {
+        args = append(args, q.AfterID)
+        after := "id > $" + strconv.Itoa(len(args))
+        if where == "" {
+            where = " WHERE " + after
+        } else {
+            where += " AND " + after
+        }
+    }
+    limitAt := len(args) + 1
+    args = append(args, q.Limit, q.Offset)
+
+    rows, err := s.db.QueryContext(ctx,
+        `SELECT `+userColumns+` FROM users`+where+` ORDER BY `+orderBy+
+            ` LIMIT $`+strconv.Itoa(limitAt)+` OFFSET $`+strconv.Itoa(limitAt+1),
+        args...,
+    )
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to query users. %w", err)
+    }
+    // always close rows. an unclosed Rows holds its connection until it's garbage collected.
+    defer rows.Close()
+
+    // i know the upper bound, so i set the capacity.
+    users := make([]userRecord, 0, q.Limit)
+    for rows.Next() {
+        u, err := scanUser(rows)
+        // the deadline can close the rows between Next and Scan, so it can surface here too.
+        if err != nil && ctx.Err() == context.DeadlineExceeded {
+            return users, true, nil
+        }
+        if err != nil {
+            return nil, false, fmt.Errorf("failed to scan user. %w", err)
+        }
+        users = append(users, u)
+    }
+
+    // rows.Next() returns false both when the rows are exhausted AND when something went wrong.
+    // rows.Err() is how you tell the difference.
+    if err := rows.Err(); err != nil {
+        if ctx.Err() == context.DeadlineExceeded {
+            return users, true, nil
+        }
+        return nil, false, fmt.Errorf("failed to iterate users. %w", err)
+    }
+
+    return users, false, nil
+}
+
+// CountUsers uses the same WHERE clause as ListUsers, so the total always agrees with the pages.
+func (s *sqlUserStore) CountUsers(ctx context.Context, f userFilter) (int, error) {
+    logBudget(ctx, "CountUsers")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    where, args := f.where()
+    var total int
+    if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+        return 0, fmt.Errorf("failed to count users. %w", err)
+    }
+
+    return total, nil
+}
+
+// StreamUsers calls fn for every user matching f, one row at a time.
+// unlike ListUsers, nothing is collected into a slice, so memory stays flat no matter how many users there are.
+// if fn returns an error, iteration stops and that error is returned.
+func (s *sqlUserStore) StreamUsers(ctx context.Context, f userFilter, fn func(userRecord) error) error {
+    logBudget(ctx, "StreamUsers")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    where, args := f.where()
+    rows, err := s.db.QueryContext(ctx,
+        `SELECT `+userColumns+` FROM users`+where+` ORDER BY id`,
+        args...,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to query users. %w", err)
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        u, err := scanUser(rows)
+        if err != nil {
+            return fmt.Errorf("failed to scan user. %w", err)
+        }
+
+        if err := fn(u); err != nil {
+            return err
+        }
+    }
+
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("failed to iterate users. %w", err)
+    }
+
+    return nil
+}
+
+// UpdateUser applies a single patch.
+func (s *sqlUserStore) UpdateUser(ctx context.Context, p userPatch) error {
+    logBudget(ctx, "UpdateUser")
+    defer ctxpkg.Timer(ctx, "db")()
+    return updateUser(ctx, s.db, p)
+}
+
+// BulkUpdateUsers applies every patch in one transaction.
+//
+// a patch that fails with errNotFound or errConflict doesn't touch any rows, so it doesn't stop the
+//   others. its error is returned at its index in the slice and the rest are committed.
+// any other error means the database itself is in trouble, so everything is rolled back and it's
+//   returned as the second value.
+func (s *sqlUserStore) BulkUpdateUsers(ctx context.Context, ps []userPatch) ([]error, error) {
+    logBudget(ctx, "BulkUpdateUsers")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to begin transaction. %w", err)
+    }
+    // Rollback after a successful Commit is a no-op, so deferring it is always safe.
+    defer tx.Rollback()
+
+    results := make([]error, len(ps))
+    for i, p := range ps {
+        // a client that went away (or a request that timed out) stops the loop. the deferred Rollback
+        //   undoes what was already updated, so it's all or nothing, like any other database error.
+        if err := ctx.Err(); err != nil {
+            return nil, fmt.Errorf("bulk update stopped after %d of %d patches. %w", i, len(ps), err)
+        }
+
+        err := updateUser(ctx, s.db.inTx(tx), p)
+        if err != nil && !errs.Is(err, errNotFound) && !errs.Is(err, errConflict) {
+            return nil, err
+        }
+        results[i] = err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit transaction. %w", err)
+    }
+
+    return results, nil
+}
+
+// updateUser is the single-row update shared by UpdateUser and BulkUpdateUsers.
+// the version check is in the WHERE clause so checking and updating is one atomic statement.
+func updateUser(ctx context.Context, q querier, p userPatch) error {
+    // +2 for the version bump and updated_at.
+    sets := make([]string, 0, len(p.Fields)+2)
+    // +3 for updated_at, and the id and version in the WHERE clause.
+    args := make([]interface{}, 0, len(p.Fields)+3)
+    for col, val := range p.Fields {
+        args = append(args, val)
+        sets = append(sets, col+" = $"+strconv.Itoa(len(args)))
+    }
+    // updated_at moves with the version, so the ETag (the version) changes exactly when updated_at does.
+    n := len(args)
+    sets = append(sets, "version = version + 1", "updated_at = $"+strconv.Itoa(n+1))
+    args = append(args, time.Now().UTC(), p.ID, p.Version)
+
+    res, err := q.ExecContext(ctx,
+        `UPDATE users SET `+strings.Join(sets, ", ")+
+            ` WHERE id = $`+strconv.Itoa(n+2)+` AND version = $`+strconv.Itoa(n+3)+` AND deleted_at IS NULL`,
+        args...,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to update user. %w", err)
+    }
+
+    affected, err := res.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to read rows affected. %w", err)
+    }
+    if affected == 1 {
+        return nil
+    }
+
+    // zero rows means either the user doesn't exist or the version was stale. find out which.
+    var exists int
+    err = q.QueryRowContext(ctx, `SELECT 1 FROM users WHERE id = $1 AND deleted_at IS NULL`, p.ID).Scan(&exists)
+    if errs.Is(err, sql.ErrNoRows) {
+        return fmt.Errorf("user %s. %w", p.ID, errNotFound)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to check user. %w", err)
+    }
+
+    return fmt.Errorf("user %s is not at version %d. %w", p.ID, p.Version, errConflict)
+}
+
+// SoftDeleteUser marks a user deleted instead of removing the row, so it can be audited or restored.
+func (s *sqlUserStore) SoftDeleteUser(ctx context.Context, userID string) error {
+    logBudget(ctx, "SoftDeleteUser")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    res, err := s.db.ExecContext(ctx,
+        `UPDATE users SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`,
+        time.Now().UTC(), userID,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to delete user. %w", err)
+    }
+
+    affected, err := res.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to read rows affected. %w", err)
+    }
+    if affected == 0 {
+        return fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+
+    return nil
+}
+
+// RestoreUser bumps the version too, so an ETag from before the delete can't be used to update the
+//   restored user.
+func (s *sqlUserStore) RestoreUser(ctx context.Context, userID string) error {
+    logBudget(ctx, "RestoreUser")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    res, err := s.db.ExecContext(ctx,
+        `UPDATE users SET deleted_at = NULL, version = version + 1, updated_at = $1 WHERE id = $2 AND deleted_at IS NOT NULL`,
+        time.Now().UTC(), userID,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to restore user. %w", err)
+    }
+
+    affected, err := res.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("failed to read rows affected. %w", err)
+    }
+    if affected == 1 {
+        return nil
+    }
+
+    // zero rows means either the user doesn't exist or it isn't deleted. find out which.
+    var exists int
+    err = s.db.QueryRowContext(ctx, `SELECT 1 FROM users WHERE id = $1`, userID).Scan(&exists)
+    if errs.Is(err, sql.ErrNoRows) {
+        return fmt.Errorf("user %s. %w", userID, errNotFound)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to check user. %w", err)
+    }
+
+    return fmt.Errorf("user %s is not deleted. %w", userID, errConflict)
+}
+
+// InsertEvent writes an event to the outbox on its own and returns its id.
+// an event for a change to a user goes through that change's transaction instead, eg. InsertUserWithEvent,
+//   so there's never a change without its event (or the other way around).
+func (s *sqlUserStore) InsertEvent(ctx context.Context, ev event) (string, error) {
+    logBudget(ctx, "InsertEvent")
+    defer ctxpkg.Timer(ctx, "db")()
+
+    return insertEvent(ctx, s.db, ev)
+}
+
+// insertEvent is the outbox insert shared by InsertEvent and the transactions that write an event.
+func insertEvent(ctx context.Context, q querier, ev event) (string, error) {
+    var id string
+    err := q.QueryRowContext(ctx,
+        `INSERT INTO outbox (type, payload, created_at) VALUES ($1, $2, $3) RETURNING id`,
+        ev.Type, ev.Payload, time.Now().UTC(),
+    ).Scan(&id)
+    if err != nil {
+        return "", fmt.Errorf("failed to insert event. %w", err)
+    }
+
+    return id, nil
+}
+
+// PendingEvents returns the oldest undispatched events.
+func (s *sqlUserStore) PendingEvents(ctx context.Context, limit int) ([]event, error) {
+    rows, err := s.db.QueryContext(ctx,
+        `SELECT id, type, payload FROM outbox WHERE dispatched_at IS NULL ORDER BY created_at LIMIT $1`,
+        limit,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to query pending events. %w", err)
+    }
+    defer rows.Close()
+
+    events := make([]event, 0, limit)
+    for rows.Next() {
+        ev := event{}
+        if err := rows.Scan(&ev.ID, &ev.Type, &ev.Payload); err != nil {
+            return nil, fmt.Errorf("failed to scan event. %w", err)
+        }
+        events = append(events, ev)
+    }
+
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("failed to iterate events. %w", err)
+    }
+
+    return events, nil
+}
+
+func (s *sqlUserStore) MarkDispatched(ctx context.Context, eventID string) error {
+    _, err := s.db.ExecContext(ctx,
+        `UPDATE outbox SET dispatched_at = $1 WHERE id = $2`,
+        time.Now().UTC(), eventID,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to mark event dispatched. %w", err)
+    }
+
+    return nil
+}
@@ -0,0 +1,191 @@
+package examplePackage
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "io"
+    "strconv"
+    "testing"
+    "time"
+    errs "errors"
+
+    "github.com/sirupsen/logrus"
+)
+
+// the placeholders have to be numbered in the same order as the args, or postgres binds a value to the wrong column.
+func TestUserFilterWhere(t *testing.T) {
+    tests := []struct {
+        name string
+        f userFilter
+        want string
+        wantArgs int
+    }{
+        {"nothing", userFilter{IncludeDeleted: true}, "", 0},
+        {"deleted only", userFilter{}, " WHERE deleted_at IS NULL", 0},
+        {"city", userFilter{City: "Austin"}, " WHERE deleted_at IS NULL AND city = $1", 1},
+        {"states and city", userFilter{States: []string{"TX", "CA"}, City: "Austin"}, " WHERE deleted_at IS NULL AND state IN ($1, $2) AND city = $3", 3},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, args := tt.f.where()
+            if got != tt.want {
+                t.Errorf("where() = %q, want %q", got, tt.want)
+            }
+            if len(args) != tt.wantArgs {
+                t.Errorf("args = %v, want %d of them", args, tt.wantArgs)
+            }
+        })
+    }
+}
+
+func TestPlaceholders(t *testing.T) {
+    if got := placeholders(3, 2); got != "$3, $4" {
+        t.Errorf("placeholders(3, 2) = %q, want %q", got, "$3, $4")
+    }
+    if got := placeholders(1, 1); got != "$1" {
+        t.Errorf("placeholders(1, 1) = %q, want %q", got, "$1")
+    }
+}
+
+// slowRowsConnector is a database whose every query returns rows users, each taking rowDelay to
+//   arrive, like a big result set from a busy database. only queries are supported.
+type slowRowsConnector struct {
+    rows int
+    rowDelay time.Duration
+}
+
+func (c slowRowsConnector) Connect(context.Context) (driver.Conn, error) { return slowRowsConn{c}, nil }
+func (c slowRowsConnector) Driver() driver.Driver { return nil }
+
+type slowRowsConn struct {
+    c slowRowsConnector
+}
+
+func (conn slowRowsConn) Prepare(string) (driver.Stmt, error) { return nil, errs.New("not supported") }
+func (conn slowRowsConn) Close() error { return nil }
+func (conn slowRowsConn) Begin() (driver.Tx, error) { return nil, errs.New("not supported") }
+
+func (conn slowRowsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+    return &slowRows{c: conn.c}, nil
+}
+
+type slowRows struct {
+    c slowRowsConnector
+    n int
+}
+
+func (r *slowRows) Columns() []string {
+    return []string{"id", "version", "full_name", "address", "city", "state", "zip_code", "phone", "email", "created_at", "updated_at", "deleted_at"}
+}
+
+func (r *slowRows) Close() error { return nil }
+
+func (r *slowRows) Next(dest []driver.Value) error {
+    if r.n >= r.c.rows {
+        return io.EOF
+    }
+    time.Sleep(r.c.rowDelay)
+    r.n++
+
+    now := time.Now()
+    row := []driver.Value{strconv.Itoa(r.n), int64(1), "Ada", "1 Main St", "Austin", "TX", int64(78701), "", "", now, now, nil}
+    copy(dest, row)
+    return nil
+}
+
+// a deadline part way through the rows gives back the rows read so far, flagged as partial, not an error.
+func TestListUsersPartial(t *testing.T) {
+    tests := []struct {
+        name string
+        rowDelay time.Duration
+        wantPartial bool
+    }{
+        {"deadline mid iteration", 20 * time.Millisecond, true},
+        {"in time", 0, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            db := sql.OpenDB(slowRowsConnector{rows: 10, rowDelay: tt.rowDelay})
+            defer db.Close()
+            s := newSQLUserStore(newSlowQueryDB(db), nil)
+
+            ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+            defer cancel()
+
+            users, partial, err := s.ListUsers(ctx, listUsersQuery{Limit: 10})
+            if err != nil {
+                t.Fatalf("ListUsers() error = %v", err)
+            }
+            if partial != tt.wantPartial {
+                t.Fatalf("partial = %v, want %v", partial, tt.wantPartial)
+            }
+            if tt.wantPartial && len(users) >= 10 {
+                t.Errorf("%d users, want fewer than all 10", len(users))
+            }
+            if !tt.wantPartial && len(users) != 10 {
+                t.Errorf("%d users, want all 10", len(users))
+            }
+        })
+    }
+}
+
+// logCapture is a logrus hook that keeps every entry, so a test can check what was logged.
+type logCapture struct {
+    entries []*logrus.Entry
+}
+
+func (lc *logCapture) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (lc *logCapture) Fire(e *logrus.Entry) error {
+    lc.entries = append(lc.entries, e)
+    return nil
+}
+
+// captureLogs adds a logCapture to the standard logger until the test ends.
+func captureLogs(t *testing.T) *logCapture {
+    std := logrus.StandardLogger()
+    hooks := logrus.LevelHooks{}
+    for lvl, hs := range std.Hooks {
+        hooks[lvl] = append([]logrus.Hook{}, hs...)
+    }
+
+    lc := &logCapture{}
+    std.AddHook(lc)
+    t.Cleanup(func() { std.ReplaceHooks(hooks) })
+
+    return lc
+}
+
+func TestLogBudgetWarnsWhenNearlyExpired(t *testing.T) {
+    tests := []struct {
+        name string
+        timeout time.Duration
+        wantWarn bool
+    }{
+        {"nearly expired", lowBudgetThreshold / 2, true},
+        {"plenty left", time.Hour, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            lc := captureLogs(t)
+            ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+            defer cancel()
+
+            logBudget(ctx, "ListUsers")
+
+            warned := false
+            for _, e := range lc.entries {
+                if e.Level == logrus.WarnLevel && e.Data["op"] == "ListUsers" {
+                    warned = true
+                }
+            }
+            if warned != tt.wantWarn {
+                t.Errorf("warned = %v, want %v (entries %v)", warned, tt.wantWarn, lc.entries)
+            }
+        })
+    }
+}
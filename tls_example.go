@@ -0,0 +1,98 @@
+/*
+Certificates get renewed (eg. every 60-90 days with let's encrypt). The naive approach is passing the
+cert and key files to server.ListenAndServeTLS(certFile, keyFile), but those are only read once at
+startup, so picking up a renewed cert means a restart.
+
+tls.Config has a GetCertificate callback that's called on every handshake. If the callback returns
+a certificate we hold in memory, we can swap that certificate whenever we want and every new
+connection uses it. Existing connections keep the cert they negotiated with, which is fine.
+*/
+package examplePackage
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/sirupsen/logrus"
+)
+
+// certReloader serves the current certificate and reloads it from disk on demand.
+type certReloader struct {
+    certFile string
+    keyFile string
+
+    // a RWMutex because every handshake reads the cert but it's only written on reload.
+    mu sync.RWMutex
+    cert *tls.Certificate
+}
+
+// newCertReloader loads the cert once up front so a bad cert fails startup instead of the first handshake.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+    cr := &certReloader{
+        certFile: certFile,
+        keyFile: keyFile,
+    }
+
+    if err := cr.reload(); err != nil {
+        return nil, err
+    }
+
+    return cr, nil
+}
+
+// reload reads and validates the cert/key pair and only swaps it in if it's good.
+// if the new files are broken (eg. a half written renewal), we keep serving the old cert.
+func (cr *certReloader) reload() error {
+    cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+    if err != nil {
+        return fmt.Errorf("failed to load key pair. %s. %w", err, errInternal)
+    }
+
+    // LoadX509KeyPair checks the key matches the cert but not that the cert is still valid.
+    leaf, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        return fmt.Errorf("failed to parse certificate. %s. %w", err, errInternal)
+    }
+
+    now := time.Now()
+    if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+        return fmt.Errorf("certificate is not valid between %s and %s. %w", leaf.NotBefore, leaf.NotAfter, errInternal)
+    }
+    cert.Leaf = leaf
+
+    cr.mu.Lock()
+    cr.cert = &cert
+    cr.mu.Unlock()
+
+    return nil
+}
+
+// GetCertificate matches the tls.Config.GetCertificate signature.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    cr.mu.RLock()
+    defer cr.mu.RUnlock()
+
+    return cr.cert, nil
+}
+
+// reloadOnSIGHUP reloads the cert every time the process receives SIGHUP.
+// a cert renewal hook (eg. certbot's --deploy-hook) only has to send `kill -HUP <pid>`.
+func (cr *certReloader) reloadOnSIGHUP() {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGHUP)
+
+    for range sigs {
+        if err := cr.reload(); err != nil {
+            logrus.WithError(err).Error("failed to reload tls certificate. keeping the current one")
+            continue
+        }
+
+        logrus.Info("reloaded tls certificate")
+    }
+}
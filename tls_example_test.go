@@ -0,0 +1,95 @@
+package examplePackage
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// writeTestCert writes a self-signed cert and its key to dir as cert.pem and key.pem, replacing
+//   any that are there.
+func writeTestCert(t *testing.T, dir string, serial int64, notAfter time.Time) {
+    t.Helper()
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(serial),
+        Subject: pkix.Name{CommonName: "localhost"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: notAfter,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+    if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0o600); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func servedSerial(t *testing.T, cr *certReloader) int64 {
+    t.Helper()
+
+    cert, err := cr.GetCertificate(&tls.ClientHelloInfo{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    leaf, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return leaf.SerialNumber.Int64()
+}
+
+// a renewed cert is served after a reload. an expired one is refused and the current one kept.
+func TestCertReloaderReload(t *testing.T) {
+    dir := t.TempDir()
+    writeTestCert(t, dir, 1, time.Now().Add(time.Hour))
+
+    cr, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := servedSerial(t, cr); got != 1 {
+        t.Fatalf("serving serial %d, want 1", got)
+    }
+
+    writeTestCert(t, dir, 2, time.Now().Add(time.Hour))
+    if err := cr.reload(); err != nil {
+        t.Fatalf("reload() = %v", err)
+    }
+    if got := servedSerial(t, cr); got != 2 {
+        t.Errorf("serving serial %d after the reload, want 2", got)
+    }
+
+    writeTestCert(t, dir, 3, time.Now().Add(-time.Minute))
+    if err := cr.reload(); err == nil {
+        t.Error("reload() of an expired cert = nil, want an error")
+    }
+    if got := servedSerial(t, cr); got != 2 {
+        t.Errorf("serving serial %d after a failed reload, want 2", got)
+    }
+}
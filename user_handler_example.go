@@ -0,0 +1,502 @@
+/*
+Handlers for a single user, /v1/user/:user_id.
+*/
+package examplePackage
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    errs "errors"
+
+    "gihub.com/husobee/vestigo"
+    ctxpkg "github.com/private-repo/context"
+)
+
+// GET /v1/user/:user_id?fields=id,full_name
+// responds 304 with no body when If-None-Match matches the user's current ETag.
+func (c *Controller) GetUserHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    userID := vestigo.Param(req, "user_id")
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "GetUser"
+    // the caller's own id (if any) is already in lf as user_id, so the user being read gets its own key.
+    lf["target_user_id"] = ctxpkg.SanitizeLogValue(userID)
+    n := c.negotiator(req)
+
+    result, err := c.handleGetUser(ctx, req, userID)
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to get user")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errNotFound) {
+            n.Respond(rw, http.StatusNotFound, response.Error(nil))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    if notModified(rw, req, result.etag) {
+        return
+    }
+
+    n.Respond(rw, http.StatusOK, response.Success(result.body))
+}
+
+// HEAD /v1/user/:user_id
+// an existence check: 200 with the ETag, or 404, and never a body. a cache uses it to decide whether
+//   its copy is still current before spending a conditional GET.
+func (c *Controller) HeadUserHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    userID := vestigo.Param(req, "user_id")
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "HeadUser"
+    lf["target_user_id"] = ctxpkg.SanitizeLogValue(userID)
+
+    version, err := c.userVersion(ctx, userID)
+    if err != nil {
+        if errs.Is(err, errNotFound) {
+            rw.WriteHeader(http.StatusNotFound)
+            return
+        }
+
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to check user")
+        rw.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    // the same ETag a GET of the full user returns.
+    rw.Header().Set("ETag", versionETag(version))
+    rw.WriteHeader(http.StatusOK)
+}
+
+// userVersion uses the cached user when there is one, the same as getUser, so HEAD and GET agree.
+func (c *Controller) userVersion(ctx context.Context, userID string) (int, error) {
+    if v, ok := c.userCache.Get(userID); ok {
+        return v.(userRecord).Version, nil
+    }
+
+    version, err := c.DB.UserVersion(ctx, userID)
+    if err != nil && !errs.Is(err, errNotFound) {
+        return 0, fmt.Errorf("failed to get user version. %s. %w", err, errInternal)
+    }
+
+    return version, err
+}
+
+// getUserResult is the body GetUser sends plus the ETag that goes with it.
+type getUserResult struct {
+    body interface{}
+    etag string
+}
+
+// handleGetUser's body is either the full userRecord or, when ?fields= is given, a fieldSet with
+//   only the requested keys.
+// the full record's ETag is its version, which is what a client sends back in If-Match to update it.
+//   a ?fields= selection is a different representation, so it gets a weak ETag hashed from the
+//   selected fields and the version. json and xml share the ETag either way.
+// a soft deleted user is a 404 unless an admin asks for it with ?include_deleted=true.
+func (c *Controller) handleGetUser(ctx context.Context, req *http.Request, userID string) (getUserResult, error) {
+    result := getUserResult{}
+
+    includeDeleted, err := parseIncludeDeleted(ctx, queryParams(req))
+    if err != nil {
+        return result, err
+    }
+
+    var user userRecord
+    if includeDeleted {
+        // straight to the store. the cache only ever holds users that aren't deleted.
+        user, err = c.DB.GetUserIncludingDeleted(ctx, userID)
+        if err != nil && !errs.Is(err, errNotFound) {
+            err = fmt.Errorf("failed to get user. %s. %w", err, errInternal)
+        }
+    } else {
+        user, err = c.getUser(ctx, userID)
+    }
+    if err != nil {
+        return result, err
+    }
+
+    fields := parseFields(req.URL.Query().Get("fields"))
+    if len(fields) == 0 {
+        result.body = user
+        result.etag = versionETag(user.Version)
+        return result, nil
+    }
+
+    fs, err := selectFields(user, fields)
+    if err != nil {
+        return result, fmt.Errorf("failed to select fields. %s. %w", err, errInternal)
+    }
+
+    etag, err := computeETag(fs, strconv.Itoa(user.Version))
+    if err != nil {
+        return result, fmt.Errorf("failed to compute user etag. %s. %w", err, errInternal)
+    }
+
+    result.body = fs
+    result.etag = etag
+    return result, nil
+}
+
+// PATCH /v1/user/:user_id
+// the body is the fields to change, eg. {"city": "Oakland"}, and If-Match must be the ETag from GetUser.
+// two clients editing the same user can't silently overwrite each other. the second one's If-Match
+//   is stale, so it gets 412 and has to re-read the user first.
+func (c *Controller) UpdateUserHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    userID := vestigo.Param(req, "user_id")
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "UpdateUser"
+    lf["target_user_id"] = ctxpkg.SanitizeLogValue(userID)
+    n := c.negotiator(req)
+
+    user, err := c.handleUpdateUser(ctx, req, userID)
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to update user")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        // the same 422 problem+json as creating or replacing a user.
+        var ve validationErrors
+        if errs.As(err, &ve) {
+            writeProblem(rw, validationProblem(req, ve))
+        } else if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errPreconditionRequired) {
+            n.Respond(rw, http.StatusPreconditionRequired, response.Error(err))
+        } else if errs.Is(err, errNotFound) {
+            n.Respond(rw, http.StatusNotFound, response.Error(nil))
+        } else if errs.Is(err, errConflict) {
+            n.Respond(rw, http.StatusPreconditionFailed, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    // the new ETag lets the client make its next update without another GET.
+    rw.Header().Set("ETag", versionETag(user.Version))
+    n.Respond(rw, http.StatusOK, response.Success(user))
+}
+
+func (c *Controller) handleUpdateUser(ctx context.Context, req *http.Request, userID string) (userRecord, error) {
+    user := userRecord{}
+
+    version, err := requireIfMatch(req)
+    if err != nil {
+        return user, err
+    }
+
+    // the fields are a map, which only json can fill.
+    if err := requireJSONBody(req); err != nil {
+        return user, err
+    }
+    fields := map[string]interface{}{}
+    if err := decodeRequestBody(req, &fields); err != nil {
+        return user, err
+    }
+
+    p, err := validatePatch(ctx, userPatch{ID: userID, Version: version, Fields: fields})
+    if err != nil {
+        return user, err
+    }
+
+    return c.applyUserPatch(ctx, p)
+}
+
+// PUT /v1/user/:user_id
+// the body is a whole createUserRequest and replaces the user, where PATCH only changes what's sent.
+//   a field left out is an error (the same validation as creating a user), not "leave it as it is".
+// email and password aren't part of a replace. changing either needs its own flow (verification, the
+//   old password), so a body with either one is a 400 rather than silently keeping the old value.
+// If-Match is required for the same reason as PATCH.
+func (c *Controller) ReplaceUserHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    userID := vestigo.Param(req, "user_id")
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "ReplaceUser"
+    lf["target_user_id"] = ctxpkg.SanitizeLogValue(userID)
+    n := c.negotiator(req)
+
+    user, err := c.handleReplaceUser(ctx, req, userID)
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to replace user")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        var ve validationErrors
+        if errs.As(err, &ve) {
+            writeProblem(rw, validationProblem(req, ve))
+        } else if errs.Is(err, errUnprocessable) {
+            n.Respond(rw, http.StatusUnprocessableEntity, response.Error(err))
+        } else if errs.Is(err, errBadRequest) {
+            n.Respond(rw, http.StatusBadRequest, response.Error(err))
+        } else if errs.Is(err, errPreconditionRequired) {
+            n.Respond(rw, http.StatusPreconditionRequired, response.Error(err))
+        } else if errs.Is(err, errNotFound) {
+            n.Respond(rw, http.StatusNotFound, response.Error(nil))
+        } else if errs.Is(err, errConflict) {
+            n.Respond(rw, http.StatusPreconditionFailed, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    rw.Header().Set("ETag", versionETag(user.Version))
+    n.Respond(rw, http.StatusOK, response.Success(user))
+}
+
+func (c *Controller) handleReplaceUser(ctx context.Context, req *http.Request, userID string) (userRecord, error) {
+    user := userRecord{}
+
+    version, err := requireIfMatch(req)
+    if err != nil {
+        return user, err
+    }
+
+    cur := createUserRequest{}
+    if err := decodeRequestBody(req, &cur); err != nil {
+        return user, err
+    }
+
+    if cur.Email != "" || cur.Password != "" {
+        return user, fmt.Errorf("email and password can't be changed with PUT. leave them out. %w", errBadRequest)
+    }
+
+    cur.Normalize()
+    err = validateCreateUserRequest(cur)
+    var ve validationErrors
+    if errs.As(err, &ve) {
+        err = ve.localize(ctxpkg.GetLocale(ctx))
+    }
+    if err != nil {
+        return user, fmt.Errorf("failed to validate replace user request. %w. %w", err, errUnprocessable)
+    }
+
+    // every replaceable column is set, so nothing from the old version survives.
+    // the values have the same types validatePatch leaves in a PATCH, which is what the stores expect.
+    return c.applyUserPatch(ctx, userPatch{
+        ID: userID,
+        Version: version,
+        Fields: map[string]interface{}{
+            "full_name": cur.FullName,
+            "address": cur.Address,
+            "city": cur.City,
+            "state": cur.State,
+            "zip_code": cur.ZipCode,
+            "phone": cur.Phone,
+        },
+    })
+}
+
+// POST /v1/user/:user_id/restore
+// undoes a soft delete. 404 when the user never existed, 409 when it isn't deleted.
+func (c *Controller) RestoreUserHandler(rw http.ResponseWriter, req *http.Request) {
+    ctx := req.Context()
+    userID := vestigo.Param(req, "user_id")
+    lf := ctxpkg.LogFields(ctx)
+    lf["handler"] = "RestoreUser"
+    lf["target_user_id"] = ctxpkg.SanitizeLogValue(userID)
+    n := c.negotiator(req)
+
+    user, err := c.handleRestoreUser(ctx, userID)
+    if err != nil {
+        ctxpkg.Logger(ctx).WithFields(lf).WithError(err).Error("failed to restore user")
+
+        if c.respondHTTPError(rw, req, err) {
+            return
+        }
+
+        if errs.Is(err, errNotFound) {
+            n.Respond(rw, http.StatusNotFound, response.Error(nil))
+        } else if errs.Is(err, errConflict) {
+            n.Respond(rw, http.StatusConflict, response.Error(err))
+        } else if errs.Is(err, errInternal) {
+            n.Respond(rw, http.StatusInternalServerError, response.Error(nil))
+        }
+        return
+    }
+
+    rw.Header().Set("ETag", versionETag(user.Version))
+    n.Respond(rw, http.StatusOK, response.Success(user))
+}
+
+func (c *Controller) handleRestoreUser(ctx context.Context, userID string) (userRecord, error) {
+    if err := c.DB.RestoreUser(ctx, userID); err != nil {
+        if errs.Is(err, errNotFound) || errs.Is(err, errConflict) {
+            return userRecord{}, err
+        }
+        return userRecord{}, fmt.Errorf("failed to restore user. %s. %w", err, errInternal)
+    }
+
+    // nothing should be cached for a deleted user, but a stale entry would hide the restore.
+    c.userCache.Delete(userID)
+
+    if err := c.recordAudit(ctx, auditUserRestore, userID); err != nil {
+        return userRecord{}, err
+    }
+
+    return c.getUser(ctx, userID)
+}
+
+// requireIfMatch reads the version a write is based on. without If-Match it's errPreconditionRequired.
+func requireIfMatch(req *http.Request) (int, error) {
+    ifMatch := req.Header.Get("If-Match")
+    if ifMatch == "" {
+        return 0, fmt.Errorf("If-Match is required to update a user. %w", errPreconditionRequired)
+    }
+
+    return parseVersionETag(ifMatch)
+}
+
+// applyUserPatch writes a validated patch and returns the user as it is now.
+func (c *Controller) applyUserPatch(ctx context.Context, p userPatch) (userRecord, error) {
+    user := userRecord{}
+    userID := p.ID
+
+    if err := c.DB.UpdateUser(ctx, p); err != nil {
+        if errs.Is(err, errNotFound) || errs.Is(err, errConflict) {
+            return user, err
+        }
+        return user, fmt.Errorf("failed to update user. %s. %w", err, errInternal)
+    }
+
+    // the cached copy is stale now.
+    c.userCache.Delete(userID)
+
+    if err := c.recordAudit(ctx, auditUserUpdate, userID); err != nil {
+        return user, err
+    }
+
+    // reading back through getUser refills the cache with the new version.
+    return c.getUser(ctx, userID)
+}
+
+// versionETag is the strong ETag for a user at version v, eg. "3".
+// it's strong because If-Match uses strong comparison, and a version number identifies exactly one state.
+func versionETag(v int) string {
+    return `"` + strconv.Itoa(v) + `"`
+}
+
+// parseVersionETag reads the version back out of an If-Match header.
+// "*" and lists of ETags are rejected. an update has to name the one version it was based on.
+func parseVersionETag(ifMatch string) (int, error) {
+    raw := strings.TrimSpace(ifMatch)
+    if strings.HasPrefix(raw, "W/") {
+        return 0, fmt.Errorf("If-Match must be a strong ETag. %w", errBadRequest)
+    }
+
+    v, err := strconv.Atoi(strings.Trim(raw, `"`))
+    if err != nil || v < 0 {
+        return 0, fmt.Errorf("If-Match %q is not a user ETag. %w", ifMatch, errBadRequest)
+    }
+
+    return v, nil
+}
+
+// getUser reads through the user cache.
+func (c *Controller) getUser(ctx context.Context, userID string) (userRecord, error) {
+    if v, ok := c.userCache.Get(userID); ok {
+        return v.(userRecord), nil
+    }
+
+    user, err := c.DB.GetUser(ctx, userID)
+    if err != nil {
+        if errs.Is(err, errNotFound) {
+            return user, err
+        }
+        return user, fmt.Errorf("failed to get user. %s. %w", err, errInternal)
+    }
+
+    c.userCache.Set(userID, user)
+    return user, nil
+}
+
+// parseFields turns "id,full_name" into a whitelist.
+// a map[string]struct{} would use slightly less memory, but map[string]bool reads better at the call site
+//   (if fields[k]) and the map is tiny.
+func parseFields(raw string) map[string]bool {
+    if raw == "" {
+        return nil
+    }
+
+    fields := make(map[string]bool)
+    for _, f := range strings.Split(raw, ",") {
+        if f = strings.TrimSpace(f); f != "" {
+            fields[f] = true
+        }
+    }
+
+    return fields
+}
+
+// fieldSet is a response with only some of its fields.
+type fieldSet map[string]interface{}
+
+// selectFields marshals v to json and keeps only the whitelisted keys.
+// going through json (instead of reflecting on the struct) means the keys are the json tag names
+//   the client already knows, and any custom MarshalJSON on v is respected.
+// unknown field names are ignored. the client just doesn't get them back.
+func selectFields(v interface{}, fields map[string]bool) (fieldSet, error) {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+
+    // through decodeJSON so a big number comes back out exactly as it went in.
+    all := fieldSet{}
+    if err := decodeJSON(bytes.NewReader(b), &all); err != nil {
+        return nil, err
+    }
+
+    fs := make(fieldSet, len(fields))
+    for k, val := range all {
+        if fields[k] {
+            fs[k] = val
+        }
+    }
+
+    return fs, nil
+}
+
+// MarshalXML lets a fieldSet be negotiated as xml. encoding/xml can't marshal maps on its own.
+// keys are sorted so the output is deterministic.
+func (fs fieldSet) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+    start.Name.Local = "user"
+    if err := e.EncodeToken(start); err != nil {
+        return err
+    }
+
+    keys := make([]string, 0, len(fs))
+    for k := range fs {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        if err := e.EncodeElement(fs[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+            return err
+        }
+    }
+
+    return e.EncodeToken(start.End())
+}
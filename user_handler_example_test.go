@@ -0,0 +1,81 @@
+package examplePackage
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestReplaceUserRejectsEmailAndPassword(t *testing.T) {
+    ctx := context.Background()
+    store := newMemUserStore()
+    u, err := store.InsertUser(ctx, createUserRequest{FullName: "Ann", Email: "ann@example.com"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := &Controller{DB: store}
+
+    whole := `"full_name": "Ann Lee", "address": "1 Main St", "city": "Oakland", "state": "CA", "zip_code": 94607`
+    tests := []struct {
+        name string
+        body string
+        wantStatus int
+    }{
+        {"email", `{` + whole + `, "email": "new@example.com"}`, http.StatusBadRequest},
+        {"password", `{` + whole + `, "password": "hunter22hunter22"}`, http.StatusBadRequest},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodPut, "/v1/user/"+u.ID, strings.NewReader(tt.body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("If-Match", versionETag(u.Version))
+
+            _, err := c.handleReplaceUser(ctx, req, u.ID)
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Errorf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+        })
+    }
+}
+
+// a PATCH body is a map of fields, which xml can't express, so xml is a 415 instead of a confusing 400.
+func TestUpdateUserContentType(t *testing.T) {
+    tests := []struct {
+        contentType string
+        body string
+        wantStatus int
+    }{
+        {"application/json", `{"city": "Austin"}`, 0},
+        {"application/json; charset=utf-8", `{"city": "Austin"}`, 0},
+        {"", `{"city": "Austin"}`, 0},
+        {"application/xml", `<user><city>Austin</city></user>`, http.StatusUnsupportedMediaType},
+        {"text/xml", `<user><city>Austin</city></user>`, http.StatusUnsupportedMediaType},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.contentType, func(t *testing.T) {
+            ctx := context.Background()
+            store := newMemUserStore()
+            u, err := store.InsertUser(ctx, createUserRequest{FullName: "Ann"})
+            if err != nil {
+                t.Fatal(err)
+            }
+            c := &Controller{DB: store, userCache: newTTLCache(time.Minute)}
+
+            req := httptest.NewRequest(http.MethodPatch, "/v1/user/"+u.ID, strings.NewReader(tt.body))
+            if tt.contentType != "" {
+                req.Header.Set("Content-Type", tt.contentType)
+            }
+            req.Header.Set("If-Match", versionETag(u.Version))
+
+            _, err = c.handleUpdateUser(ctx, req, u.ID)
+            if status := errStatus(err); status != tt.wantStatus {
+                t.Errorf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+            }
+        })
+    }
+}
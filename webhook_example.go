@@ -0,0 +1,144 @@
+/*
+Webhooks tell downstream systems about a new user by POSTing the createUserResponse to the url in settings.
+
+Delivery is best effort and never part of the api call. The handler queues the notification on the
+jobQueue (jobqueue_example.go) and returns. A slow or broken receiver costs us a log line, not a failed
+signup, and a flood of signups fills the bounded queue instead of spawning a goroutine each.
+*/
+package examplePackage
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "math/rand"
+    "net/http"
+    "time"
+
+    ctxpkg "github.com/private-repo/context"
+    "github.com/sirupsen/logrus"
+)
+
+type webhookConfig struct {
+    // Timeout bounds each attempt, not the whole delivery.
+    Timeout time.Duration
+    Retry retryConfig
+}
+
+var defaultWebhookConfig = webhookConfig{
+    Timeout: 5 * time.Second,
+    Retry: retryConfig{
+        MaxAttempts: 3,
+        BaseDelay: 200 * time.Millisecond,
+        MaxDelay: 2 * time.Second,
+    },
+}
+
+// webhookJob is one notification. the request id is copied out of the request's context because
+//   the job outlives the request.
+type webhookJob struct {
+    requestID string
+    body []byte
+}
+
+type webhookNotifier struct {
+    cfg webhookConfig
+    // url is read when the job is sent, so a settings reload changes the target without a restart.
+    // an empty url means webhooks are off.
+    url func() string
+    client *http.Client
+    jobs *jobQueue
+}
+
+func newWebhookNotifier(cfg webhookConfig, jobs *jobQueue, url func() string) *webhookNotifier {
+    return &webhookNotifier{
+        cfg: cfg,
+        url: url,
+        client: &http.Client{Timeout: cfg.Timeout},
+        jobs: jobs,
+    }
+}
+
+// webhookURL reads the webhook url from the current settings.
+func (c *Controller) webhookURL() string {
+    return c.currentSettings().WebhookURL
+}
+
+// Notify queues v to be POSTed as json. it never fails the caller.
+func (w *webhookNotifier) Notify(ctx context.Context, v interface{}) {
+    if w == nil || w.url() == "" {
+        return
+    }
+
+    lf := ctxpkg.LogFields(ctx)
+    body, err := json.Marshal(v)
+    if err != nil {
+        logrus.WithFields(lf).WithError(err).Error("failed to marshal webhook body")
+        return
+    }
+
+    job := webhookJob{requestID: ctxpkg.GetRequestID(ctx), body: body}
+    if !w.jobs.Enqueue(func(ctx context.Context) { w.deliver(ctx, job) }) {
+        logrus.WithFields(lf).Warn("job queue is full or shutting down. webhook dropped")
+    }
+}
+
+// deliver POSTs one job, retrying with the same full jitter backoff as getSettingsWithRetry.
+func (w *webhookNotifier) deliver(ctx context.Context, job webhookJob) {
+    lf := logrus.Fields{"request_id": job.requestID}
+    rc := w.cfg.Retry
+
+    delay := rc.BaseDelay
+    var err error
+    for attempt := 1; attempt <= rc.MaxAttempts; attempt++ {
+        if err = w.post(ctx, job); err == nil {
+            return
+        }
+
+        if attempt == rc.MaxAttempts {
+            break
+        }
+
+        logrus.WithFields(lf).WithError(err).WithField("attempt", attempt).Warn("webhook failed. retrying")
+
+        select {
+        case <-ctx.Done():
+            logrus.WithFields(lf).WithError(ctx.Err()).Warn("webhook abandoned at the shutdown deadline")
+            return
+        case <-time.After(time.Duration(rand.Int63n(int64(delay) + 1))):
+        }
+
+        delay *= 2
+        if delay > rc.MaxDelay {
+            delay = rc.MaxDelay
+        }
+    }
+
+    logrus.WithFields(lf).WithError(err).Error("webhook failed. giving up")
+}
+
+func (w *webhookNotifier) post(ctx context.Context, job webhookJob) error {
+    ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url(), bytes.NewReader(job.body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", mediaTypeJSON)
+    // the receiver can use it to correlate with our logs, and to drop a retried duplicate.
+    req.Header.Set("X-Request-ID", job.requestID)
+
+    resp, err := w.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("webhook returned %d", resp.StatusCode)
+    }
+
+    return nil
+}